@@ -1,18 +1,100 @@
 package api
 
+// Headers carrying the fields of requests and responses with a raw
+// application/octet-stream payload, instead of a JSON body
+const (
+	IdHeader          = "X-Id"
+	KeyHeader         = "X-Key"
+	VersionHeader     = "X-Version"
+	TTLSecondsHeader  = "X-Ttl-Seconds"
+	MaxReadsHeader    = "X-Max-Reads"
+	IfMatchHeader     = "X-If-Match"
+	ContentTypeHeader = "X-Content-Type"
+	PassphraseHeader  = "X-Passphrase"
+	RecipientsHeader  = "X-Recipients"
+	IdentityHeader    = "X-Identity"
+	ShareHeader       = "X-Share"
+
+	SplitSharesHeader    = "X-Split-Shares"
+	SplitThresholdHeader = "X-Split-Threshold"
+	KeySharesHeader      = "X-Key-Shares"
+)
+
+// ContentTypeOctetStream marks a raw payload
+const ContentTypeOctetStream = "application/octet-stream"
+
+// Error codes tell apart the errors of unsuccessful responses. Unlike the
+// status message, they are part of the API and don't change
+const (
+	ErrorCodeNotFound   = "not_found"
+	ErrorCodeInvalidKey = "invalid_key"
+	ErrorCodeConflict   = "conflict"
+)
+
 type Response struct {
 	StatusCode    int         `json:"status_code"`
 	StatusMessage string      `json:"status_message"`
+	ErrorCode     string      `json:"error_code,omitempty"`
 	Result        interface{} `json:"result,omitempty"`
 	Errors        []string    `json:"errors,omitempty"`
 }
 
+// IdMessage is a text to store or a retrieved one. On store, IfMatch
+// replaces the text with that version instead of creating a new one, and a
+// Passphrase derives the key from it instead of generating a random one.
+// Recipients, base64 X25519 public keys, encrypt the text to them instead,
+// it can then only be retrieved with the identity of one of them.
+// SplitShares and SplitThreshold return the key split into that many Shamir
+// shares, any SplitThreshold of which retrieve the text. Version is set on
+// retrieve. ContentType is the media type of the payload, kept with
+// the text and returned on retrieve
 type IdMessage struct {
-	Id      string `json:"id"`
-	Payload string `json:"payload"`
+	Id          string   `json:"id"`
+	Payload     string   `json:"payload"`
+	TTLSeconds  int64    `json:"ttl_seconds,omitempty"`
+	MaxReads    int      `json:"max_reads,omitempty"`
+	IfMatch     int      `json:"if_match,omitempty"`
+	Version     int      `json:"version,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Passphrase  string   `json:"passphrase,omitempty"`
+	Recipients  []string `json:"recipients,omitempty"`
+
+	SplitShares    int `json:"split_shares,omitempty"`
+	SplitThreshold int `json:"split_threshold,omitempty"`
 }
 
+// IdKeyPair identifies a text and proves access to it, with either its key,
+// the passphrase it was stored with or the base64 X25519 identity of one of
+// its recipients. With Share, the identity is that of the recipient of the
+// named share instead. KeyShares, base64 Shamir shares of the key, stand in
+// for the key of a text stored with SplitShares. The result of storing a
+// text with a passphrase or with recipients has no key, that of storing it
+// with SplitShares has KeyShares instead
 type IdKeyPair struct {
-	Id  string `json:"id"`
-	Key string `json:"key"`
+	Id         string   `json:"id"`
+	Key        string   `json:"key,omitempty"`
+	KeyShares  []string `json:"key_shares,omitempty"`
+	Passphrase string   `json:"passphrase,omitempty"`
+	Identity   string   `json:"identity,omitempty"`
+	Share      string   `json:"share,omitempty"`
+	Version    int      `json:"version,omitempty"`
+}
+
+// ShareRequest shares a text with the recipient with the base64 X25519
+// public key Recipient under Name, or revokes the share called Name. The
+// text is opened like on retrieve, a share can't be used for that
+type ShareRequest struct {
+	IdKeyPair
+	Name      string `json:"name"`
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// Shares lists the names of the shares of a text
+type Shares struct {
+	Id     string   `json:"id"`
+	Shares []string `json:"shares"`
+}
+
+type Id struct {
+	Id string `json:"id"`
 }
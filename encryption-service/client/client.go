@@ -1,39 +1,512 @@
 package client
 
 import (
-	"github.com/akh-dev/encrypt/encryption-service/config"
-	"github.com/akh-dev/encrypt/encryption-service/engine"
-	"github.com/akh-dev/encrypt/encryption-service/service"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/encryption-service/api"
 )
 
+const DefaultTimeout = 10 * time.Second
+
+// EncryptionClient talks to the encryption-server over its HTTP API
 type EncryptionClient struct {
-	service *service.Service
+	baseURL string
+	client  *http.Client
+	timeout time.Duration
+}
+
+type Option func(*EncryptionClient)
+
+// WithTimeout limits how long a single call may take, in addition to any
+// deadline of the context passed to it. Zero disables the limit
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *EncryptionClient) {
+		c.timeout = timeout
+	}
+}
+
+// WithHTTPClient replaces the http.Client used for requests, e.g. to
+// configure TLS or a proxy
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *EncryptionClient) {
+		c.client = client
+	}
+}
+
+// StoreOption sets an optional setting of a stored text
+type StoreOption func(*api.IdMessage)
+
+// WithTTL makes the encryption-server forget the text after ttl, rounded
+// down to whole seconds
+func WithTTL(ttl time.Duration) StoreOption {
+	return func(req *api.IdMessage) {
+		req.TTLSeconds = int64(ttl / time.Second)
+	}
+}
+
+// WithMaxReads makes the encryption-server delete the text once it has been
+// retrieved n times
+func WithMaxReads(n int) StoreOption {
+	return func(req *api.IdMessage) {
+		req.MaxReads = n
+	}
+}
+
+// WithIfMatch replaces the text stored with the same id if it is still at
+// version, instead of failing with ErrConflict
+func WithIfMatch(version int) StoreOption {
+	return func(req *api.IdMessage) {
+		req.IfMatch = version
+	}
+}
+
+// WithContentType stores the media type of the payload with it, it is
+// returned by Retrieve
+func WithContentType(contentType string) StoreOption {
+	return func(req *api.IdMessage) {
+		req.ContentType = contentType
+	}
+}
+
+// WithPassphrase derives the key of the text from passphrase on the server,
+// instead of generating a random one. The result of Store has no key then,
+// the text is retrieved with RetrieveWithPassphrase
+func WithPassphrase(passphrase string) StoreOption {
+	return func(req *api.IdMessage) {
+		req.Passphrase = passphrase
+	}
+}
+
+// WithRecipients encrypts the text to the X25519 public keys of its
+// recipients, instead of with a key returned to the caller. The result of
+// Store has no key then, the text is retrieved with RetrieveWithIdentity and
+// the private key of one of the recipients. See engine.GenerateIdentity
+func WithRecipients(recipients ...[]byte) StoreOption {
+	return func(req *api.IdMessage) {
+		for _, recipient := range recipients {
+			req.Recipients = append(req.Recipients, base64.StdEncoding.EncodeToString(recipient))
+		}
+	}
+}
+
+// WithKeyShares returns the key split into n Shamir shares instead, any
+// threshold of which retrieve the text once they are put together with
+// shamir.Combine. The key isn't wrapped with the server's KEK then, so no
+// single holder of a share or of the KEK can decrypt the text
+func WithKeyShares(n, threshold int) StoreOption {
+	return func(req *api.IdMessage) {
+		req.SplitShares = n
+		req.SplitThreshold = threshold
+	}
+}
+
+// New creates a client for the encryption-server at baseURL, e.g.
+// "http://localhost:8080"
+func New(baseURL string, opts ...Option) (*EncryptionClient, error) {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, errors.Errorf("base url %q must start with http:// or https://", baseURL)
+	}
+
+	c := &EncryptionClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  http.DefaultClient,
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+func (c *EncryptionClient) Store(ctx context.Context, id, payload []byte, opts ...StoreOption) (*StoreResult, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	return c.StoreStream(ctx, id, bytes.NewReader(payload), opts...)
 }
 
-func New() (*EncryptionClient, error) {
-	cfg, err := config.Get()
+// StoreStream is Store with the payload read from src and sent as it is
+// read. It isn't limited by WithTimeout, only by ctx
+func (c *EncryptionClient) StoreStream(ctx context.Context, id []byte, src io.Reader, opts ...StoreOption) (*StoreResult, error) {
+	req := &api.IdMessage{
+		Id: string(id),
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+
+	// the payload is sent raw, JSON strings can't carry arbitrary bytes
+	header := http.Header{}
+	header.Set("Content-Type", api.ContentTypeOctetStream)
+	if req.Id != "" {
+		header.Set(api.IdHeader, req.Id)
+	}
+	if req.ContentType != "" {
+		header.Set(api.ContentTypeHeader, req.ContentType)
+	}
+	if req.TTLSeconds != 0 {
+		header.Set(api.TTLSecondsHeader, strconv.FormatInt(req.TTLSeconds, 10))
+	}
+	if req.MaxReads != 0 {
+		header.Set(api.MaxReadsHeader, strconv.Itoa(req.MaxReads))
+	}
+	if req.IfMatch != 0 {
+		header.Set(api.IfMatchHeader, strconv.Itoa(req.IfMatch))
+	}
+	if req.Passphrase != "" {
+		header.Set(api.PassphraseHeader, req.Passphrase)
+	}
+	if len(req.Recipients) > 0 {
+		header.Set(api.RecipientsHeader, strings.Join(req.Recipients, ","))
+	}
+	if req.SplitShares != 0 || req.SplitThreshold != 0 {
+		header.Set(api.SplitSharesHeader, strconv.Itoa(req.SplitShares))
+		header.Set(api.SplitThresholdHeader, strconv.Itoa(req.SplitThreshold))
+	}
+
+	r, err := c.open(ctx, http.MethodPost, "/store", header, src)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to load config")
+		return nil, err
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &api.IdKeyPair{}
+	if err := parseResponse(r, body, result); err != nil {
+		return nil, err
+	}
+
+	var aesKey []byte
+	if result.Key != "" {
+		aesKey, err = base64.StdEncoding.DecodeString(result.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed key in the response")
+		}
 	}
 
-	encryptionEngine, err := engine.NewAESEngine()
+	keyShares := [][]byte{}
+	for _, share := range result.KeyShares {
+		decoded, err := base64.StdEncoding.DecodeString(share)
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed key share in the response")
+		}
+		keyShares = append(keyShares, decoded)
+	}
+	if len(keyShares) == 0 {
+		keyShares = nil
+	}
+
+	return &StoreResult{Id: []byte(result.Id), Key: aesKey, KeyShares: keyShares, Version: result.Version}, nil
+}
+
+func (c *EncryptionClient) Retrieve(ctx context.Context, id, aesKey []byte) (*RetrieveResult, error) {
+	return c.retrieve(ctx, id, keyCredentials(aesKey))
+}
+
+func (c *EncryptionClient) RetrieveWithPassphrase(ctx context.Context, id []byte, passphrase string) (*RetrieveResult, error) {
+	return c.retrieve(ctx, id, passphraseCredentials(passphrase))
+}
+
+func (c *EncryptionClient) RetrieveWithIdentity(ctx context.Context, id, identity []byte) (*RetrieveResult, error) {
+	return c.retrieve(ctx, id, identityCredentials(identity))
+}
+
+// RetrieveShare is Retrieve for a text shared with the recipient of
+// identity under name
+func (c *EncryptionClient) RetrieveShare(ctx context.Context, id []byte, name string, identity []byte) (*RetrieveResult, error) {
+	credentials := identityCredentials(identity)
+	credentials.Set(api.ShareHeader, name)
+	return c.retrieve(ctx, id, credentials)
+}
+
+func (c *EncryptionClient) retrieve(ctx context.Context, id []byte, credentials http.Header) (*RetrieveResult, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	payload := &bytes.Buffer{}
+	result, err := c.retrieveStream(ctx, id, credentials, payload)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to initialise encryption service")
+		return nil, err
 	}
+	result.Payload = payload.Bytes()
 
-	s, err := service.New(cfg, encryptionEngine)
+	return result, nil
+}
 
-	client := &EncryptionClient{service: s}
+// RetrieveStream is Retrieve with the payload written to dst as it arrives,
+// the returned result has no Payload. If it fails after the payload started
+// arriving, dst holds only a part of it. It isn't limited by WithTimeout,
+// only by ctx
+func (c *EncryptionClient) RetrieveStream(ctx context.Context, id, aesKey []byte, dst io.Writer) (*RetrieveResult, error) {
+	return c.retrieveStream(ctx, id, keyCredentials(aesKey), dst)
+}
 
-	return client, nil
+func (c *EncryptionClient) RetrieveStreamWithPassphrase(ctx context.Context, id []byte, passphrase string, dst io.Writer) (*RetrieveResult, error) {
+	return c.retrieveStream(ctx, id, passphraseCredentials(passphrase), dst)
 }
 
-func (c *EncryptionClient) Store(id, payload []byte) (aesKey []byte, err error) {
-	return c.service.ProcessStore(id, payload)
+func (c *EncryptionClient) RetrieveStreamWithIdentity(ctx context.Context, id, identity []byte, dst io.Writer) (*RetrieveResult, error) {
+	return c.retrieveStream(ctx, id, identityCredentials(identity), dst)
 }
 
-func (c *EncryptionClient) Retrieve(id, aesKey []byte) (payload []byte, err error) {
-	return c.service.ProcessRetrieve(id, payload)
+func (c *EncryptionClient) retrieveStream(ctx context.Context, id []byte, credentials http.Header, dst io.Writer) (*RetrieveResult, error) {
+	header := credentials.Clone()
+	header.Set(api.IdHeader, string(id))
+	header.Set("Accept", api.ContentTypeOctetStream)
+
+	r, err := c.open(ctx, http.MethodGet, "/retrieve", header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// errors are always JSON, a raw payload comes with its id
+	if r.StatusCode == http.StatusOK && r.Header.Get(api.IdHeader) != "" {
+		defer r.Body.Close()
+		version, err := strconv.Atoi(r.Header.Get(api.VersionHeader))
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed version in the response")
+		}
+		if _, err := io.Copy(dst, r.Body); err != nil {
+			return nil, errors.Wrap(err, "failed to read payload")
+		}
+		return &RetrieveResult{Version: version, ContentType: r.Header.Get("Content-Type")}, nil
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &api.IdMessage{}
+	if err := parseResponse(r, body, result); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(dst, result.Payload); err != nil {
+		return nil, errors.Wrap(err, "failed to write payload")
+	}
+
+	return &RetrieveResult{Version: result.Version, ContentType: result.ContentType}, nil
+}
+
+func (c *EncryptionClient) Delete(ctx context.Context, id, aesKey []byte) error {
+	req := &api.IdKeyPair{
+		Id:  string(id),
+		Key: base64.StdEncoding.EncodeToString(aesKey),
+	}
+
+	return c.do(ctx, http.MethodDelete, "/delete", req, &api.Id{})
+}
+
+func (c *EncryptionClient) DeleteWithPassphrase(ctx context.Context, id []byte, passphrase string) error {
+	req := &api.IdKeyPair{
+		Id:         string(id),
+		Passphrase: passphrase,
+	}
+
+	return c.do(ctx, http.MethodDelete, "/delete", req, &api.Id{})
+}
+
+func (c *EncryptionClient) DeleteWithIdentity(ctx context.Context, id, identity []byte) error {
+	req := &api.IdKeyPair{
+		Id:       string(id),
+		Identity: base64.StdEncoding.EncodeToString(identity),
+	}
+
+	return c.do(ctx, http.MethodDelete, "/delete", req, &api.Id{})
+}
+
+// Share shares the text with the owner of the X25519 public key recipient
+// under name, and returns the names of all its shares
+func (c *EncryptionClient) Share(ctx context.Context, id, aesKey []byte, name string, recipient []byte) ([]string, error) {
+	req := &api.ShareRequest{
+		IdKeyPair: api.IdKeyPair{
+			Id:  string(id),
+			Key: base64.StdEncoding.EncodeToString(aesKey),
+		},
+		Name:      name,
+		Recipient: base64.StdEncoding.EncodeToString(recipient),
+	}
+
+	result := &api.Shares{}
+	if err := c.do(ctx, http.MethodPost, "/share", req, result); err != nil {
+		return nil, err
+	}
+
+	return result.Shares, nil
+}
+
+// Revoke removes the share called name from the text, and returns the names
+// of the remaining shares
+func (c *EncryptionClient) Revoke(ctx context.Context, id, aesKey []byte, name string) ([]string, error) {
+	req := &api.ShareRequest{
+		IdKeyPair: api.IdKeyPair{
+			Id:  string(id),
+			Key: base64.StdEncoding.EncodeToString(aesKey),
+		},
+		Name: name,
+	}
+
+	result := &api.Shares{}
+	if err := c.do(ctx, http.MethodPost, "/revoke", req, result); err != nil {
+		return nil, err
+	}
+
+	return result.Shares, nil
+}
+
+// keyCredentials are the headers proving access to a text with its key
+func keyCredentials(aesKey []byte) http.Header {
+	header := http.Header{}
+	header.Set(api.KeyHeader, base64.StdEncoding.EncodeToString(aesKey))
+	return header
+}
+
+// passphraseCredentials are the headers proving access to a text with the
+// passphrase it was stored with
+func passphraseCredentials(passphrase string) http.Header {
+	header := http.Header{}
+	header.Set(api.PassphraseHeader, passphrase)
+	return header
+}
+
+// identityCredentials are the headers proving access to a text with the
+// identity of one of its recipients
+func identityCredentials(identity []byte) http.Header {
+	header := http.Header{}
+	header.Set(api.IdentityHeader, base64.StdEncoding.EncodeToString(identity))
+	return header
+}
+
+// do sends a JSON request and decodes the result of a successful response
+// into result
+func (c *EncryptionClient) do(ctx context.Context, method, uri string, reqObj, result interface{}) error {
+	buf, err := json.Marshal(reqObj)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	r, body, err := c.send(ctx, method, uri, header, buf)
+	if err != nil {
+		return err
+	}
+
+	return parseResponse(r, body, result)
+}
+
+// send performs a request and returns the response with its whole body
+func (c *EncryptionClient) send(ctx context.Context, method, uri string, header http.Header, reqBody []byte) (*http.Response, []byte, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	r, err := c.open(ctx, method, uri, header, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r, body, nil
+}
+
+// open performs a request and returns the response, whose body has to be
+// closed
+func (c *EncryptionClient) open(ctx context.Context, method, uri string, header http.Header, reqBody io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+uri, reqBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header = header
+
+	r, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to perform request")
+	}
+
+	return r, nil
+}
+
+// readBody reads and closes the body of a response
+func readBody(r *http.Response) ([]byte, error) {
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	return body, nil
+}
+
+// parseResponse decodes the result of a successful JSON response into
+// result, or returns the error of an unsuccessful one
+func parseResponse(r *http.Response, body []byte, result interface{}) error {
+	parsed := &struct {
+		api.Response
+		Result json.RawMessage `json:"result,omitempty"`
+	}{}
+	if err := json.Unmarshal(body, parsed); err != nil {
+		return &ServerError{StatusCode: r.StatusCode, Message: http.StatusText(r.StatusCode)}
+	}
+
+	if err := responseError(&parsed.Response); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(parsed.Result, result); err != nil {
+		return errors.Wrap(err, "failed to parse response result")
+	}
+
+	return nil
+}
+
+// responseError maps the status of a response to the client's errors. The
+// status code in the body is authoritative, the server doesn't always
+// mirror it in the HTTP status. Errors sharing a status code are told apart
+// by their error code
+func responseError(resp *api.Response) error {
+	switch {
+	case resp.StatusCode == 0:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.ErrorCode == api.ErrorCodeInvalidKey:
+		return ErrBadKey
+	case resp.StatusCode == http.StatusConflict:
+		return ErrConflict
+	default:
+		return &ServerError{
+			StatusCode: resp.StatusCode,
+			Message:    resp.StatusMessage,
+			Errors:     resp.Errors,
+		}
+	}
 }
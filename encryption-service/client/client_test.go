@@ -0,0 +1,606 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/akh-dev/encrypt/encryption-service/api"
+	"github.com/akh-dev/encrypt/encryption-service/config"
+	"github.com/akh-dev/encrypt/encryption-service/engine"
+	"github.com/akh-dev/encrypt/encryption-service/service"
+	"github.com/akh-dev/encrypt/storage-service/backend"
+	storageConfig "github.com/akh-dev/encrypt/storage-service/config"
+	storage "github.com/akh-dev/encrypt/storage-service/service"
+)
+
+// fooPayload is the text stored as foo, it isn't valid UTF-8
+var fooPayload = []byte("foo bar\x00\xff")
+
+// fakeServer mimics the responses of the encryption-server for a single
+// stored text
+func fakeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var resp *api.Response
+		switch r.URL.Path {
+		case "/store":
+			body, _ := ioutil.ReadAll(r.Body)
+			ttlSeconds, _ := strconv.Atoi(r.Header.Get(api.TTLSecondsHeader))
+			ifMatch, _ := strconv.Atoi(r.Header.Get(api.IfMatchHeader))
+			req := &api.IdMessage{Id: r.Header.Get(api.IdHeader), Payload: string(body), TTLSeconds: int64(ttlSeconds), IfMatch: ifMatch}
+			switch {
+			case r.Header.Get("Content-Type") != api.ContentTypeOctetStream || !bytes.Equal(body, fooPayload):
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusBadRequest, StatusMessage: "unexpected payload"}
+			case req.TTLSeconds < 0:
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusBadRequest, StatusMessage: "bad request"}
+			case r.Header.Get(api.RecipientsHeader) != "" && r.Header.Get(api.RecipientsHeader) != "YWxpY2U=,Ym9i":
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusBadRequest, StatusMessage: "unexpected recipients"}
+			case req.Id == "foo" && req.IfMatch != 1:
+				w.WriteHeader(http.StatusConflict)
+				resp = &api.Response{StatusCode: http.StatusConflict, StatusMessage: "Conflict"}
+			default:
+				if req.Id == "" {
+					req.Id = "generated"
+				}
+				result := api.IdKeyPair{Id: req.Id, Key: "a2V5", Version: req.IfMatch + 1}
+				if r.Header.Get(api.PassphraseHeader) != "" || r.Header.Get(api.RecipientsHeader) != "" {
+					result.Key = ""
+				}
+				if r.Header.Get(api.SplitSharesHeader) == "3" && r.Header.Get(api.SplitThresholdHeader) == "2" {
+					result.Key = ""
+					result.KeyShares = []string{"AWE=", "AmI=", "A2M="}
+				}
+				resp = &api.Response{StatusMessage: "Success", Result: result}
+			}
+		case "/retrieve":
+			req := &api.IdKeyPair{Id: r.Header.Get(api.IdHeader), Key: r.Header.Get(api.KeyHeader)}
+			switch {
+			case req.Id != "foo":
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusNotFound, StatusMessage: "Not Found"}
+			case req.Key != "a2V5" && r.Header.Get(api.PassphraseHeader) != "secret" && r.Header.Get(api.IdentityHeader) != "aWRlbnRpdHk=",
+				r.Header.Get(api.ShareHeader) != "" && r.Header.Get(api.ShareHeader) != "alice":
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusBadRequest, StatusMessage: "invalid key", ErrorCode: api.ErrorCodeInvalidKey}
+			default:
+				w.Header().Set("Content-Type", "application/x-foo")
+				w.Header().Set(api.IdHeader, req.Id)
+				w.Header().Set(api.VersionHeader, "1")
+				w.Write(fooPayload)
+				return
+			}
+		case "/delete":
+			req := &api.IdKeyPair{}
+			json.NewDecoder(r.Body).Decode(req)
+			if req.Id != "foo" {
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusNotFound, StatusMessage: "Not Found"}
+			} else {
+				resp = &api.Response{StatusMessage: "Success", Result: api.Id{Id: req.Id}}
+			}
+		case "/share", "/revoke":
+			req := &api.ShareRequest{}
+			json.NewDecoder(r.Body).Decode(req)
+			switch {
+			case req.Id != "foo":
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusNotFound, StatusMessage: "Not Found"}
+			case req.Key != "a2V5":
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &api.Response{StatusCode: http.StatusBadRequest, StatusMessage: "invalid key", ErrorCode: api.ErrorCodeInvalidKey}
+			case r.URL.Path == "/share":
+				resp = &api.Response{StatusMessage: "Success", Result: api.Shares{Id: req.Id, Shares: []string{req.Name, "bob"}}}
+			default:
+				resp = &api.Response{StatusMessage: "Success", Result: api.Shares{Id: req.Id, Shares: []string{"bob"}}}
+			}
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			return
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			resp = &api.Response{StatusCode: http.StatusInternalServerError, StatusMessage: "internal server error"}
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+// realServer runs the encryption-service in front of a storage-service with
+// a memory backend, so the tests see the responses the client has to handle.
+// The backend is returned to tamper with the stored records
+func realServer(t *testing.T) (*httptest.Server, *backend.MemoryBackend) {
+	return realServerWith(t, nil)
+}
+
+// realServerWith is realServer with the storage-service's handler wrapped in
+// wrap, to intervene between the requests of the encryption-service
+func realServerWith(t *testing.T, wrap func(http.Handler) http.Handler) (*httptest.Server, *backend.MemoryBackend) {
+	memory, _ := backend.NewMemoryBackend()
+	storageService, err := storage.New(&storageConfig.Config{Hash: storageConfig.HashConf{Salt: "salt"}}, memory, slog.Default())
+	if err != nil {
+		t.Fatalf("failed to create storage-service : %s", err.Error())
+	}
+	storageHandler := storageService.Handler()
+	if wrap != nil {
+		storageHandler = wrap(storageHandler)
+	}
+	storageServer := httptest.NewServer(storageHandler)
+	t.Cleanup(storageServer.Close)
+
+	storageURL, _ := url.Parse(storageServer.URL)
+	cfg := &config.Config{
+		Service: config.ServiceConf{CtxTimeout: 10, AllowClientIds: true},
+		Storage: config.StorageServiceConf{
+			Host:        storageURL.Hostname(),
+			Port:        storageURL.Port(),
+			StoreUri:    "/store",
+			RetrieveUri: "/retrieve",
+			MetadataUri: "/metadata",
+			DeleteUri:   "/delete",
+			ConsumeUri:  "/consume",
+			ScanUri:     "/scan",
+		},
+		Passphrase: config.PassphraseConf{Time: 1, Memory: 64, Threads: 1},
+	}
+	aes, _ := engine.NewAESEngine()
+	encryptionService, err := service.New(cfg, aes, slog.Default())
+	if err != nil {
+		t.Fatalf("failed to create encryption-service : %s", err.Error())
+	}
+
+	server := httptest.NewServer(encryptionService.Handler())
+	t.Cleanup(server.Close)
+	return server, memory
+}
+
+func TestEncryptionService(t *testing.T) {
+	server, _ := realServer(t)
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	stored, err := c.Store(ctx, []byte("foo"), fooPayload)
+	if err != nil {
+		t.Fatalf("failed to store : %s", err.Error())
+	}
+
+	retrieved, err := c.Retrieve(ctx, []byte("foo"), stored.Key)
+	if err != nil || !bytes.Equal(retrieved.Payload, fooPayload) || retrieved.Version != 1 {
+		t.Errorf("expected the stored text at version 1, got %+v (%v)", retrieved, err)
+	}
+
+	wrongKey := bytes.Repeat([]byte{1}, 32)
+	if _, err := c.Retrieve(ctx, []byte("foo"), wrongKey); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey for a wrong key, got %v", err)
+	}
+	if _, err := c.Retrieve(ctx, []byte("foo"), []byte("short")); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey for a malformed key, got %v", err)
+	}
+	if _, err := c.RetrieveWithPassphrase(ctx, []byte("foo"), "secret"); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey for a passphrase of a text stored with a key, got %v", err)
+	}
+	if err := c.Delete(ctx, []byte("foo"), wrongKey); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey deleting with a wrong key, got %v", err)
+	}
+
+	if _, err := c.Retrieve(ctx, []byte("missing"), stored.Key); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := c.Store(ctx, []byte("foo"), fooPayload); err != ErrConflict {
+		t.Errorf("expected ErrConflict storing an existing id, got %v", err)
+	}
+	if _, err := c.Store(ctx, []byte("foo"), fooPayload, WithIfMatch(2)); err != ErrConflict {
+		t.Errorf("expected ErrConflict replacing the wrong version, got %v", err)
+	}
+
+	_, err = c.Store(ctx, []byte("bar"), fooPayload, WithTTL(-time.Second))
+	if serverErr, ok := err.(*ServerError); !ok || serverErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad request *ServerError for a negative ttl, got %v", err)
+	}
+
+	if err := c.Delete(ctx, []byte("foo"), stored.Key); err != nil {
+		t.Fatalf("failed to delete : %s", err.Error())
+	}
+	if _, err := c.Retrieve(ctx, []byte("foo"), stored.Key); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestEncryptionServiceRecipients(t *testing.T) {
+	server, _ := realServer(t)
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	alice, aliceRecipient, _ := engine.GenerateIdentity()
+	bob, bobRecipient, _ := engine.GenerateIdentity()
+	eve, _, _ := engine.GenerateIdentity()
+
+	if _, err := c.StoreStream(ctx, []byte("foo"), bytes.NewReader(fooPayload), WithRecipients(aliceRecipient[:], bobRecipient[:])); err != nil {
+		t.Fatalf("failed to store : %s", err.Error())
+	}
+
+	retrieved, err := c.RetrieveWithIdentity(ctx, []byte("foo"), alice[:])
+	if err != nil || !bytes.Equal(retrieved.Payload, fooPayload) {
+		t.Errorf("expected the stored text, got %+v (%v)", retrieved, err)
+	}
+	dst := &bytes.Buffer{}
+	if _, err := c.RetrieveStreamWithIdentity(ctx, []byte("foo"), bob[:], dst); err != nil || !bytes.Equal(dst.Bytes(), fooPayload) {
+		t.Errorf("expected the stored text streamed, got %q (%v)", dst.Bytes(), err)
+	}
+	if _, err := c.RetrieveWithIdentity(ctx, []byte("foo"), eve[:]); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey for an identity that isn't a recipient, got %v", err)
+	}
+
+	stored, err := c.Store(ctx, []byte("bar"), fooPayload)
+	if err != nil {
+		t.Fatalf("failed to store : %s", err.Error())
+	}
+	if _, err := c.RetrieveStreamWithIdentity(ctx, []byte("bar"), alice[:], io.Discard); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey for an identity of a text stored with a key, got %v", err)
+	}
+	if _, err := c.Retrieve(ctx, []byte("bar"), stored.Key); err != nil {
+		t.Errorf("expected the text to be left alone, got %v", err)
+	}
+
+	if err := c.DeleteWithIdentity(ctx, []byte("foo"), alice[:]); err != nil {
+		t.Fatalf("failed to delete : %s", err.Error())
+	}
+	if _, err := c.RetrieveWithIdentity(ctx, []byte("foo"), alice[:]); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestStreamMaxReads checks that a streamed retrieve of a text with limited
+// reads doesn't use up a read when a segment after the first fails to
+// authenticate
+func TestStreamMaxReads(t *testing.T) {
+	server, memory := realServer(t)
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	stored, err := c.StoreStream(ctx, []byte("limited"), bytes.NewReader(payload), WithMaxReads(2))
+	if err != nil {
+		t.Fatalf("failed to store : %s", err.Error())
+	}
+
+	keys, _ := memory.List()
+	if len(keys) != 1 {
+		t.Fatalf("expected a single stored record, got %v", keys)
+	}
+	record, _ := memory.Get(keys[0])
+	ciphertext := append([]byte(nil), record.Payload...)
+	record.Payload[len(record.Payload)-1] ^= 1
+	memory.Put(keys[0], record)
+
+	dst := &bytes.Buffer{}
+	if _, err := c.RetrieveStream(ctx, []byte("limited"), stored.Key, dst); err == nil {
+		t.Fatalf("expected the corrupted text to fail")
+	}
+	if dst.Len() != 0 {
+		t.Errorf("expected nothing to be written for a corrupted text, got %d bytes", dst.Len())
+	}
+
+	record.Payload = ciphertext
+	memory.Put(keys[0], record)
+
+	for i := 0; i < 2; i++ {
+		dst.Reset()
+		if _, err := c.RetrieveStream(ctx, []byte("limited"), stored.Key, dst); err != nil || !bytes.Equal(dst.Bytes(), payload) {
+			t.Fatalf("read %d failed : %v", i+1, err)
+		}
+	}
+	if _, err := c.RetrieveStream(ctx, []byte("limited"), stored.Key, io.Discard); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound once the reads are used up, got %v", err)
+	}
+}
+
+// TestConsumeReplaced checks that the read of a text replaced between its
+// retrieve and the read being counted isn't counted against the new version
+func TestConsumeReplaced(t *testing.T) {
+	var c *EncryptionClient
+	var replaced *StoreResult
+	ctx := context.Background()
+
+	server, _ := realServerWith(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/consume" && replaced == nil {
+				var err error
+				if replaced, err = c.Store(ctx, []byte("foo"), []byte("replaced"), WithMaxReads(1), WithIfMatch(1)); err != nil {
+					t.Errorf("failed to replace : %s", err.Error())
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	c, _ = New(server.URL)
+
+	stored, err := c.Store(ctx, []byte("foo"), fooPayload, WithMaxReads(1))
+	if err != nil {
+		t.Fatalf("failed to store : %s", err.Error())
+	}
+	if _, err := c.Retrieve(ctx, []byte("foo"), stored.Key); err != ErrConflict {
+		t.Errorf("expected ErrConflict for a text replaced while it was read, got %v", err)
+	}
+	if replaced == nil {
+		t.Fatal("the text wasn't replaced")
+	}
+
+	retrieved, err := c.Retrieve(ctx, []byte("foo"), replaced.Key)
+	if err != nil || string(retrieved.Payload) != "replaced" || retrieved.Version != 2 {
+		t.Errorf("expected the replacement to be left unread, got %+v (%v)", retrieved, err)
+	}
+	if _, err := c.Retrieve(ctx, []byte("foo"), replaced.Key); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound once the replacement is read, got %v", err)
+	}
+}
+
+func TestStoreRetrieve(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("failed to create client : %s", err.Error())
+	}
+	ctx := context.Background()
+
+	stored, err := c.Store(ctx, []byte("bar"), fooPayload)
+	if err != nil {
+		t.Fatalf("failed to store : %s", err.Error())
+	}
+	if !bytes.Equal(stored.Key, []byte("key")) {
+		t.Errorf("keys don't match. expected %s, got %s", "key", stored.Key)
+	}
+	if stored.Version != 1 {
+		t.Errorf("expected version 1, got %d", stored.Version)
+	}
+	key := stored.Key
+
+	if !bytes.Equal(stored.Id, []byte("bar")) {
+		t.Errorf("ids don't match. expected %s, got %s", "bar", stored.Id)
+	}
+
+	stored, err = c.Store(ctx, nil, fooPayload)
+	if err != nil {
+		t.Fatalf("failed to store without an id : %s", err.Error())
+	}
+	if !bytes.Equal(stored.Id, []byte("generated")) {
+		t.Errorf("expected the server generated id, got %s", stored.Id)
+	}
+
+	if _, err := c.Store(ctx, []byte("foo"), fooPayload); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+
+	retrieved, err := c.Retrieve(ctx, []byte("foo"), key)
+	if err != nil {
+		t.Fatalf("failed to retrieve : %s", err.Error())
+	}
+	if !bytes.Equal(retrieved.Payload, fooPayload) {
+		t.Errorf("texts don't match. expected %q, got %q", fooPayload, retrieved.Payload)
+	}
+	if retrieved.ContentType != "application/x-foo" {
+		t.Errorf("expected content type %s, got %s", "application/x-foo", retrieved.ContentType)
+	}
+
+	stored, err = c.Store(ctx, []byte("foo"), fooPayload, WithIfMatch(retrieved.Version))
+	if err != nil {
+		t.Fatalf("failed to replace : %s", err.Error())
+	}
+	if stored.Version != 2 {
+		t.Errorf("expected version 2 after replacing, got %d", stored.Version)
+	}
+
+	if _, err := c.Retrieve(ctx, []byte("bar"), key); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := c.Retrieve(ctx, []byte("foo"), []byte("wrong")); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey, got %v", err)
+	}
+
+	if err := c.Delete(ctx, []byte("foo"), key); err != nil {
+		t.Errorf("failed to delete : %s", err.Error())
+	}
+
+	if err := c.Delete(ctx, []byte("bar"), key); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStoreRetrieveStream(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	// a reader of unknown length is sent chunked
+	stored, err := c.StoreStream(ctx, []byte("bar"), iotest.OneByteReader(bytes.NewReader(fooPayload)))
+	if err != nil {
+		t.Fatalf("failed to store a stream : %s", err.Error())
+	}
+	if !bytes.Equal(stored.Key, []byte("key")) {
+		t.Errorf("keys don't match. expected %s, got %s", "key", stored.Key)
+	}
+
+	payload := &bytes.Buffer{}
+	retrieved, err := c.RetrieveStream(ctx, []byte("foo"), stored.Key, payload)
+	if err != nil {
+		t.Fatalf("failed to retrieve a stream : %s", err.Error())
+	}
+	if !bytes.Equal(payload.Bytes(), fooPayload) {
+		t.Errorf("texts don't match. expected %q, got %q", fooPayload, payload.Bytes())
+	}
+	if retrieved.Version != 1 || retrieved.Payload != nil {
+		t.Errorf("expected version 1 without a payload, got %+v", retrieved)
+	}
+
+	if _, err := c.RetrieveStream(ctx, []byte("bar"), stored.Key, payload); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	stored, err := c.Store(ctx, []byte("bar"), fooPayload, WithPassphrase("secret"))
+	if err != nil {
+		t.Fatalf("failed to store with a passphrase : %s", err.Error())
+	}
+	if stored.Key != nil {
+		t.Errorf("expected no key for a text stored with a passphrase, got %q", stored.Key)
+	}
+
+	retrieved, err := c.RetrieveWithPassphrase(ctx, []byte("foo"), "secret")
+	if err != nil {
+		t.Fatalf("failed to retrieve with a passphrase : %s", err.Error())
+	}
+	if !bytes.Equal(retrieved.Payload, fooPayload) {
+		t.Errorf("texts don't match. expected %q, got %q", fooPayload, retrieved.Payload)
+	}
+
+	if _, err := c.RetrieveWithPassphrase(ctx, []byte("foo"), "wrong"); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey, got %v", err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	stored, err := c.Store(ctx, []byte("bar"), fooPayload, WithRecipients([]byte("alice"), []byte("bob")))
+	if err != nil {
+		t.Fatalf("failed to store with recipients : %s", err.Error())
+	}
+	if stored.Key != nil {
+		t.Errorf("expected no key for a text stored with recipients, got %q", stored.Key)
+	}
+
+	retrieved, err := c.RetrieveWithIdentity(ctx, []byte("foo"), []byte("identity"))
+	if err != nil {
+		t.Fatalf("failed to retrieve with an identity : %s", err.Error())
+	}
+	if !bytes.Equal(retrieved.Payload, fooPayload) {
+		t.Errorf("texts don't match. expected %q, got %q", fooPayload, retrieved.Payload)
+	}
+
+	if _, err := c.RetrieveWithIdentity(ctx, []byte("foo"), []byte("other")); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey, got %v", err)
+	}
+}
+
+func TestShare(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL)
+	ctx := context.Background()
+
+	shares, err := c.Share(ctx, []byte("foo"), []byte("key"), "alice", []byte("alice's public key"))
+	if err != nil {
+		t.Fatalf("failed to share : %s", err.Error())
+	}
+	if strings.Join(shares, ",") != "alice,bob" {
+		t.Errorf("expected shares alice and bob, got %v", shares)
+	}
+
+	retrieved, err := c.RetrieveShare(ctx, []byte("foo"), "alice", []byte("identity"))
+	if err != nil {
+		t.Fatalf("failed to retrieve share : %s", err.Error())
+	}
+	if !bytes.Equal(retrieved.Payload, fooPayload) {
+		t.Errorf("texts don't match. expected %q, got %q", fooPayload, retrieved.Payload)
+	}
+
+	if _, err := c.RetrieveShare(ctx, []byte("foo"), "carol", []byte("identity")); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey for another share, got %v", err)
+	}
+
+	shares, err = c.Revoke(ctx, []byte("foo"), []byte("key"), "alice")
+	if err != nil {
+		t.Fatalf("failed to revoke : %s", err.Error())
+	}
+	if strings.Join(shares, ",") != "bob" {
+		t.Errorf("expected share bob, got %v", shares)
+	}
+
+	if _, err := c.Share(ctx, []byte("foo"), []byte("wrong"), "alice", []byte("alice's public key")); err != ErrBadKey {
+		t.Errorf("expected ErrBadKey, got %v", err)
+	}
+}
+
+func TestKeyShares(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL)
+
+	stored, err := c.Store(context.Background(), []byte("bar"), fooPayload, WithKeyShares(3, 2))
+	if err != nil {
+		t.Fatalf("failed to store with key shares : %s", err.Error())
+	}
+	if stored.Key != nil {
+		t.Errorf("expected no key for a text stored with key shares, got %q", stored.Key)
+	}
+	if len(stored.KeyShares) != 3 || string(stored.KeyShares[1]) != "\x02b" {
+		t.Errorf("expected 3 decoded key shares, got %q", stored.KeyShares)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL)
+
+	err := c.do(context.Background(), http.MethodGet, "/broken", struct{}{}, &struct{}{})
+	serverErr, ok := err.(*ServerError)
+	if !ok {
+		t.Fatalf("expected a *ServerError, got %v", err)
+	}
+	if serverErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status code %d, got %d", http.StatusInternalServerError, serverErr.StatusCode)
+	}
+
+	_, err = c.Store(context.Background(), []byte("foo"), fooPayload, WithTTL(-time.Second))
+	serverErr, ok = err.(*ServerError)
+	if !ok || serverErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad request *ServerError for a negative ttl, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c, _ := New(server.URL, WithTimeout(10*time.Millisecond))
+
+	err := c.do(context.Background(), http.MethodGet, "/slow", struct{}{}, &struct{}{})
+	if err == nil {
+		t.Error("expected the request to time out but got success")
+	}
+}
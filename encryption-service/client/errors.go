@@ -0,0 +1,36 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned when there is no text stored with the id
+	ErrNotFound = errors.New("text not found")
+
+	// ErrBadKey is returned when the key doesn't decrypt the stored text
+	ErrBadKey = errors.New("invalid key")
+
+	// ErrConflict is returned when storing a text would overwrite another
+	// one, or the text to replace has been changed since it was read
+	ErrConflict = errors.New("text already exists or has been changed")
+)
+
+// ServerError is returned for any other unsuccessful response of the
+// encryption-server
+type ServerError struct {
+	StatusCode int
+	Message    string
+	Errors     []string
+}
+
+func (e *ServerError) Error() string {
+	msg := fmt.Sprintf("encryption-server returned %d - %s", e.StatusCode, e.Message)
+	if len(e.Errors) > 0 {
+		msg += ": " + strings.Join(e.Errors, ", ")
+	}
+	return msg
+}
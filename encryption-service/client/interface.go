@@ -1,13 +1,89 @@
 package client
 
+import (
+	"context"
+	"io"
+)
+
 // Client provides functionality to interact with the encryption-server
 type Client interface {
 	// Store accepts an id and a payload in bytes and requests that the
-	// encryption-server stores them in its data store
-	Store(id, payload []byte) (aesKey []byte, err error)
+	// encryption-server stores them in its data store. With an empty id the
+	// server generates one, returned in the result. It returns ErrConflict
+	// if the id is taken, unless WithIfMatch names the version to replace
+	Store(ctx context.Context, id, payload []byte, opts ...StoreOption) (*StoreResult, error)
+
+	// StoreStream is Store for a payload too large to be held in memory, it
+	// is encrypted as it is read from src
+	StoreStream(ctx context.Context, id []byte, src io.Reader, opts ...StoreOption) (*StoreResult, error)
 
 	// Retrieve accepts an id and an AES key, and requests that the
 	// encryption-server retrieves the original (decrypted) bytes stored
 	// with the provided id
-	Retrieve(id, aesKey []byte) (payload []byte, err error)
+	Retrieve(ctx context.Context, id, aesKey []byte) (*RetrieveResult, error)
+
+	// RetrieveStream is Retrieve for a payload too large to be held in
+	// memory, it is written to dst as it is decrypted
+	RetrieveStream(ctx context.Context, id, aesKey []byte, dst io.Writer) (*RetrieveResult, error)
+
+	// RetrieveWithPassphrase and RetrieveStreamWithPassphrase are Retrieve
+	// and RetrieveStream for a text stored WithPassphrase
+	RetrieveWithPassphrase(ctx context.Context, id []byte, passphrase string) (*RetrieveResult, error)
+	RetrieveStreamWithPassphrase(ctx context.Context, id []byte, passphrase string, dst io.Writer) (*RetrieveResult, error)
+
+	// RetrieveWithIdentity and RetrieveStreamWithIdentity are Retrieve and
+	// RetrieveStream for a text stored WithRecipients, with the private key
+	// of one of the recipients
+	RetrieveWithIdentity(ctx context.Context, id, identity []byte) (*RetrieveResult, error)
+	RetrieveStreamWithIdentity(ctx context.Context, id, identity []byte, dst io.Writer) (*RetrieveResult, error)
+
+	// Delete accepts an id and an AES key, and requests that the
+	// encryption-server permanently removes the text stored with the
+	// provided id
+	Delete(ctx context.Context, id, aesKey []byte) error
+
+	// DeleteWithPassphrase is Delete for a text stored WithPassphrase
+	DeleteWithPassphrase(ctx context.Context, id []byte, passphrase string) error
+
+	// DeleteWithIdentity is Delete for a text stored WithRecipients
+	DeleteWithIdentity(ctx context.Context, id, identity []byte) error
+
+	// Share gives the owner of the X25519 public key recipient access to the
+	// text under name, without encrypting it again. Revoke takes that access
+	// away. Both return the names of all shares of the text afterwards.
+	// Replacing the text drops its shares
+	Share(ctx context.Context, id, aesKey []byte, name string, recipient []byte) ([]string, error)
+	Revoke(ctx context.Context, id, aesKey []byte, name string) ([]string, error)
+
+	// RetrieveShare is Retrieve for the recipient of the share called name,
+	// with their private key
+	RetrieveShare(ctx context.Context, id []byte, name string, identity []byte) (*RetrieveResult, error)
+}
+
+// StoreResult is a successfully stored text
+type StoreResult struct {
+	// Id is the id the text is stored with
+	Id []byte
+
+	// Key is the AES key needed to retrieve the text, nil for a text stored
+	// WithPassphrase, WithRecipients or WithKeyShares
+	Key []byte
+
+	// KeyShares are the shares of the key of a text stored WithKeyShares
+	KeyShares [][]byte
+
+	// Version is the version the text is stored at, for WithIfMatch
+	Version int
+}
+
+// RetrieveResult is a retrieved and decrypted text
+type RetrieveResult struct {
+	Payload []byte
+
+	// Version is the version the text is stored at, for WithIfMatch
+	Version int
+
+	// ContentType is the media type the text was stored with,
+	// application/octet-stream if it was stored without one
+	ContentType string
 }
@@ -6,16 +6,24 @@ import (
 )
 
 type Config struct {
-	Service ServiceConf
-	Storage StorageServiceConf
+	Service    ServiceConf
+	Storage    StorageServiceConf
+	KEK        KEKConf
+	TLS        TLSConf
+	Passphrase PassphraseConf
 }
 
 // DBConf - DB config
 
 type ServiceConf struct {
-	CtxTimeout int    `env:"CONTEXT_TIMEOUT" envDefault:"10"`
-	Port       string `env:"LISTEN_PORT" envDefault:"8080"`
-	Debug      bool   `env:"DEBUG" envDefault:"false"`
+	CtxTimeout      int    `env:"CONTEXT_TIMEOUT" envDefault:"10"`
+	Port            string `env:"LISTEN_PORT" envDefault:"8080"`
+	Debug           bool   `env:"DEBUG" envDefault:"false"`
+	ShutdownTimeout int    `env:"SHUTDOWN_TIMEOUT" envDefault:"30"`
+	Algorithm       string `env:"ENCRYPTION_ALGORITHM" envDefault:"aes-256-gcm"`
+	// AllowClientIds lets callers choose the ids of stored texts, otherwise
+	// only server generated ids are accepted
+	AllowClientIds bool `env:"ALLOW_CLIENT_IDS" envDefault:"true"`
 }
 
 type StorageServiceConf struct {
@@ -23,6 +31,49 @@ type StorageServiceConf struct {
 	Port        string `env:"STORAGE_PORT" envDefault:"8081"`
 	StoreUri    string `env:"STORAGE_STORE_URI" envDefault:"/store"`
 	RetrieveUri string `env:"STORAGE_RETRIEVE_URI" envDefault:"/retrieve"`
+	MetadataUri string `env:"STORAGE_METADATA_URI" envDefault:"/metadata"`
+	DeleteUri   string `env:"STORAGE_DELETE_URI" envDefault:"/delete"`
+	ConsumeUri  string `env:"STORAGE_CONSUME_URI" envDefault:"/consume"`
+	ScanUri     string `env:"STORAGE_SCAN_URI" envDefault:"/scan"`
+	// TLS enables https to the storage-service. CAFile verifies its
+	// certificate, CertFile and KeyFile are presented for mutual TLS
+	TLS      bool   `env:"STORAGE_TLS" envDefault:"false"`
+	CAFile   string `env:"STORAGE_TLS_CA_FILE"`
+	CertFile string `env:"STORAGE_TLS_CERT_FILE"`
+	KeyFile  string `env:"STORAGE_TLS_KEY_FILE"`
+}
+
+// TLSConf - certificate of the public listener, TLS is enabled when set
+
+type TLSConf struct {
+	CertFile string `env:"TLS_CERT_FILE"`
+	KeyFile  string `env:"TLS_KEY_FILE"`
+}
+
+// KEKConf - server side key-encryption keys. Envelope mode is enabled when
+// File is set. Every ReportInterval seconds the data keys still wrapped with
+// a previous KEK are counted, 0 disables it
+
+type KEKConf struct {
+	File           string   `env:"KEK_FILE"`
+	PreviousFiles  []string `env:"PREVIOUS_KEK_FILES" envSeparator:","`
+	UnwrapToken    string   `env:"UNWRAP_TOKEN"`
+	ReportInterval int      `env:"KEK_REPORT_INTERVAL" envDefault:"3600"`
+}
+
+// PassphraseConf - Argon2id cost of keys derived from passphrases. Memory
+// is in KiB. The cost is stored with every text, changing it only affects
+// texts stored afterwards. Texts are only decrypted when their cost is
+// within the Max cost, each 0 of which defaults to the configured cost
+
+type PassphraseConf struct {
+	Time    uint `env:"ARGON2_TIME" envDefault:"3"`
+	Memory  uint `env:"ARGON2_MEMORY" envDefault:"65536"`
+	Threads uint `env:"ARGON2_THREADS" envDefault:"4"`
+
+	MaxTime    uint `env:"ARGON2_MAX_TIME"`
+	MaxMemory  uint `env:"ARGON2_MAX_MEMORY"`
+	MaxThreads uint `env:"ARGON2_MAX_THREADS"`
 }
 
 func Get() (*Config, error) {
@@ -36,5 +87,17 @@ func Get() (*Config, error) {
 		return nil, errors.Wrap(err, "Failed to load Storage config")
 	}
 
+	if err := env.Parse(&cfg.KEK); err != nil {
+		return nil, errors.Wrap(err, "Failed to load KEK config")
+	}
+
+	if err := env.Parse(&cfg.TLS); err != nil {
+		return nil, errors.Wrap(err, "Failed to load TLS config")
+	}
+
+	if err := env.Parse(&cfg.Passphrase); err != nil {
+		return nil, errors.Wrap(err, "Failed to load Passphrase config")
+	}
+
 	return cfg, nil
 }
@@ -1,15 +1,8 @@
 package engine
 
-// based on https://github.com/gtank/cryptopasta/blob/master/encrypt.go
-
-import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"io"
+import "io"
 
-	"github.com/pkg/errors"
-)
+// based on https://github.com/gtank/cryptopasta/blob/master/encrypt.go
 
 type AESEngine struct{}
 
@@ -18,53 +11,22 @@ func NewAESEngine() (*AESEngine, error) {
 }
 
 func (*AESEngine) GenerateNewKey() (*[32]byte, error) {
-	key := [32]byte{}
-	_, err := io.ReadFull(rand.Reader, key[:])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to generate a new key")
-	}
-
-	return &key, nil
+	return generateKey()
 }
 
-func (*AESEngine) Encrypt(plaintext []byte, key *[32]byte) (ciphertext []byte, err error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create new cipher.Block")
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create NewGCM")
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create new random nonce")
-	}
-
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+func (*AESEngine) Encrypt(plaintext, additionalData []byte, key *[32]byte) (ciphertext []byte, err error) {
+	return seal(AlgorithmIDAES256GCM, plaintext, additionalData, key)
 }
 
-func (*AESEngine) Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create new cipher.Block")
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create NewGCM")
-	}
+// Decrypt opens any envelope, not only the ones encrypted with AES-256-GCM
+func (*AESEngine) Decrypt(ciphertext, additionalData []byte, key *[32]byte) (plaintext []byte, err error) {
+	return open(ciphertext, additionalData, key)
+}
 
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, errors.New("malformed ciphertext")
-	}
+func (*AESEngine) EncryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	return sealStream(AlgorithmIDAES256GCM, dst, src, additionalData, key)
+}
 
-	return gcm.Open(nil,
-		ciphertext[:gcm.NonceSize()],
-		ciphertext[gcm.NonceSize():],
-		nil,
-	)
+func (*AESEngine) DecryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	return openStream(dst, src, additionalData, key)
 }
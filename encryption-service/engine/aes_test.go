@@ -8,8 +8,9 @@ import (
 )
 
 type testcase struct {
-	plaintext []byte
-	key       *[32]byte
+	plaintext      []byte
+	additionalData []byte
+	key            *[32]byte
 }
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -18,19 +19,23 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatalf("failed to create new aes engine : %s", err.Error())
 	}
 
+	testEncryptDecrypt(t, aes)
+}
+
+func testEncryptDecrypt(t *testing.T, aes Interface) {
 	testCases, err := setupTestData(aes)
 	if err != nil {
 		t.Fatalf("failed to setup test data : %s", err.Error())
 	}
 
 	for i, data := range testCases {
-		ciphertext, err := aes.Encrypt(data.plaintext, data.key)
+		ciphertext, err := aes.Encrypt(data.plaintext, data.additionalData, data.key)
 		if err != nil {
 			t.Errorf("test case %d failed : failed to encode :%s", i, err.Error())
 			continue
 		}
 
-		plaintext, err := aes.Decrypt(ciphertext, data.key)
+		plaintext, err := aes.Decrypt(ciphertext, data.additionalData, data.key)
 		if err != nil {
 			t.Errorf("test case %d failed : failed to decode :%s", i, err.Error())
 			continue
@@ -46,17 +51,22 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatalf("failed to generate new key : %s", err.Error())
 	}
 
-	ciphertext, err := aes.Encrypt(testCases[2].plaintext, testCases[2].key)
+	ciphertext, err := aes.Encrypt(testCases[2].plaintext, testCases[2].additionalData, testCases[2].key)
 	if err != nil {
 		t.Fatalf("test case %d failed : failed to encode :%s", 3, err.Error())
 	}
 
-	_, err = aes.Decrypt(ciphertext, incorrectKey)
+	_, err = aes.Decrypt(ciphertext, testCases[2].additionalData, incorrectKey)
 	//t.Error(err)
 	if err == nil {
 		t.Error("test case failed : expected to receive error \"cipher: message authentication failed\" but got success")
 	}
 
+	_, err = aes.Decrypt(ciphertext, []byte("another-id"), testCases[2].key)
+	if err == nil {
+		t.Error("test case failed : expected mismatching additional data to fail authentication but got success")
+	}
+
 	//cipherStr := "eExBjrIiqouen6Mfy5BjItJv+CDotFikcotWCOlQxVHazDyQEzCB+HXt8B0OIXGk9Cdw+EPrMEMHjmc="
 	//keyStr := "7pdenu5EBuR3RNqt9Poty0TypaJttOL3kJ9Zei8ebAA="
 	//cipherBytes, _ := base64.StdEncoding.DecodeString(cipherStr)
@@ -69,7 +79,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	//t.Error(string(plaintext))
 }
 
-func setupTestData(aes *AESEngine) ([]testcase, error) {
+func setupTestData(aes Interface) ([]testcase, error) {
 	key1, err := aes.GenerateNewKey()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to generate new key")
@@ -87,8 +97,9 @@ func setupTestData(aes *AESEngine) ([]testcase, error) {
 
 	testCases := []testcase{
 		{
-			plaintext: []byte("foo bar"),
-			key:       key1,
+			plaintext:      []byte("foo bar"),
+			additionalData: []byte("my-1st-text"),
+			key:            key1,
 		},
 		{
 			plaintext: []byte(""),
@@ -100,7 +111,8 @@ Quisque convallis, mauris et gravida volutpat, risus diam venenatis enim, a vest
 Vivamus luctus tellus et eleifend rhoncus. Etiam et dui volutpat, posuere justo in, consectetur dui. Phasellus non volutpat risus. Quisque volutpat erat velit, et aliquet urna malesuada vel. Donec elementum, nisl vel semper rutrum, felis lectus viverra tortor, nec cursus ligula mi at risus. Mauris consequat dapibus aliquet. Aenean efficitur tempor blandit. Lorem ipsum dolor sit amet, consectetur adipiscing elit.
 Donec imperdiet quam eu eros dictum luctus ac ac ex. Nullam suscipit tristique libero, sit amet convallis metus laoreet volutpat. Sed placerat vestibulum augue a pulvinar. Nullam eu nulla ante. Suspendisse potenti. Suspendisse placerat tincidunt urna, at lobortis ex rhoncus sit amet. Fusce in ligula id risus tincidunt vulputate. Quisque sapien quam, fermentum eget rhoncus sed, dictum vel dolor. Nullam venenatis libero nibh, eget efficitur sapien tincidunt non. Morbi fringilla velit sapien, eu facilisis risus varius in. Aliquam maximus lorem id leo lacinia euismod. Nam tristique, lacus at convallis sodales, nibh mauris feugiat leo, a consectetur sem dolor non quam. Duis non consectetur ante.
 Vestibulum magna nisi, ultricies vitae erat non, congue porttitor diam. Fusce laoreet placerat accumsan. Aenean dictum neque quis mi iaculis, eu condimentum dui convallis. Curabitur eget urna lectus. Nulla in convallis quam, sit amet accumsan sapien. Proin et mi libero. Integer quis risus eu neque interdum aliquet. Nam placerat nisi vel est cursus, vel volutpat leo rutrum. Suspendisse in lectus interdum, volutpat odio sed, commodo magna. Ut venenatis nulla quis purus hendrerit sollicitudin. Nunc ultricies, enim vel auctor euismod, neque tortor finibus purus, et suscipit arcu dui at odio.`),
-			key: key3,
+			additionalData: []byte("lorem-ipsum"),
+			key:            key3,
 		},
 	}
 
@@ -0,0 +1,62 @@
+package engine
+
+import "io"
+
+// ChaCha20Engine encrypts with ChaCha20-Poly1305 (RFC 8439) and a random
+// 96-bit nonce. It is faster than AES-GCM on CPUs without AES instructions
+type ChaCha20Engine struct{}
+
+func NewChaCha20Engine() (*ChaCha20Engine, error) {
+	return &ChaCha20Engine{}, nil
+}
+
+func (*ChaCha20Engine) GenerateNewKey() (*[32]byte, error) {
+	return generateKey()
+}
+
+func (*ChaCha20Engine) Encrypt(plaintext, additionalData []byte, key *[32]byte) (ciphertext []byte, err error) {
+	return seal(AlgorithmIDChaCha20Poly1305, plaintext, additionalData, key)
+}
+
+// Decrypt opens any envelope, not only the ones encrypted with ChaCha20-Poly1305
+func (*ChaCha20Engine) Decrypt(ciphertext, additionalData []byte, key *[32]byte) (plaintext []byte, err error) {
+	return open(ciphertext, additionalData, key)
+}
+
+func (*ChaCha20Engine) EncryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	return sealStream(AlgorithmIDChaCha20Poly1305, dst, src, additionalData, key)
+}
+
+func (*ChaCha20Engine) DecryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	return openStream(dst, src, additionalData, key)
+}
+
+// XChaCha20Engine encrypts with XChaCha20-Poly1305. Its 192-bit nonce is
+// large enough to be picked at random for any number of messages under the
+// same key
+type XChaCha20Engine struct{}
+
+func NewXChaCha20Engine() (*XChaCha20Engine, error) {
+	return &XChaCha20Engine{}, nil
+}
+
+func (*XChaCha20Engine) GenerateNewKey() (*[32]byte, error) {
+	return generateKey()
+}
+
+func (*XChaCha20Engine) Encrypt(plaintext, additionalData []byte, key *[32]byte) (ciphertext []byte, err error) {
+	return seal(AlgorithmIDXChaCha20Poly1305, plaintext, additionalData, key)
+}
+
+// Decrypt opens any envelope, not only the ones encrypted with XChaCha20-Poly1305
+func (*XChaCha20Engine) Decrypt(ciphertext, additionalData []byte, key *[32]byte) (plaintext []byte, err error) {
+	return open(ciphertext, additionalData, key)
+}
+
+func (*XChaCha20Engine) EncryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	return sealStream(AlgorithmIDXChaCha20Poly1305, dst, src, additionalData, key)
+}
+
+func (*XChaCha20Engine) DecryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	return openStream(dst, src, additionalData, key)
+}
@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestChaCha20EncryptDecrypt(t *testing.T) {
+	chacha, err := NewChaCha20Engine()
+	if err != nil {
+		t.Fatalf("failed to create new chacha20 engine : %s", err.Error())
+	}
+
+	testEncryptDecrypt(t, chacha)
+}
+
+func TestXChaCha20EncryptDecrypt(t *testing.T) {
+	xchacha, err := NewXChaCha20Engine()
+	if err != nil {
+		t.Fatalf("failed to create new xchacha20 engine : %s", err.Error())
+	}
+
+	testEncryptDecrypt(t, xchacha)
+}
+
+func TestNew(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmAES256GCM, AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305} {
+		if _, err := New(algorithm); err != nil {
+			t.Errorf("failed to create engine for %s : %s", algorithm, err.Error())
+		}
+	}
+
+	if _, err := New("rot13"); err == nil {
+		t.Error("expected an error for an unknown algorithm but got success")
+	}
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	AlgorithmAES256GCM         = "aes-256-gcm"
+	AlgorithmChaCha20Poly1305  = "chacha20-poly1305"
+	AlgorithmXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// AlgorithmID identifies the AEAD in a ciphertext envelope. The values are
+// part of the stored format and must never be reused
+type AlgorithmID byte
+
+const (
+	AlgorithmIDAES256GCM         AlgorithmID = 1
+	AlgorithmIDChaCha20Poly1305  AlgorithmID = 2
+	AlgorithmIDXChaCha20Poly1305 AlgorithmID = 3
+)
+
+var aeads = map[AlgorithmID]func(key []byte) (cipher.AEAD, error){
+	AlgorithmIDAES256GCM:         newAESGCM,
+	AlgorithmIDChaCha20Poly1305:  chacha20poly1305.New,
+	AlgorithmIDXChaCha20Poly1305: chacha20poly1305.NewX,
+}
+
+// New creates the engine for the named algorithm
+func New(algorithm string) (Interface, error) {
+	switch algorithm {
+	case AlgorithmAES256GCM:
+		return NewAESEngine()
+	case AlgorithmChaCha20Poly1305:
+		return NewChaCha20Engine()
+	case AlgorithmXChaCha20Poly1305:
+		return NewXChaCha20Engine()
+	default:
+		return nil, errors.Errorf("unknown encryption algorithm %q", algorithm)
+	}
+}
+
+func generateKey() (*[32]byte, error) {
+	key := [32]byte{}
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate a new key")
+	}
+
+	return &key, nil
+}
+
+func newAEAD(algorithm AlgorithmID, key *[32]byte) (cipher.AEAD, error) {
+	constructor, ok := aeads[algorithm]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownAlgorithm, "algorithm id %d", algorithm)
+	}
+
+	aead, err := constructor(key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AEAD cipher")
+	}
+
+	return aead, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher.Block")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create NewGCM")
+	}
+
+	return gcm, nil
+}
+
+// seal encrypts plaintext under a fresh random nonce and returns it wrapped
+// in an envelope. Both the envelope header and additionalData are
+// authenticated
+func seal(algorithm AlgorithmID, plaintext, additionalData []byte, key *[32]byte) ([]byte, error) {
+	aead, err := newAEAD(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new random nonce")
+	}
+
+	envelope := &Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: algorithm,
+		KeyID:     KeyID(key),
+		Nonce:     nonce,
+	}
+	header := envelope.Header()
+
+	return aead.Seal(header, nonce, plaintext, associatedData(header, additionalData)), nil
+}
+
+// open decrypts an envelope produced by seal or sealStream with any of the
+// known algorithms, optionally preceded by a key header
+func open(ciphertext, additionalData []byte, key *[32]byte) ([]byte, error) {
+	_, header, err := readKeyHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		ciphertext = ciphertext[len(header.Header()):]
+		additionalData = header.AdditionalData(additionalData)
+	}
+
+	envelope, err := ParseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(envelope.KeyID, KeyID(key)) {
+		return nil, ErrWrongKey
+	}
+
+	if envelope.Version == StreamEnvelopeVersion {
+		return openStreamEnvelope(envelope, additionalData, key)
+	}
+
+	return openEnvelope(envelope, additionalData, key)
+}
+
+// KeyHeader precedes an envelope whose key isn't known to the caller, with
+// what is needed to get the key. It is either a key derivation header, see
+// KDFParams, or a recipient header, see RecipientHeader
+type KeyHeader interface {
+	// Header returns the serialised header
+	Header() []byte
+	// AdditionalData returns the additional data the envelope following the
+	// header is encrypted with
+	AdditionalData(additionalData []byte) []byte
+}
+
+// readKeyHeader reads the key header at the start of src, if there is one.
+// The returned reader continues with the envelope
+func readKeyHeader(src io.Reader) (io.Reader, KeyHeader, error) {
+	magic := make([]byte, len(kdfMagic))
+	if _, err := io.ReadFull(src, magic); err != nil {
+		return nil, nil, readHeaderError(err)
+	}
+
+	switch {
+	case bytes.Equal(magic, kdfMagic):
+		params, err := readKDFParams(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return src, params, nil
+	case bytes.Equal(magic, recipientMagic):
+		header, err := readRecipientHeader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return src, header, nil
+	default:
+		return io.MultiReader(bytes.NewReader(magic), src), nil, nil
+	}
+}
+
+// openEnvelope decrypts a version 1 envelope
+func openEnvelope(envelope *Envelope, additionalData []byte, key *[32]byte) ([]byte, error) {
+	aead, err := newAEAD(envelope.Algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, ErrMalformedEnvelope
+	}
+
+	return aead.Open(nil, envelope.Nonce, envelope.Ciphertext, associatedData(envelope.Header(), additionalData))
+}
+
+// associatedData prepends the header to the caller's additional data. The
+// header is self-delimiting, so the concatenation is unambiguous
+func associatedData(header, additionalData []byte) []byte {
+	ad := make([]byte, 0, len(header)+len(additionalData))
+	ad = append(ad, header...)
+	return append(ad, additionalData...)
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Every ciphertext produced by an engine is wrapped in an envelope that
+// describes how it was made, so it can be decrypted regardless of which
+// engine is configured when it is read back:
+//
+//	magic       4 bytes  "AKHE"
+//	version     1 byte   format version, 1 or 2 for streams, see stream.go
+//	algorithm   1 byte   AlgorithmID of the AEAD used
+//	key id len  1 byte
+//	key id      n bytes  fingerprint of the key, see KeyID
+//	nonce len   1 byte
+//	nonce       n bytes
+//	ciphertext  rest     AEAD output including the tag
+//
+// Everything before the ciphertext is authenticated as additional data.
+
+const EnvelopeVersion = 1
+
+var envelopeMagic = []byte("AKHE")
+
+var (
+	ErrMalformedEnvelope  = errors.New("malformed ciphertext envelope")
+	ErrUnsupportedVersion = errors.New("unsupported ciphertext envelope version")
+	ErrUnknownAlgorithm   = errors.New("unknown encryption algorithm")
+	ErrWrongKey           = errors.New("ciphertext was not encrypted with this key")
+)
+
+type Envelope struct {
+	Version    byte
+	Algorithm  AlgorithmID
+	KeyID      []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// KeyID returns a short fingerprint of the key. It lets Decrypt tell a wrong
+// key apart from a corrupted ciphertext without revealing anything useful
+// about the key itself
+func KeyID(key *[32]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("akh-dev/encrypt key id"))
+	h.Write(key[:])
+	return h.Sum(nil)[:8]
+}
+
+// Header returns the serialised envelope without the ciphertext
+func (e *Envelope) Header() []byte {
+	buf := make([]byte, 0, len(envelopeMagic)+4+len(e.KeyID)+len(e.Nonce))
+	buf = append(buf, envelopeMagic...)
+	buf = append(buf, e.Version, byte(e.Algorithm))
+	buf = append(buf, byte(len(e.KeyID)))
+	buf = append(buf, e.KeyID...)
+	buf = append(buf, byte(len(e.Nonce)))
+	buf = append(buf, e.Nonce...)
+	return buf
+}
+
+func (e *Envelope) Marshal() []byte {
+	return append(e.Header(), e.Ciphertext...)
+}
+
+// ParseEnvelope splits data into the envelope fields. The returned slices
+// alias data
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	if len(data) < len(envelopeMagic)+2 || !bytes.Equal(data[:len(envelopeMagic)], envelopeMagic) {
+		return nil, ErrMalformedEnvelope
+	}
+	data = data[len(envelopeMagic):]
+
+	e := &Envelope{
+		Version:   data[0],
+		Algorithm: AlgorithmID(data[1]),
+	}
+	if err := checkVersion(e.Version); err != nil {
+		return nil, err
+	}
+	data = data[2:]
+
+	var ok bool
+	if e.KeyID, data, ok = readField(data); !ok {
+		return nil, ErrMalformedEnvelope
+	}
+	if e.Nonce, data, ok = readField(data); !ok {
+		return nil, ErrMalformedEnvelope
+	}
+	e.Ciphertext = data
+
+	return e, nil
+}
+
+// ReadEnvelopeHeader reads the envelope fields up to and including the nonce
+// from r, leaving r at the start of the ciphertext
+func ReadEnvelopeHeader(r io.Reader) (*Envelope, error) {
+	fixed := make([]byte, len(envelopeMagic)+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, readHeaderError(err)
+	}
+	if !bytes.Equal(fixed[:len(envelopeMagic)], envelopeMagic) {
+		return nil, ErrMalformedEnvelope
+	}
+
+	e := &Envelope{
+		Version:   fixed[len(envelopeMagic)],
+		Algorithm: AlgorithmID(fixed[len(envelopeMagic)+1]),
+	}
+	if err := checkVersion(e.Version); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if e.KeyID, err = readFieldFrom(r); err != nil {
+		return nil, err
+	}
+	if e.Nonce, err = readFieldFrom(r); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func checkVersion(version byte) error {
+	if version != EnvelopeVersion && version != StreamEnvelopeVersion {
+		return errors.Wrapf(ErrUnsupportedVersion, "version %d", version)
+	}
+
+	return nil
+}
+
+// readFieldFrom reads a single byte length prefixed field from r
+func readFieldFrom(r io.Reader) ([]byte, error) {
+	length := []byte{0}
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, readHeaderError(err)
+	}
+
+	field := make([]byte, length[0])
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, readHeaderError(err)
+	}
+
+	return field, nil
+}
+
+// readHeaderError reports a header cut short as malformed, and any other
+// read error as it is
+func readHeaderError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMalformedEnvelope
+	}
+
+	return errors.Wrap(err, "failed to read envelope header")
+}
+
+// readField reads a single byte length prefixed field
+func readField(data []byte) (field, rest []byte, ok bool) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, nil, false
+	}
+	n := 1 + int(data[0])
+	return data[1:n], data[n:], true
+}
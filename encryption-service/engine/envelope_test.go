@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	envelope := &Envelope{
+		Version:    EnvelopeVersion,
+		Algorithm:  AlgorithmIDXChaCha20Poly1305,
+		KeyID:      []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Nonce:      bytes.Repeat([]byte{0xaa}, 24),
+		Ciphertext: []byte("ciphertext and tag"),
+	}
+
+	parsed, err := ParseEnvelope(envelope.Marshal())
+	if err != nil {
+		t.Fatalf("failed to parse envelope : %s", err.Error())
+	}
+
+	if parsed.Version != envelope.Version ||
+		parsed.Algorithm != envelope.Algorithm ||
+		!bytes.Equal(parsed.KeyID, envelope.KeyID) ||
+		!bytes.Equal(parsed.Nonce, envelope.Nonce) ||
+		!bytes.Equal(parsed.Ciphertext, envelope.Ciphertext) {
+		t.Errorf("envelopes don't match. expected %+v, got %+v", envelope, parsed)
+	}
+}
+
+func TestDecryptAcrossEngines(t *testing.T) {
+	aes, _ := NewAESEngine()
+	xchacha, _ := NewXChaCha20Engine()
+
+	key, err := aes.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("failed to generate new key : %s", err.Error())
+	}
+
+	ciphertext, err := xchacha.Encrypt([]byte("foo bar"), nil, key)
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+
+	plaintext, err := aes.Decrypt(ciphertext, nil, key)
+	if err != nil {
+		t.Fatalf("aes engine failed to decrypt an xchacha20 envelope : %s", err.Error())
+	}
+	if string(plaintext) != "foo bar" {
+		t.Errorf("texts don't match. expected %s, got %s", "foo bar", plaintext)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	aes, _ := NewAESEngine()
+
+	key, _ := aes.GenerateNewKey()
+	otherKey, _ := aes.GenerateNewKey()
+
+	ciphertext, err := aes.Encrypt([]byte("foo bar"), nil, key)
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+
+	unknownAlgorithm := append([]byte(nil), ciphertext...)
+	unknownAlgorithm[5] = 0xff
+
+	unsupportedVersion := append([]byte(nil), ciphertext...)
+	unsupportedVersion[4] = 0xff
+
+	tamperedHeader := append([]byte(nil), ciphertext...)
+	tamperedHeader[5] = byte(AlgorithmIDChaCha20Poly1305)
+
+	testCases := []struct {
+		ciphertext []byte
+		key        *[32]byte
+		expected   error
+	}{
+		{ciphertext: []byte("some foreign blob"), key: key, expected: ErrMalformedEnvelope},
+		{ciphertext: ciphertext[:10], key: key, expected: ErrMalformedEnvelope},
+		{ciphertext: unsupportedVersion, key: key, expected: ErrUnsupportedVersion},
+		{ciphertext: unknownAlgorithm, key: key, expected: ErrUnknownAlgorithm},
+		{ciphertext: ciphertext, key: otherKey, expected: ErrWrongKey},
+	}
+
+	for i, data := range testCases {
+		_, err := aes.Decrypt(data.ciphertext, nil, data.key)
+		if errors.Cause(err) != data.expected {
+			t.Errorf("test case %d failed : expected %v, got %v", i, data.expected, err)
+		}
+	}
+
+	// the header is authenticated, so swapping the algorithm id for another
+	// one with the same nonce size must not decrypt
+	if _, err := aes.Decrypt(tamperedHeader, nil, key); err == nil {
+		t.Error("expected tampered header to fail authentication but got success")
+	}
+}
@@ -1,7 +1,38 @@
 package engine
 
+import "io"
+
 type Interface interface {
 	GenerateNewKey() (*[32]byte, error)
-	Encrypt(plaintext []byte, key *[32]byte) ([]byte, error)
-	Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error)
+
+	// Encrypt seals plaintext with the key. additionalData is authenticated
+	// but not stored, the exact same bytes must be passed to Decrypt
+	Encrypt(plaintext, additionalData []byte, key *[32]byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte, key *[32]byte) (plaintext []byte, err error)
+
+	// EncryptStream seals everything read from src into segments written to
+	// dst, without holding more than a couple of segments in memory
+	EncryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error
+	// DecryptStream opens a ciphertext read from src into dst. Plaintext is
+	// only written once it has been authenticated, but a ciphertext that is
+	// corrupted part way fails after the segments before the corruption were
+	// written. Decrypt and DecryptStream both open any envelope version
+	DecryptStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error
+}
+
+// RecipientInterface encrypts texts to the X25519 public keys of their
+// recipients instead of with a key known to the caller. Only the identity,
+// i.e. the private key, of one of the recipients decrypts them again
+type RecipientInterface interface {
+	Interface
+
+	EncryptTo(plaintext, additionalData []byte, recipients []*[32]byte) ([]byte, error)
+	DecryptWith(ciphertext, additionalData []byte, identity *[32]byte) (plaintext []byte, err error)
+
+	EncryptStreamTo(dst io.Writer, src io.Reader, additionalData []byte, recipients []*[32]byte) error
+	DecryptStreamWith(dst io.Writer, src io.Reader, additionalData []byte, identity *[32]byte) error
+
+	// OpenKeyWith opens the data key of a ciphertext with the identity, for
+	// callers that pass the key on
+	OpenKeyWith(ciphertext []byte, identity *[32]byte) (*[32]byte, error)
 }
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// A ciphertext encrypted with a key derived from a passphrase starts with a
+// header holding everything needed to derive the key again, apart from the
+// passphrase itself, followed by a regular envelope:
+//
+//	magic       4 bytes  "AKHK"
+//	version     1 byte   format version, currently 1
+//	kdf         1 byte   KDFArgon2id
+//	time        4 bytes  big endian, Argon2id passes
+//	memory      4 bytes  big endian, Argon2id memory in KiB
+//	threads     1 byte   Argon2id parallelism
+//	salt len    1 byte
+//	salt        n bytes
+//	envelope    rest     see Envelope
+//
+// The header is authenticated as part of the envelope's additional data, see
+// KDFParams.AdditionalData. A tampered header derives a different key and
+// fails like a wrong passphrase.
+
+const KDFHeaderVersion = 1
+
+// KDFArgon2id identifies Argon2id in a key derivation header
+const KDFArgon2id = 1
+
+const (
+	// KDFSaltSize is the size of the random salt of every derived key
+	KDFSaltSize = 16
+
+	// MaxArgon2idTime and MaxArgon2idMemory bound the cost of deriving a key,
+	// also for headers read back from storage, so a forged header can't make
+	// a derivation run for ever
+	MaxArgon2idTime   = 64
+	MaxArgon2idMemory = 1 << 20
+)
+
+var kdfMagic = []byte("AKHK")
+
+var ErrNoKDFParams = errors.New("ciphertext wasn't encrypted with a key derived from a passphrase")
+
+var ErrKDFCostTooHigh = errors.New("key derivation cost is above the allowed maximum")
+
+// Argon2idCost is the tunable cost of deriving a key with Argon2id. Memory
+// is in KiB
+type Argon2idCost struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Validate checks the cost is within the range Argon2id accepts and below
+// the limits of this package
+func (c Argon2idCost) Validate() error {
+	if c.Time < 1 || c.Time > MaxArgon2idTime {
+		return errors.Errorf("argon2id time must be between 1 and %d", MaxArgon2idTime)
+	}
+	if c.Threads < 1 {
+		return errors.New("argon2id threads must be at least 1")
+	}
+	if c.Memory < 8*uint32(c.Threads) || c.Memory > MaxArgon2idMemory {
+		return errors.Errorf("argon2id memory must be between %d and %d KiB", 8*uint32(c.Threads), MaxArgon2idMemory)
+	}
+
+	return nil
+}
+
+// CheckMax returns ErrKDFCostTooHigh if any part of the cost is above max.
+// Callers deriving keys from headers they didn't write check them against
+// their own, much lower, maximum before deriving
+func (c Argon2idCost) CheckMax(max Argon2idCost) error {
+	if c.Time > max.Time || c.Memory > max.Memory || c.Threads > max.Threads {
+		return errors.Wrapf(ErrKDFCostTooHigh, "%+v is above %+v", c, max)
+	}
+
+	return nil
+}
+
+// KDFParams are the parameters a key is derived from a passphrase with
+type KDFParams struct {
+	Argon2idCost
+	Salt []byte
+}
+
+// NewKDFParams returns parameters with the given cost and a new random salt
+func NewKDFParams(cost Argon2idCost) (*KDFParams, error) {
+	if err := cost.Validate(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, KDFSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errors.Wrap(err, "failed to create new random salt")
+	}
+
+	return &KDFParams{Argon2idCost: cost, Salt: salt}, nil
+}
+
+// DeriveKey derives the key of the passphrase
+func (p *KDFParams) DeriveKey(passphrase []byte) *[32]byte {
+	key := [32]byte{}
+	copy(key[:], argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, uint32(len(key))))
+	return &key
+}
+
+// Header returns the serialised key derivation header
+func (p *KDFParams) Header() []byte {
+	buf := make([]byte, 0, len(kdfMagic)+13+len(p.Salt))
+	buf = append(buf, kdfMagic...)
+	buf = append(buf, KDFHeaderVersion, KDFArgon2id)
+	buf = binary.BigEndian.AppendUint32(buf, p.Time)
+	buf = binary.BigEndian.AppendUint32(buf, p.Memory)
+	buf = append(buf, p.Threads, byte(len(p.Salt)))
+	return append(buf, p.Salt...)
+}
+
+// AdditionalData returns the additional data to encrypt the envelope
+// following the header with, so the header is authenticated along with it
+func (p *KDFParams) AdditionalData(additionalData []byte) []byte {
+	return associatedData(p.Header(), additionalData)
+}
+
+// ParseKDFParams reads the key derivation header at the start of data. It
+// returns ErrNoKDFParams if data doesn't start with one
+func ParseKDFParams(data []byte) (*KDFParams, error) {
+	return ReadKDFParams(bytes.NewReader(data))
+}
+
+// ReadKDFParams reads the key derivation header from r, leaving r at the
+// start of the envelope. It returns ErrNoKDFParams if r doesn't start with
+// one, after having read its first four bytes
+func ReadKDFParams(r io.Reader) (*KDFParams, error) {
+	magic := make([]byte, len(kdfMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, readHeaderError(err)
+	}
+	if !bytes.Equal(magic, kdfMagic) {
+		return nil, ErrNoKDFParams
+	}
+
+	return readKDFParams(r)
+}
+
+// readKDFParams reads the key derivation header following its magic
+func readKDFParams(r io.Reader) (*KDFParams, error) {
+	fixed := make([]byte, 11)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, readHeaderError(err)
+	}
+	if fixed[0] != KDFHeaderVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "key derivation header version %d", fixed[0])
+	}
+	if fixed[1] != KDFArgon2id {
+		return nil, errors.Errorf("unknown key derivation function %d", fixed[1])
+	}
+
+	p := &KDFParams{
+		Argon2idCost: Argon2idCost{
+			Time:    binary.BigEndian.Uint32(fixed[2:]),
+			Memory:  binary.BigEndian.Uint32(fixed[6:]),
+			Threads: fixed[10],
+		},
+	}
+	if err := p.Validate(); err != nil {
+		return nil, errors.Wrap(ErrMalformedEnvelope, err.Error())
+	}
+
+	var err error
+	if p.Salt, err = readFieldFrom(r); err != nil {
+		return nil, err
+	}
+	if len(p.Salt) == 0 {
+		return nil, ErrMalformedEnvelope
+	}
+
+	return p, nil
+}
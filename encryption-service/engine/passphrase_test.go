@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// testCost keeps the derivations of the tests fast
+var testCost = Argon2idCost{Time: 1, Memory: 64, Threads: 1}
+
+func TestPassphraseEncryptDecrypt(t *testing.T) {
+	e, _ := NewChaCha20Engine()
+
+	params, err := NewKDFParams(testCost)
+	if err != nil {
+		t.Fatalf("failed to create key derivation parameters : %s", err.Error())
+	}
+	key := params.DeriveKey([]byte("correct horse battery staple"))
+
+	sealed, err := e.Encrypt([]byte("foo bar"), params.AdditionalData([]byte("id")), key)
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+	ciphertext := append(params.Header(), sealed...)
+
+	parsed, err := ParseKDFParams(ciphertext)
+	if err != nil {
+		t.Fatalf("failed to parse key derivation parameters : %s", err.Error())
+	}
+	if parsed.Argon2idCost != testCost || !bytes.Equal(parsed.Salt, params.Salt) {
+		t.Errorf("parameters don't match. expected %+v, got %+v", params, parsed)
+	}
+
+	// the same passphrase and parameters always derive the same key
+	derived := parsed.DeriveKey([]byte("correct horse battery staple"))
+	if *derived != *key {
+		t.Fatal("derived keys don't match")
+	}
+
+	plaintext, err := e.Decrypt(ciphertext, []byte("id"), derived)
+	if err != nil {
+		t.Fatalf("failed to decrypt : %s", err.Error())
+	}
+	if string(plaintext) != "foo bar" {
+		t.Errorf("texts don't match. expected %s, got %s", "foo bar", plaintext)
+	}
+
+	streamed := &bytes.Buffer{}
+	if err := e.DecryptStream(streamed, bytes.NewReader(ciphertext), []byte("id"), derived); err != nil {
+		t.Fatalf("failed to decrypt as a stream : %s", err.Error())
+	}
+	if streamed.String() != "foo bar" {
+		t.Errorf("texts don't match. expected %s, got %s", "foo bar", streamed.String())
+	}
+
+	wrongKey := parsed.DeriveKey([]byte("wrong"))
+	if _, err := e.Decrypt(ciphertext, []byte("id"), wrongKey); errors.Cause(err) != ErrWrongKey {
+		t.Errorf("expected %v for a wrong passphrase, got %v", ErrWrongKey, err)
+	}
+}
+
+func TestKDFParamsErrors(t *testing.T) {
+	e, _ := NewAESEngine()
+	key, _ := e.GenerateNewKey()
+
+	ciphertext, err := e.Encrypt([]byte("foo bar"), nil, key)
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+	if _, err := ParseKDFParams(ciphertext); err != ErrNoKDFParams {
+		t.Errorf("expected %v for an envelope, got %v", ErrNoKDFParams, err)
+	}
+
+	params, _ := NewKDFParams(testCost)
+
+	// a forged header must not make the derivation arbitrarily expensive
+	expensive := params.Header()
+	binary.BigEndian.PutUint32(expensive[10:], MaxArgon2idMemory+1)
+	if _, err := ParseKDFParams(expensive); errors.Cause(err) != ErrMalformedEnvelope {
+		t.Errorf("expected %v for too much memory, got %v", ErrMalformedEnvelope, err)
+	}
+
+	if err := params.CheckMax(testCost); err != nil {
+		t.Errorf("expected the cost to be within itself, got %v", err)
+	}
+	if err := params.CheckMax(Argon2idCost{Time: 1, Memory: 32, Threads: 1}); errors.Cause(err) != ErrKDFCostTooHigh {
+		t.Errorf("expected %v for too much memory, got %v", ErrKDFCostTooHigh, err)
+	}
+
+	if _, err := ParseKDFParams(params.Header()[:8]); err != ErrMalformedEnvelope {
+		t.Errorf("expected %v for a truncated header, got %v", ErrMalformedEnvelope, err)
+	}
+
+	if _, err := NewKDFParams(Argon2idCost{Time: 0, Memory: 64, Threads: 1}); err == nil {
+		t.Error("expected an error for a zero time but got success")
+	}
+
+	// the header is authenticated, a different salt doesn't decrypt even
+	// with the key derived from the original one
+	passphraseKey := params.DeriveKey([]byte("passphrase"))
+	sealed, _ := e.Encrypt([]byte("foo bar"), params.AdditionalData(nil), passphraseKey)
+	tampered := append(params.Header(), sealed...)
+	tampered[len(params.Header())-1] ^= 0xff
+	if _, err := e.Decrypt(tampered, nil, passphraseKey); err == nil {
+		t.Error("expected tampered header to fail authentication but got success")
+	}
+}
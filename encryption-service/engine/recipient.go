@@ -0,0 +1,345 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A ciphertext encrypted to recipients starts with a header holding its data
+// key sealed to the X25519 public key of every recipient, followed by a
+// regular envelope:
+//
+//	magic       4 bytes  "AKHR"
+//	version     1 byte   format version, currently 1
+//	count       1 byte   number of stanzas, at least 1
+//	stanzas     count * RecipientStanzaSize bytes
+//	envelope    rest     see Envelope
+//
+// A stanza is an ephemeral X25519 public key followed by the data key sealed
+// with ChaCha20-Poly1305, under a key derived with HKDF-SHA256 from the
+// shared secret of the ephemeral key and the recipient's key. Stanzas don't
+// name their recipient, an identity opens a header by trying all of them.
+// The header is authenticated as part of the envelope's additional data, see
+// RecipientHeader.AdditionalData.
+
+const RecipientHeaderVersion = 1
+
+const (
+	// RecipientStanzaSize is the size of a data key sealed to one recipient
+	RecipientStanzaSize = curve25519.PointSize + 32 + chacha20poly1305.Overhead
+
+	// MaxRecipients is the number of recipients a header can hold
+	MaxRecipients = 255
+)
+
+var recipientMagic = []byte("AKHR")
+
+// stanzaInfo separates the keys derived for stanzas from any other use of
+// the same shared secret
+var stanzaInfo = []byte("akh-dev/encrypt x25519 stanza")
+
+var (
+	ErrNoRecipientHeader = errors.New("ciphertext wasn't encrypted to recipients")
+	ErrInvalidRecipient  = errors.New("invalid recipient public key")
+)
+
+// GenerateIdentity creates a new X25519 key pair. The identity is the private
+// key, recipient the public key texts are encrypted to
+func GenerateIdentity() (identity, recipient *[32]byte, err error) {
+	identity = &[32]byte{}
+	if _, err := io.ReadFull(rand.Reader, identity[:]); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate a new identity")
+	}
+
+	recipient, err = Recipient(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return identity, recipient, nil
+}
+
+// Recipient returns the public key of an identity
+func Recipient(identity *[32]byte) (*[32]byte, error) {
+	public, err := curve25519.X25519(identity[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute public key")
+	}
+
+	recipient := [32]byte{}
+	copy(recipient[:], public)
+	return &recipient, nil
+}
+
+// SealKey seals a data key to a recipient. additionalData is authenticated
+// and has to be passed to OpenKey as it is
+func SealKey(key, recipient *[32]byte, additionalData []byte) ([]byte, error) {
+	ephemeral := [32]byte{}
+	if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+		return nil, errors.Wrap(err, "failed to generate an ephemeral key")
+	}
+
+	ephemeralPublic, err := curve25519.X25519(ephemeral[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute ephemeral public key")
+	}
+
+	aead, err := stanzaAEAD(ephemeral[:], recipient[:], ephemeralPublic, recipient[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// every stanza key is used once, so the nonce can be fixed
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephemeralPublic, nonce, key[:], additionalData), nil
+}
+
+// OpenKey opens a data key sealed to the identity with SealKey. It returns
+// ErrWrongKey if the stanza wasn't sealed to the identity
+func OpenKey(stanza []byte, identity *[32]byte, additionalData []byte) (*[32]byte, error) {
+	if len(stanza) != RecipientStanzaSize {
+		return nil, ErrMalformedEnvelope
+	}
+
+	recipient, err := Recipient(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPublic := stanza[:curve25519.PointSize]
+	aead, err := stanzaAEAD(identity[:], ephemeralPublic, ephemeralPublic, recipient[:])
+	if errors.Cause(err) == ErrInvalidRecipient {
+		return nil, ErrMalformedEnvelope
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	opened, err := aead.Open(nil, nonce, stanza[curve25519.PointSize:], additionalData)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+
+	key := [32]byte{}
+	copy(key[:], opened)
+	return &key, nil
+}
+
+// stanzaAEAD derives the key of a stanza from the shared secret of scalar
+// and point, both public keys are bound to it
+func stanzaAEAD(scalar, point, ephemeralPublic, recipient []byte) (cipher.AEAD, error) {
+	shared, err := curve25519.X25519(scalar, point)
+	if err != nil {
+		// the point is of low order, there is no secret to share
+		return nil, errors.Wrap(ErrInvalidRecipient, err.Error())
+	}
+
+	salt := make([]byte, 0, len(ephemeralPublic)+len(recipient))
+	salt = append(salt, ephemeralPublic...)
+	salt = append(salt, recipient...)
+
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, stanzaInfo), wrappingKey); err != nil {
+		return nil, errors.Wrap(err, "failed to derive stanza key")
+	}
+
+	return chacha20poly1305.New(wrappingKey)
+}
+
+// RecipientHeader holds the data key of a ciphertext sealed to each of its
+// recipients
+type RecipientHeader struct {
+	Stanzas [][]byte
+}
+
+// NewRecipientHeader seals the data key to every recipient
+func NewRecipientHeader(key *[32]byte, recipients []*[32]byte) (*RecipientHeader, error) {
+	if len(recipients) == 0 || len(recipients) > MaxRecipients {
+		return nil, errors.Errorf("between 1 and %d recipients are required", MaxRecipients)
+	}
+
+	h := &RecipientHeader{}
+	for _, recipient := range recipients {
+		stanza, err := SealKey(key, recipient, nil)
+		if err != nil {
+			return nil, err
+		}
+		h.Stanzas = append(h.Stanzas, stanza)
+	}
+
+	return h, nil
+}
+
+// OpenKey opens the data key with the identity of any of the recipients. It
+// returns ErrWrongKey if the identity isn't one of them
+func (h *RecipientHeader) OpenKey(identity *[32]byte) (*[32]byte, error) {
+	for _, stanza := range h.Stanzas {
+		key, err := OpenKey(stanza, identity, nil)
+		if err == ErrWrongKey {
+			continue
+		}
+		return key, err
+	}
+
+	return nil, ErrWrongKey
+}
+
+// Header returns the serialised recipient header
+func (h *RecipientHeader) Header() []byte {
+	buf := make([]byte, 0, len(recipientMagic)+2+len(h.Stanzas)*RecipientStanzaSize)
+	buf = append(buf, recipientMagic...)
+	buf = append(buf, RecipientHeaderVersion, byte(len(h.Stanzas)))
+	for _, stanza := range h.Stanzas {
+		buf = append(buf, stanza...)
+	}
+	return buf
+}
+
+// AdditionalData returns the additional data to encrypt the envelope
+// following the header with, so the header is authenticated along with it
+func (h *RecipientHeader) AdditionalData(additionalData []byte) []byte {
+	return associatedData(h.Header(), additionalData)
+}
+
+// ParseRecipientHeader reads the recipient header at the start of data. It
+// returns ErrNoRecipientHeader if data doesn't start with one
+func ParseRecipientHeader(data []byte) (*RecipientHeader, error) {
+	return ReadRecipientHeader(bytes.NewReader(data))
+}
+
+// ReadRecipientHeader reads the recipient header from r, leaving r at the
+// start of the envelope. It returns ErrNoRecipientHeader if r doesn't start
+// with one, after having read its first four bytes
+func ReadRecipientHeader(r io.Reader) (*RecipientHeader, error) {
+	magic := make([]byte, len(recipientMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, readHeaderError(err)
+	}
+	if !bytes.Equal(magic, recipientMagic) {
+		return nil, ErrNoRecipientHeader
+	}
+
+	return readRecipientHeader(r)
+}
+
+// readRecipientHeader reads the recipient header following its magic
+func readRecipientHeader(r io.Reader) (*RecipientHeader, error) {
+	fixed := make([]byte, 2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, readHeaderError(err)
+	}
+	if fixed[0] != RecipientHeaderVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "recipient header version %d", fixed[0])
+	}
+	if fixed[1] == 0 {
+		return nil, ErrMalformedEnvelope
+	}
+
+	h := &RecipientHeader{}
+	for i := 0; i < int(fixed[1]); i++ {
+		stanza := make([]byte, RecipientStanzaSize)
+		if _, err := io.ReadFull(r, stanza); err != nil {
+			return nil, readHeaderError(err)
+		}
+		h.Stanzas = append(h.Stanzas, stanza)
+	}
+
+	return h, nil
+}
+
+// RecipientEngine encrypts texts to the public keys of their recipients with
+// a new random data key each, and decrypts them with a recipient's identity.
+// Its Interface methods are those of the engine it wraps
+type RecipientEngine struct {
+	Interface
+}
+
+var _ RecipientInterface = (*RecipientEngine)(nil)
+
+// NewRecipientEngine creates a recipient engine encrypting with e
+func NewRecipientEngine(e Interface) *RecipientEngine {
+	return &RecipientEngine{Interface: e}
+}
+
+func (e *RecipientEngine) EncryptTo(plaintext, additionalData []byte, recipients []*[32]byte) ([]byte, error) {
+	header, key, err := e.newHeader(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := e.Encrypt(plaintext, header.AdditionalData(additionalData), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header.Header(), ciphertext...), nil
+}
+
+func (e *RecipientEngine) EncryptStreamTo(dst io.Writer, src io.Reader, additionalData []byte, recipients []*[32]byte) error {
+	header, key, err := e.newHeader(recipients)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(header.Header()); err != nil {
+		return err
+	}
+
+	return e.EncryptStream(dst, src, header.AdditionalData(additionalData), key)
+}
+
+func (e *RecipientEngine) DecryptWith(ciphertext, additionalData []byte, identity *[32]byte) ([]byte, error) {
+	key, err := e.OpenKeyWith(ciphertext, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Decrypt(ciphertext, additionalData, key)
+}
+
+func (e *RecipientEngine) DecryptStreamWith(dst io.Writer, src io.Reader, additionalData []byte, identity *[32]byte) error {
+	header, err := ReadRecipientHeader(src)
+	if err != nil {
+		return err
+	}
+
+	key, err := header.OpenKey(identity)
+	if err != nil {
+		return err
+	}
+
+	// the header is authenticated along with the envelope, it is handed on
+	return e.DecryptStream(dst, io.MultiReader(bytes.NewReader(header.Header()), src), additionalData, key)
+}
+
+func (e *RecipientEngine) OpenKeyWith(ciphertext []byte, identity *[32]byte) (*[32]byte, error) {
+	header, err := ParseRecipientHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return header.OpenKey(identity)
+}
+
+func (e *RecipientEngine) newHeader(recipients []*[32]byte) (*RecipientHeader, *[32]byte, error) {
+	key, err := e.GenerateNewKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := NewRecipientHeader(key, recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, key, nil
+}
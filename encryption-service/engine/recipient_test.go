@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRecipientEncryptDecrypt(t *testing.T) {
+	aes, _ := NewAESEngine()
+	e := NewRecipientEngine(aes)
+
+	alice, aliceRecipient, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate identity : %s", err.Error())
+	}
+	bob, bobRecipient, _ := GenerateIdentity()
+	eve, _, _ := GenerateIdentity()
+
+	recipients := []*[32]byte{aliceRecipient, bobRecipient}
+	ciphertext, err := e.EncryptTo([]byte("foo bar"), []byte("id"), recipients)
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+
+	streamed := &bytes.Buffer{}
+	if err := e.EncryptStreamTo(streamed, bytes.NewReader([]byte("foo bar")), []byte("id"), recipients); err != nil {
+		t.Fatalf("failed to encrypt as a stream : %s", err.Error())
+	}
+
+	for _, ciphertext := range [][]byte{ciphertext, streamed.Bytes()} {
+		for _, identity := range []*[32]byte{alice, bob} {
+			plaintext, err := e.DecryptWith(ciphertext, []byte("id"), identity)
+			if err != nil {
+				t.Fatalf("failed to decrypt : %s", err.Error())
+			}
+			if string(plaintext) != "foo bar" {
+				t.Errorf("texts don't match. expected %s, got %s", "foo bar", plaintext)
+			}
+
+			decrypted := &bytes.Buffer{}
+			if err := e.DecryptStreamWith(decrypted, bytes.NewReader(ciphertext), []byte("id"), identity); err != nil {
+				t.Fatalf("failed to decrypt as a stream : %s", err.Error())
+			}
+			if decrypted.String() != "foo bar" {
+				t.Errorf("texts don't match. expected %s, got %s", "foo bar", decrypted.String())
+			}
+		}
+
+		if _, err := e.DecryptWith(ciphertext, []byte("id"), eve); err != ErrWrongKey {
+			t.Errorf("expected %v for an identity that isn't a recipient, got %v", ErrWrongKey, err)
+		}
+		if err := e.DecryptStreamWith(&bytes.Buffer{}, bytes.NewReader(ciphertext), []byte("id"), eve); err != ErrWrongKey {
+			t.Errorf("expected %v for an identity that isn't a recipient, got %v", ErrWrongKey, err)
+		}
+		if key, err := e.OpenKeyWith(ciphertext, bob); err != nil || key == nil {
+			t.Errorf("failed to open the key : %v", err)
+		}
+		if _, err := e.DecryptWith(ciphertext, []byte("other id"), alice); err == nil {
+			t.Error("expected other additional data to fail authentication but got success")
+		}
+	}
+}
+
+func TestRecipientHeaderErrors(t *testing.T) {
+	chacha, _ := NewChaCha20Engine()
+	e := NewRecipientEngine(chacha)
+	identity, recipient, _ := GenerateIdentity()
+
+	key, _ := e.GenerateNewKey()
+	ciphertext, _ := e.Encrypt([]byte("foo bar"), nil, key)
+	if _, err := e.DecryptWith(ciphertext, nil, identity); err != ErrNoRecipientHeader {
+		t.Errorf("expected %v for an envelope, got %v", ErrNoRecipientHeader, err)
+	}
+
+	// all zeros is a point of low order, nothing can be sealed to it
+	if _, err := e.EncryptTo([]byte("foo bar"), nil, []*[32]byte{{}}); errors.Cause(err) != ErrInvalidRecipient {
+		t.Errorf("expected %v for a low order point, got %v", ErrInvalidRecipient, err)
+	}
+	if _, err := e.EncryptTo([]byte("foo bar"), nil, nil); err == nil {
+		t.Error("expected an error without recipients but got success")
+	}
+
+	sealed, err := e.EncryptTo([]byte("foo bar"), nil, []*[32]byte{recipient})
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+	header, err := ParseRecipientHeader(sealed)
+	if err != nil {
+		t.Fatalf("failed to parse recipient header : %s", err.Error())
+	}
+	headerSize := len(header.Header())
+
+	// a swapped stanza opens to another data key, and the header is
+	// authenticated with the envelope anyway
+	otherKey, _ := e.GenerateNewKey()
+	otherStanza, _ := SealKey(otherKey, recipient, nil)
+	swapped := append(append([]byte(nil), sealed[:6]...), otherStanza...)
+	swapped = append(swapped, sealed[headerSize:]...)
+	if _, err := e.DecryptWith(swapped, nil, identity); err == nil {
+		t.Error("expected a swapped stanza to fail but got success")
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[headerSize-1] ^= 0xff
+	if _, err := e.DecryptWith(tampered, nil, identity); err != ErrWrongKey {
+		t.Errorf("expected %v for a tampered stanza, got %v", ErrWrongKey, err)
+	}
+
+	if _, err := ParseRecipientHeader(sealed[:headerSize-1]); err != ErrMalformedEnvelope {
+		t.Errorf("expected %v for a truncated header, got %v", ErrMalformedEnvelope, err)
+	}
+
+	// the stanza additional data binds a sealed key to its use
+	stanza, _ := SealKey(key, recipient, []byte("id"))
+	if _, err := OpenKey(stanza, identity, []byte("other id")); err != ErrWrongKey {
+		t.Errorf("expected %v for other additional data, got %v", ErrWrongKey, err)
+	}
+	opened, err := OpenKey(stanza, identity, []byte("id"))
+	if err != nil {
+		t.Fatalf("failed to open key : %s", err.Error())
+	}
+	if *opened != *key {
+		t.Error("opened key doesn't match")
+	}
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Streamed ciphertexts use envelope version 2. The header is the same as in
+// version 1, except that its nonce field holds a nonce prefix. The payload is
+// split into segments of StreamSegmentSize bytes that are sealed one by one
+// following the STREAM construction: the nonce of a segment is the prefix
+// followed by the 32-bit big endian segment counter and a byte that is 1 for
+// the last segment and 0 for all others. Only the last segment may be shorter
+// than StreamSegmentSize, and it is empty for an empty payload. Reordered,
+// dropped or truncated segments fail to authenticate.
+//
+//	header      see Envelope, version 2
+//	segments    StreamSegmentSize bytes + tag each, the last one shorter
+//
+// Both the header and the caller's additional data are authenticated with
+// every segment.
+
+const (
+	StreamEnvelopeVersion = 2
+	StreamSegmentSize     = 64 * 1024
+)
+
+// streamNonceSuffixSize is the size of the counter and the last segment flag
+// at the end of a segment's nonce
+const streamNonceSuffixSize = 5
+
+var ErrStreamTooLong = errors.New("stream has too many segments")
+
+// sealStream encrypts everything read from src into a version 2 envelope
+// written to dst. At most two segments are held in memory
+func sealStream(algorithm AlgorithmID, dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	aead, err := newAEAD(algorithm, key)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, aead.NonceSize()-streamNonceSuffixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return errors.Wrap(err, "failed to create new random nonce prefix")
+	}
+
+	envelope := &Envelope{
+		Version:   StreamEnvelopeVersion,
+		Algorithm: algorithm,
+		KeyID:     KeyID(key),
+		Nonce:     prefix,
+	}
+	header := envelope.Header()
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	ad := associatedData(header, additionalData)
+
+	// one byte is read ahead, to know whether a segment is the last one
+	buf := make([]byte, StreamSegmentSize+1)
+	sealed := make([]byte, 0, StreamSegmentSize+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+
+	n, err := io.ReadFull(src, buf)
+	for counter := uint64(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "failed to read plaintext")
+		}
+		if counter > math.MaxUint32 {
+			return ErrStreamTooLong
+		}
+
+		last := n <= StreamSegmentSize
+		size := n
+		if !last {
+			size = StreamSegmentSize
+		}
+
+		segmentNonce(nonce, prefix, uint32(counter), last)
+		sealed = aead.Seal(sealed[:0], nonce, buf[:size], ad)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		buf[0] = buf[StreamSegmentSize]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
+
+// openStream decrypts an envelope read from src into dst. A version 1
+// envelope is read into memory and opened as a whole. Like open, it skips a
+// key header in front of the envelope. Plaintext is only written
+// once the segment holding it has been authenticated, but a stream that
+// fails part way has already written the segments before the failure.
+// Errors returned by dst are passed on as they are
+func openStream(dst io.Writer, src io.Reader, additionalData []byte, key *[32]byte) error {
+	src, header, err := readKeyHeader(src)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		additionalData = header.AdditionalData(additionalData)
+	}
+
+	envelope, err := ReadEnvelopeHeader(src)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(envelope.KeyID, KeyID(key)) {
+		return ErrWrongKey
+	}
+
+	if envelope.Version == EnvelopeVersion {
+		envelope.Ciphertext, err = ioutil.ReadAll(src)
+		if err != nil {
+			return errors.Wrap(err, "failed to read ciphertext")
+		}
+		plaintext, err := openEnvelope(envelope, additionalData, key)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(plaintext)
+		return err
+	}
+
+	aead, err := newAEAD(envelope.Algorithm, key)
+	if err != nil {
+		return err
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize()-streamNonceSuffixSize {
+		return ErrMalformedEnvelope
+	}
+	ad := associatedData(envelope.Header(), additionalData)
+
+	segmentSize := StreamSegmentSize + aead.Overhead()
+	buf := make([]byte, segmentSize+1)
+	opened := make([]byte, 0, StreamSegmentSize)
+	nonce := make([]byte, aead.NonceSize())
+
+	n, err := io.ReadFull(src, buf)
+	for counter := uint64(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "failed to read ciphertext")
+		}
+		if counter > math.MaxUint32 {
+			return ErrStreamTooLong
+		}
+
+		last := n <= segmentSize
+		size := n
+		if !last {
+			size = segmentSize
+		}
+
+		segmentNonce(nonce, envelope.Nonce, uint32(counter), last)
+		opened, err = aead.Open(opened[:0], nonce, buf[:size], ad)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open segment %d", counter)
+		}
+		if _, err := dst.Write(opened); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		buf[0] = buf[segmentSize]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
+
+// segmentNonce writes the nonce of a segment into nonce
+func segmentNonce(nonce, prefix []byte, counter uint32, last bool) {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// openStreamEnvelope decrypts a whole version 2 envelope held in memory
+func openStreamEnvelope(envelope *Envelope, additionalData []byte, key *[32]byte) ([]byte, error) {
+	plaintext := &bytes.Buffer{}
+	src := io.MultiReader(bytes.NewReader(envelope.Header()), bytes.NewReader(envelope.Ciphertext))
+	if err := openStream(plaintext, src, additionalData, key); err != nil {
+		return nil, err
+	}
+
+	return plaintext.Bytes(), nil
+}
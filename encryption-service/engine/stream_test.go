@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	sizes := []int{0, 1, StreamSegmentSize - 1, StreamSegmentSize, StreamSegmentSize + 1, 3*StreamSegmentSize + 5}
+
+	for _, algorithm := range []string{AlgorithmAES256GCM, AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305} {
+		e, err := New(algorithm)
+		if err != nil {
+			t.Fatalf("failed to create engine for %s : %s", algorithm, err.Error())
+		}
+
+		key, err := e.GenerateNewKey()
+		if err != nil {
+			t.Fatalf("failed to generate new key : %s", err.Error())
+		}
+
+		for _, size := range sizes {
+			plaintext := randomBytes(t, size)
+
+			ciphertext := &bytes.Buffer{}
+			if err := e.EncryptStream(ciphertext, bytes.NewReader(plaintext), []byte("id"), key); err != nil {
+				t.Fatalf("%s failed to encrypt %d bytes : %s", algorithm, size, err.Error())
+			}
+
+			decrypted := &bytes.Buffer{}
+			if err := e.DecryptStream(decrypted, bytes.NewReader(ciphertext.Bytes()), []byte("id"), key); err != nil {
+				t.Fatalf("%s failed to decrypt %d bytes : %s", algorithm, size, err.Error())
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Errorf("%s texts of %d bytes don't match", algorithm, size)
+			}
+
+			// a stream fits in memory here, so Decrypt has to open it too
+			opened, err := e.Decrypt(ciphertext.Bytes(), []byte("id"), key)
+			if err != nil {
+				t.Fatalf("%s failed to decrypt a stream of %d bytes in one go : %s", algorithm, size, err.Error())
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("%s texts of %d bytes decrypted in one go don't match", algorithm, size)
+			}
+		}
+	}
+}
+
+func TestStreamDecryptErrors(t *testing.T) {
+	e, _ := NewXChaCha20Engine()
+	key, _ := e.GenerateNewKey()
+	otherKey, _ := e.GenerateNewKey()
+
+	plaintext := randomBytes(t, 3*StreamSegmentSize+5)
+	buf := &bytes.Buffer{}
+	if err := e.EncryptStream(buf, bytes.NewReader(plaintext), nil, key); err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+	ciphertext := buf.Bytes()
+
+	envelope, err := ReadEnvelopeHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatalf("failed to read envelope header : %s", err.Error())
+	}
+	headerSize := len(envelope.Header())
+	segmentSize := StreamSegmentSize + 16
+	segment := func(i int) []byte {
+		return ciphertext[headerSize+i*segmentSize : headerSize+(i+1)*segmentSize]
+	}
+
+	// dropping the tail at a segment boundary leaves a stream whose last
+	// segment isn't flagged as the last one
+	truncated := ciphertext[:headerSize+2*segmentSize]
+
+	reordered := append([]byte(nil), ciphertext[:headerSize]...)
+	reordered = append(reordered, segment(1)...)
+	reordered = append(reordered, segment(0)...)
+	reordered = append(reordered, ciphertext[headerSize+2*segmentSize:]...)
+
+	testCases := []struct {
+		ciphertext     []byte
+		additionalData []byte
+		key            *[32]byte
+	}{
+		{ciphertext: truncated, key: key},
+		{ciphertext: reordered, key: key},
+		{ciphertext: ciphertext, additionalData: []byte("other id"), key: key},
+		{ciphertext: ciphertext[:headerSize], key: key},
+	}
+
+	for i, data := range testCases {
+		if err := e.DecryptStream(io.Discard, bytes.NewReader(data.ciphertext), data.additionalData, data.key); err == nil {
+			t.Errorf("test case %d failed : expected an error but got success", i)
+		}
+	}
+
+	written := &bytes.Buffer{}
+	err = e.DecryptStream(written, bytes.NewReader(ciphertext), nil, otherKey)
+	if errors.Cause(err) != ErrWrongKey {
+		t.Errorf("expected %v, got %v", ErrWrongKey, err)
+	}
+	if written.Len() != 0 {
+		t.Errorf("expected nothing to be written with the wrong key but got %d bytes", written.Len())
+	}
+}
+
+func TestDecryptStreamOpensEnvelope(t *testing.T) {
+	e, _ := NewAESEngine()
+	key, _ := e.GenerateNewKey()
+
+	ciphertext, err := e.Encrypt([]byte("foo bar"), []byte("id"), key)
+	if err != nil {
+		t.Fatalf("failed to encrypt : %s", err.Error())
+	}
+
+	decrypted := &bytes.Buffer{}
+	if err := e.DecryptStream(decrypted, bytes.NewReader(ciphertext), []byte("id"), key); err != nil {
+		t.Fatalf("failed to decrypt a version %d envelope as a stream : %s", EnvelopeVersion, err.Error())
+	}
+	if decrypted.String() != "foo bar" {
+		t.Errorf("texts don't match. expected %s, got %s", "foo bar", decrypted.String())
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("failed to read random bytes : %s", err.Error())
+	}
+
+	return data
+}
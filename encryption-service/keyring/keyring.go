@@ -0,0 +1,148 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/encryption-service/engine"
+)
+
+var ErrUnknownKEK = errors.New("data key was wrapped with an unknown key-encryption key")
+
+// KeyRing holds the server side key-encryption keys (KEKs) used to wrap
+// per-record data keys. New data keys are always wrapped with the current
+// KEK, previous KEKs are only kept to unwrap data keys wrapped before a
+// rotation
+type KeyRing struct {
+	engine  engine.Interface
+	current *[32]byte
+	keys    map[string]*[32]byte
+}
+
+func New(encryptionEngine engine.Interface, current *[32]byte, previous ...*[32]byte) *KeyRing {
+	k := &KeyRing{
+		engine:  encryptionEngine,
+		current: current,
+		keys:    map[string]*[32]byte{},
+	}
+
+	for _, kek := range append(previous, current) {
+		k.keys[hex.EncodeToString(engine.KeyID(kek))] = kek
+	}
+
+	return k
+}
+
+// Load reads the current and previous KEKs from keyfiles. A keyfile contains
+// either the 32 raw key bytes or their base64 encoding
+func Load(encryptionEngine engine.Interface, currentFile string, previousFiles []string) (*KeyRing, error) {
+	current, err := readKeyFile(currentFile)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := []*[32]byte{}
+	for _, file := range previousFiles {
+		kek, err := readKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, kek)
+	}
+
+	return New(encryptionEngine, current, previous...), nil
+}
+
+// Wrap encrypts a data key with the current KEK
+func (k *KeyRing) Wrap(dek *[32]byte, additionalData []byte) ([]byte, error) {
+	wrapped, err := k.engine.Encrypt(dek[:], additionalData, k.current)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to wrap data key")
+	}
+
+	return wrapped, nil
+}
+
+// Unwrap decrypts a data key with whichever KEK it was wrapped with. current
+// is false when that was a previous KEK, i.e. the data key should be wrapped
+// again
+func (k *KeyRing) Unwrap(wrapped, additionalData []byte) (dek *[32]byte, current bool, err error) {
+	envelope, err := engine.ParseEnvelope(wrapped)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "malformed wrapped data key")
+	}
+
+	kek, ok := k.keys[hex.EncodeToString(envelope.KeyID)]
+	if !ok {
+		return nil, false, ErrUnknownKEK
+	}
+
+	plaintext, err := k.engine.Decrypt(wrapped, additionalData, kek)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to unwrap data key")
+	}
+	if len(plaintext) != 32 {
+		return nil, false, errors.New("unwrapped data key has the wrong length")
+	}
+
+	dek = &[32]byte{}
+	copy(dek[:], plaintext)
+
+	return dek, kek == k.current, nil
+}
+
+// IsCurrent reports whether the data key was wrapped with the current KEK
+func (k *KeyRing) IsCurrent(wrapped []byte) bool {
+	envelope, err := engine.ParseEnvelope(wrapped)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(envelope.KeyID, engine.KeyID(k.current))
+}
+
+// KEKID returns the hex id of the KEK the data key was wrapped with, and
+// whether that KEK is in the keyring
+func (k *KeyRing) KEKID(wrapped []byte) (id string, known bool, err error) {
+	envelope, err := engine.ParseEnvelope(wrapped)
+	if err != nil {
+		return "", false, errors.Wrap(err, "malformed wrapped data key")
+	}
+
+	id = hex.EncodeToString(envelope.KeyID)
+	_, known = k.keys[id]
+
+	return id, known, nil
+}
+
+// CurrentID returns the hex id of the current KEK
+func (k *KeyRing) CurrentID() string {
+	return hex.EncodeToString(engine.KeyID(k.current))
+}
+
+func readKeyFile(path string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read keyfile %s", path)
+	}
+
+	if len(data) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, errors.Errorf("keyfile %s must contain 32 raw bytes or their base64 encoding", path)
+		}
+		data = decoded
+	}
+	if len(data) != 32 {
+		return nil, errors.Errorf("keyfile %s must contain a 32 byte key, got %d bytes", path, len(data))
+	}
+
+	key := [32]byte{}
+	copy(key[:], data)
+
+	return &key, nil
+}
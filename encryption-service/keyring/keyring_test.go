@@ -0,0 +1,97 @@
+package keyring
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/akh-dev/encrypt/encryption-service/engine"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	aes, _ := engine.NewAESEngine()
+	oldKEK, _ := aes.GenerateNewKey()
+	newKEK, _ := aes.GenerateNewKey()
+	dek, _ := aes.GenerateNewKey()
+
+	wrapped, err := New(aes, oldKEK).Wrap(dek, []byte("my-1st-text"))
+	if err != nil {
+		t.Fatalf("failed to wrap data key : %s", err.Error())
+	}
+
+	// after a rotation the old KEK is only used for unwrapping
+	rotated := New(aes, newKEK, oldKEK)
+
+	unwrapped, current, err := rotated.Unwrap(wrapped, []byte("my-1st-text"))
+	if err != nil {
+		t.Fatalf("failed to unwrap data key : %s", err.Error())
+	}
+	if *unwrapped != *dek {
+		t.Error("unwrapped data key doesn't match the original")
+	}
+	if current {
+		t.Error("data key wrapped with a previous KEK was reported as current")
+	}
+
+	rewrapped, err := rotated.Wrap(unwrapped, []byte("my-1st-text"))
+	if err != nil {
+		t.Fatalf("failed to rewrap data key : %s", err.Error())
+	}
+	if _, current, err := rotated.Unwrap(rewrapped, []byte("my-1st-text")); err != nil || !current {
+		t.Errorf("expected rewrapped data key to use the current KEK, got current=%v (%v)", current, err)
+	}
+
+	if _, _, err := rotated.Unwrap(wrapped, []byte("another-id")); err == nil {
+		t.Error("expected unwrapping for another record to fail but got success")
+	}
+
+	if _, _, err := New(aes, newKEK).Unwrap(wrapped, []byte("my-1st-text")); err != ErrUnknownKEK {
+		t.Errorf("expected ErrUnknownKEK once the old KEK is dropped, got %v", err)
+	}
+
+	oldID, known, err := rotated.KEKID(wrapped)
+	if err != nil || !known || oldID == rotated.CurrentID() {
+		t.Errorf("expected the id of the previous KEK, got %s known=%v (%v)", oldID, known, err)
+	}
+	if id, _, _ := rotated.KEKID(rewrapped); id != rotated.CurrentID() {
+		t.Errorf("expected the id of the current KEK %s, got %s", rotated.CurrentID(), id)
+	}
+	if _, known, _ := New(aes, newKEK).KEKID(wrapped); known {
+		t.Error("expected a dropped KEK not to be known")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	aes, _ := engine.NewAESEngine()
+	kek, _ := aes.GenerateNewKey()
+	dir := t.TempDir()
+
+	rawFile := filepath.Join(dir, "raw.key")
+	if err := ioutil.WriteFile(rawFile, kek[:], 0600); err != nil {
+		t.Fatal(err)
+	}
+	b64File := filepath.Join(dir, "b64.key")
+	if err := ioutil.WriteFile(b64File, []byte(base64.StdEncoding.EncodeToString(kek[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	shortFile := filepath.Join(dir, "short.key")
+	if err := ioutil.WriteFile(shortFile, []byte("too short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{rawFile, b64File} {
+		k, err := Load(aes, file, nil)
+		if err != nil {
+			t.Errorf("failed to load %s : %s", file, err.Error())
+			continue
+		}
+		if *k.current != *kek {
+			t.Errorf("key loaded from %s doesn't match", file)
+		}
+	}
+
+	if _, err := Load(aes, shortFile, nil); err == nil {
+		t.Error("expected loading a short keyfile to fail but got success")
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/akh-dev/encrypt/encryption-service/engine"
 
 	"github.com/akh-dev/encrypt/encryption-service/config"
 	"github.com/akh-dev/encrypt/encryption-service/service"
+	"github.com/akh-dev/encrypt/logging"
 )
 
 func main() {
@@ -17,19 +22,39 @@ func main() {
 		log.Fatalf("Failed to load config: %+v", err)
 	}
 
-	encryptionEngine, err := engine.NewAESEngine()
+	logger := logging.New(os.Stderr, cfg.Service.Debug)
+	slog.SetDefault(logger)
+
+	encryptionEngine, err := engine.New(cfg.Service.Algorithm)
 	if err != nil {
 		log.Fatalf("Failed to initialise encryption service: %+v", err)
 	}
 
-	encryptionService, err := service.New(cfg, encryptionEngine)
+	encryptionService, err := service.New(cfg, encryptionEngine, logger)
 	if err != nil {
 		log.Fatalf("Failed to initialise encryption service: %+v", err)
 	}
 
-	encryptionService.ListenAndServe()
-
-	log.Println("Encryption-Service started, press <ENTER> to exit")
-	fmt.Scanln()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := encryptionService.ReloadCertificates(); err != nil {
+				logger.Error("failed to reload certificates", "error", err)
+				continue
+			}
+			logger.Info("certificates reloaded")
+		}
+	}()
+
+	logger.Info("Encryption-Service starting, send SIGINT or SIGTERM to stop")
+	if err := encryptionService.Run(ctx); err != nil {
+		logger.Error("Encryption-Service failed", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Encryption-Service stopped")
 
 }
@@ -2,7 +2,9 @@ package service
 
 import (
 	"encoding/json"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 
 	"github.com/akh-dev/encrypt/encryption-service/api"
@@ -34,6 +36,59 @@ func respondNotFound(w http.ResponseWriter, errors []string) {
 	respObj := &api.Response{
 		StatusCode:    http.StatusNotFound,
 		StatusMessage: http.StatusText(http.StatusNotFound),
+		ErrorCode:     api.ErrorCodeNotFound,
+		Errors:        errors,
+	}
+	writeResponse(w, respObj)
+}
+
+func respondConflict(w http.ResponseWriter, errors []string) {
+	w.WriteHeader(http.StatusConflict)
+	respObj := &api.Response{
+		StatusCode:    http.StatusConflict,
+		StatusMessage: http.StatusText(http.StatusConflict),
+		ErrorCode:     api.ErrorCodeConflict,
+		Errors:        errors,
+	}
+	writeResponse(w, respObj)
+}
+
+func respondInvalidKey(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	respObj := &api.Response{
+		StatusCode:    http.StatusBadRequest,
+		StatusMessage: "invalid key",
+		ErrorCode:     api.ErrorCodeInvalidKey,
+		Errors:        []string{},
+	}
+	writeResponse(w, respObj)
+}
+
+func respondPayloadTooLarge(w http.ResponseWriter, errors []string) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	respObj := &api.Response{
+		StatusCode:    http.StatusRequestEntityTooLarge,
+		StatusMessage: http.StatusText(http.StatusRequestEntityTooLarge),
+		Errors:        errors,
+	}
+	writeResponse(w, respObj)
+}
+
+func respondNotAcceptable(w http.ResponseWriter, errors []string) {
+	w.WriteHeader(http.StatusNotAcceptable)
+	respObj := &api.Response{
+		StatusCode:    http.StatusNotAcceptable,
+		StatusMessage: http.StatusText(http.StatusNotAcceptable),
+		Errors:        errors,
+	}
+	writeResponse(w, respObj)
+}
+
+func respondUnauthorized(w http.ResponseWriter, errors []string) {
+	w.WriteHeader(http.StatusUnauthorized)
+	respObj := &api.Response{
+		StatusCode:    http.StatusUnauthorized,
+		StatusMessage: http.StatusText(http.StatusUnauthorized),
 		Errors:        errors,
 	}
 	writeResponse(w, respObj)
@@ -42,43 +97,79 @@ func respondNotFound(w http.ResponseWriter, errors []string) {
 func writeResponse(w http.ResponseWriter, respObj *api.Response) {
 	response, err := json.Marshal(respObj)
 	if err != nil {
-		log.Println(err.Error())
+		slog.Error("failed to marshal response", "error", err)
 		return
 	}
 
-	n, err := w.Write(response)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	if _, err := w.Write(response); err != nil {
+		slog.Warn("failed to write response", "error", err)
 	}
-	log.Printf("wrote %d bytes in the response", n)
-
 }
 
 func writeCommonHeaders(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json")
 }
 
-func parseStoreRequest(r *http.Request) (*api.IdMessage, error) {
+// parseStoreRequest reads a store request with a JSON, raw or multipart body,
+// depending on its content type. The payload of a raw request is returned as
+// a reader, to be streamed, for the others it is part of the request
+func parseStoreRequest(r *http.Request) (*api.IdMessage, io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case api.ContentTypeOctetStream:
+		storeReq, err := parseRawStoreRequest(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return storeReq, r.Body, nil
+	case "multipart/form-data":
+		storeReq, err := parseMultipartStoreRequest(r)
+		return storeReq, nil, err
+	}
+
 	dec := json.NewDecoder(r.Body)
 	storeReq := &api.IdMessage{}
 	if err := dec.Decode(storeReq); err != nil {
-		err = errors.Wrap(err, "failed to parse Store request")
-		log.Println(err.Error())
-		return nil, err
+		return nil, nil, errors.Wrap(err, "failed to parse Store request")
 	}
 
-	return storeReq, nil
+	return storeReq, nil, nil
 }
 
 func parseRetrieveRequest(r *http.Request) (*api.IdKeyPair, error) {
+	if retrieveReq := idKeyPairFromHeaders(r); retrieveReq != nil {
+		return retrieveReq, nil
+	}
+
 	dec := json.NewDecoder(r.Body)
 	retrieveReq := &api.IdKeyPair{}
 	if err := dec.Decode(retrieveReq); err != nil {
-		err = errors.Wrap(err, "failed to parse Retrieve request")
-		log.Println(err.Error())
-		return nil, err
+		return nil, errors.Wrap(err, "failed to parse Retrieve request")
 	}
 
 	return retrieveReq, nil
 }
+
+func parseDeleteRequest(r *http.Request) (*api.IdKeyPair, error) {
+	if deleteReq := idKeyPairFromHeaders(r); deleteReq != nil {
+		return deleteReq, nil
+	}
+
+	dec := json.NewDecoder(r.Body)
+	deleteReq := &api.IdKeyPair{}
+	if err := dec.Decode(deleteReq); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Delete request")
+	}
+
+	return deleteReq, nil
+}
+
+func parseShareRequest(r *http.Request) (*api.ShareRequest, error) {
+	dec := json.NewDecoder(r.Body)
+	shareReq := &api.ShareRequest{}
+	if err := dec.Decode(shareReq); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Share request")
+	}
+
+	return shareReq, nil
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/encryption-service/api"
+)
+
+// multipartMaxMemory is how much of a multipart upload is kept in memory,
+// the rest is buffered in temporary files
+const multipartMaxMemory = 32 << 20
+
+// parseRawStoreRequest reads the fields of a store request with an
+// application/octet-stream body from its headers. The payload is left in the
+// body, to be encrypted as it is read
+func parseRawStoreRequest(r *http.Request) (*api.IdMessage, error) {
+	storeReq := &api.IdMessage{
+		Id:          r.Header.Get(api.IdHeader),
+		ContentType: r.Header.Get(api.ContentTypeHeader),
+		Passphrase:  r.Header.Get(api.PassphraseHeader),
+		Recipients:  splitList(r.Header.Get(api.RecipientsHeader)),
+	}
+
+	ttlSeconds, err := optionalInt(api.TTLSecondsHeader, r.Header.Get(api.TTLSecondsHeader))
+	if err != nil {
+		return nil, err
+	}
+	storeReq.TTLSeconds = int64(ttlSeconds)
+
+	if storeReq.MaxReads, err = optionalInt(api.MaxReadsHeader, r.Header.Get(api.MaxReadsHeader)); err != nil {
+		return nil, err
+	}
+	if storeReq.IfMatch, err = optionalInt(api.IfMatchHeader, r.Header.Get(api.IfMatchHeader)); err != nil {
+		return nil, err
+	}
+	if storeReq.SplitShares, err = optionalInt(api.SplitSharesHeader, r.Header.Get(api.SplitSharesHeader)); err != nil {
+		return nil, err
+	}
+	if storeReq.SplitThreshold, err = optionalInt(api.SplitThresholdHeader, r.Header.Get(api.SplitThresholdHeader)); err != nil {
+		return nil, err
+	}
+
+	return storeReq, nil
+}
+
+// parseMultipartStoreRequest reads a multipart/form-data store request. The
+// payload is either a file, whose content type is kept unless content_type
+// is set, or a plain field. The other fields are named like in JSON requests
+func parseMultipartStoreRequest(r *http.Request) (*api.IdMessage, error) {
+	if err := r.ParseMultipartForm(multipartMaxMemory); err != nil {
+		return nil, errors.Wrap(err, "failed to parse multipart form")
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	storeReq := &api.IdMessage{
+		Id:          r.FormValue("id"),
+		ContentType: r.FormValue("content_type"),
+		Passphrase:  r.FormValue("passphrase"),
+		Recipients:  splitList(r.FormValue("recipients")),
+	}
+
+	file, header, err := r.FormFile("payload")
+	switch err {
+	case nil:
+		defer file.Close()
+		payload, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read payload")
+		}
+		storeReq.Payload = string(payload)
+		if storeReq.ContentType == "" {
+			storeReq.ContentType = header.Header.Get("Content-Type")
+		}
+	case http.ErrMissingFile:
+		storeReq.Payload = r.FormValue("payload")
+	default:
+		return nil, errors.Wrap(err, "failed to read payload")
+	}
+
+	ttlSeconds, err := optionalInt("ttl_seconds", r.FormValue("ttl_seconds"))
+	if err != nil {
+		return nil, err
+	}
+	storeReq.TTLSeconds = int64(ttlSeconds)
+
+	if storeReq.MaxReads, err = optionalInt("max_reads", r.FormValue("max_reads")); err != nil {
+		return nil, err
+	}
+	if storeReq.IfMatch, err = optionalInt("if_match", r.FormValue("if_match")); err != nil {
+		return nil, err
+	}
+	if storeReq.SplitShares, err = optionalInt("split_shares", r.FormValue("split_shares")); err != nil {
+		return nil, err
+	}
+	if storeReq.SplitThreshold, err = optionalInt("split_threshold", r.FormValue("split_threshold")); err != nil {
+		return nil, err
+	}
+
+	return storeReq, nil
+}
+
+// optionalInt parses a numeric field of a raw or multipart request, a
+// missing field is zero
+func optionalInt(name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "malformed %s", name)
+	}
+
+	return n, nil
+}
+
+// splitList splits a comma separated field of a raw or multipart request, a
+// missing field is an empty list
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// idKeyPairFromHeaders reads the id and the key, key shares, passphrase or
+// identity of a request without a body. It returns nil if the request has no id header
+func idKeyPairFromHeaders(r *http.Request) *api.IdKeyPair {
+	id := r.Header.Get(api.IdHeader)
+	if id == "" {
+		return nil
+	}
+
+	return &api.IdKeyPair{
+		Id:         id,
+		Key:        r.Header.Get(api.KeyHeader),
+		KeyShares:  splitList(r.Header.Get(api.KeySharesHeader)),
+		Passphrase: r.Header.Get(api.PassphraseHeader),
+		Identity:   r.Header.Get(api.IdentityHeader),
+		Share:      r.Header.Get(api.ShareHeader),
+	}
+}
+
+// acceptsRawPayload reports whether the request asks for the payload as the
+// raw response body rather than as a JSON string
+func acceptsRawPayload(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == api.ContentTypeOctetStream {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeRawHeaders starts a response whose body is the raw payload of a
+// retrieved text, with the content type it was stored with. The length of a
+// streamed payload isn't known up front
+func writeRawHeaders(w http.ResponseWriter, id string, text *Text) {
+	contentType := text.ContentType
+	if contentType == "" {
+		contentType = api.ContentTypeOctetStream
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	// the content type is chosen by whoever stored the text
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(api.IdHeader, id)
+	w.Header().Set(api.VersionHeader, strconv.Itoa(text.Version))
+	w.WriteHeader(http.StatusOK)
+}
+
+// streamingWriter passes the plaintext of a streamed retrieve on to the
+// response. Nothing is written before start has succeeded, which happens on
+// the first write, i.e. once the first segment has been authenticated
+type streamingWriter struct {
+	w       io.Writer
+	start   func() error
+	started bool
+}
+
+func (s *streamingWriter) Write(p []byte) (int, error) {
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+
+	return s.w.Write(p)
+}
+
+// begin calls start unless it has been called already. A text with an empty
+// payload is never written, so begin is called once it has been decrypted
+func (s *streamingWriter) begin() error {
+	if s.started {
+		return nil
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.started = true
+
+	return nil
+}
@@ -3,54 +3,176 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
-	"strings"
+	"os"
+	"sync/atomic"
 	"time"
-
-	storageApi "github.com/akh-dev/encrypt/storage-service/api"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 
 	"github.com/akh-dev/encrypt/encryption-service/api"
 	"github.com/akh-dev/encrypt/encryption-service/config"
 	"github.com/akh-dev/encrypt/encryption-service/engine"
+	"github.com/akh-dev/encrypt/encryption-service/keyring"
+	"github.com/akh-dev/encrypt/encryption-service/shamir"
+	"github.com/akh-dev/encrypt/logging"
+)
+
+var (
+	NotFoundError          = errors.New("text not found")
+	InvalidKeyError        = errors.New("invalid key")
+	UnwrapUnavailableError = errors.New("no wrapped data key available")
+	ConflictError          = errors.New("text already exists or has been changed")
+	TooLargeError          = errors.New("text is larger than the storage accepts")
 )
 
-var NotFoundError = errors.New("text not found")
+const (
+	// wrappedKeyMetadata is the storage metadata entry holding a record's
+	// data key wrapped with the KEK
+	wrappedKeyMetadata = "wrapped_key"
+
+	// contentTypeMetadata is the storage metadata entry holding the media
+	// type of a record's payload
+	contentTypeMetadata = "content_type"
+)
 
 type Service struct {
-	config *config.Config
-	engine engine.Interface
-	client *http.Client
+	config     *config.Config
+	engine     engine.Interface
+	recipients engine.RecipientInterface
+	keyring    *keyring.KeyRing
+	kdfCost    engine.Argon2idCost
+	kdfMax     engine.Argon2idCost
+	client     atomic.Pointer[http.Client]
+	server     *http.Server
+	logger     *slog.Logger
+
+	serverCert *keyPair
 }
 
-func New(cfg *config.Config, engine engine.Interface) (*Service, error) {
+func New(cfg *config.Config, e engine.Interface, logger *slog.Logger) (*Service, error) {
 	svc := &Service{
-		config: cfg,
-		engine: engine,
-		client: http.DefaultClient,
+		config:     cfg,
+		engine:     e,
+		recipients: engine.NewRecipientEngine(e),
+		logger:     logger,
+	}
+
+	client, err := svc.newStorageClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create storage client")
+	}
+	svc.client.Store(client)
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		svc.serverCert, err = newKeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load TLS certificate")
+		}
+	}
+
+	svc.kdfCost, err = argon2idCost(cfg.Passphrase.Time, cfg.Passphrase.Memory, cfg.Passphrase.Threads)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid passphrase config")
+	}
+
+	svc.kdfMax, err = argon2idCost(
+		max(cfg.Passphrase.MaxTime, cfg.Passphrase.Time),
+		max(cfg.Passphrase.MaxMemory, cfg.Passphrase.Memory),
+		max(cfg.Passphrase.MaxThreads, cfg.Passphrase.Threads),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid maximum passphrase cost")
+	}
+
+	if cfg.KEK.File != "" {
+		kr, err := keyring.Load(e, cfg.KEK.File, cfg.KEK.PreviousFiles)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load key-encryption keys")
+		}
+		svc.keyring = kr
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", svc.defaultHandler)
+	mux.HandleFunc("/store", svc.handleStoreRequest)
+	mux.HandleFunc("/retrieve", svc.handleRetrieveRequest)
+	mux.HandleFunc("/delete", svc.handleDeleteRequest)
+	mux.HandleFunc("/share", svc.handleShareRequest)
+	mux.HandleFunc("/revoke", svc.handleRevokeRequest)
+
+	svc.server = &http.Server{
+		Addr:      fmt.Sprintf(":%s", cfg.Service.Port),
+		Handler:   logging.Middleware(logger, mux),
+		TLSConfig: svc.serverTLSConfig(),
 	}
 
 	return svc, nil
 }
 
-func (s *Service) ListenAndServe() {
-	http.HandleFunc("/", s.defaultHandler)
-	http.HandleFunc("/store", s.handleStoreRequest)
-	http.HandleFunc("/retrieve", s.handleRetrieveRequest)
+// Run serves requests until ctx is cancelled and then shuts the service down
+// gracefully. It returns an error if the service can't start, e.g. because
+// the port is already in use
+func (s *Service) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", s.server.Addr)
+	}
+	s.logger.Info("listening", "addr", listener.Addr().String(), "tls", s.server.TLSConfig != nil)
 
+	reportCtx, stopReporting := context.WithCancel(ctx)
+	defer stopReporting()
+	go s.reportKEKs(reportCtx)
+
+	errc := make(chan error, 1)
 	go func() {
-		//err := http.ListenAndServeTLS(fmt.Sprintf(":%s", s.port), "cert.pem", "key.pem")
-		err := http.ListenAndServe(fmt.Sprintf(":%s", s.config.Service.Port), nil)
-		if err != nil {
-			log.Fatal(err.Error())
+		if s.server.TLSConfig != nil {
+			// certificates come from TLSConfig.GetCertificate
+			errc <- s.server.ServeTLS(listener, "", "")
+		} else {
+			errc <- s.server.Serve(listener)
 		}
 	}()
+
+	select {
+	case err := <-errc:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return errors.Wrap(err, "server failed")
+	case <-ctx.Done():
+	}
+
+	timeout := time.Duration(s.config.Service.ShutdownTimeout) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return s.Shutdown(shutdownCtx)
+}
+
+// Handler returns the handler serving the API, without the listener
+func (s *Service) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Shutdown stops accepting new requests and waits for the in-flight ones to
+// finish, or for ctx to expire
+func (s *Service) Shutdown(ctx context.Context) error {
+	if err := s.server.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "failed to shut down the server")
+	}
+
+	return nil
 }
 
 func (s *Service) defaultHandler(w http.ResponseWriter, r *http.Request) {
@@ -59,6 +181,7 @@ func (s *Service) defaultHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) handleStoreRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	writeCommonHeaders(w)
 
 	if r.Method != http.MethodPost {
@@ -66,38 +189,144 @@ func (s *Service) handleStoreRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	storeReq, err := parseStoreRequest(r)
+	storeReq, body, err := parseStoreRequest(r)
 	if err != nil {
-		log.Printf("failed to parse request data : %s", err.Error())
+		logger.Warn("failed to parse request data", "error", err)
 		respondBadRequest(w, "bad request", []string{})
 		return
 	}
-	if s.config.Service.Debug {
-		log.Printf("handleStoreRequest: request data: %s, %s", storeReq.Id, storeReq.Payload)
+	logger.Debug("store request", "id", storeReq.Id, "payload_bytes", len(storeReq.Payload), "ttl_seconds", storeReq.TTLSeconds, "max_reads", storeReq.MaxReads, "with_passphrase", storeReq.Passphrase != "", "recipients", len(storeReq.Recipients), "split_shares", storeReq.SplitShares, "split_threshold", storeReq.SplitThreshold)
+
+	if storeReq.TTLSeconds < 0 {
+		respondBadRequest(w, "bad request", []string{"ttl_seconds must not be negative"})
+		return
+	}
+	if storeReq.MaxReads < 0 {
+		respondBadRequest(w, "bad request", []string{"max_reads must not be negative"})
+		return
+	}
+	if storeReq.IfMatch < 0 {
+		respondBadRequest(w, "bad request", []string{"if_match must not be negative"})
+		return
+	}
+
+	if storeReq.Id == "" {
+		if storeReq.IfMatch != 0 {
+			respondBadRequest(w, "bad request", []string{"if_match requires an id"})
+			return
+		}
+		storeReq.Id, err = newId()
+		if err != nil {
+			logger.Error("failed to generate an id", "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+			return
+		}
+	} else if !s.config.Service.AllowClientIds && storeReq.IfMatch == 0 {
+		// replacing needs the id, but can't create a text with it
+		respondBadRequest(w, "bad request", []string{"ids are generated by the server, leave the id empty"})
+		return
 	}
 
-	newKey, err := s.ProcessStore([]byte(storeReq.Id), []byte(storeReq.Payload))
+	if storeReq.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(storeReq.ContentType); err != nil {
+			respondBadRequest(w, "bad request", []string{"malformed content type"})
+			return
+		}
+	}
+
+	if storeReq.Passphrase != "" && len(storeReq.Recipients) > 0 {
+		respondBadRequest(w, "bad request", []string{"send either a passphrase or recipients, not both"})
+		return
+	}
+	recipients, err := decodeRecipients(storeReq.Recipients)
 	if err != nil {
-		log.Printf("failed to process Store request: %s", err.Error())
-		respondInternalServerError(w, "internal server error", []string{})
+		respondBadRequest(w, "bad request", []string{err.Error()})
+		return
+	}
+
+	split := storeReq.SplitShares != 0 || storeReq.SplitThreshold != 0
+	if split {
+		if storeReq.Passphrase != "" || len(storeReq.Recipients) > 0 {
+			respondBadRequest(w, "bad request", []string{"only a random key can be split, not with a passphrase or recipients"})
+			return
+		}
+		if storeReq.SplitThreshold < 2 || storeReq.SplitThreshold > storeReq.SplitShares || storeReq.SplitShares > shamir.MaxShares {
+			respondBadRequest(w, "bad request", []string{fmt.Sprintf("split_threshold must be between 2 and split_shares, at most %d", shamir.MaxShares)})
+			return
+		}
+	}
+
+	opts := StoreOptions{
+		TTL:         time.Duration(storeReq.TTLSeconds) * time.Second,
+		MaxReads:    storeReq.MaxReads,
+		IfMatch:     storeReq.IfMatch,
+		ContentType: storeReq.ContentType,
+		Passphrase:  []byte(storeReq.Passphrase),
+		Recipients:  recipients,
+		NoWrap:      split,
+	}
+
+	var newKey []byte
+	var version int
+	if body != nil {
+		newKey, version, err = s.ProcessStoreStream(r.Context(), []byte(storeReq.Id), body, opts)
+	} else {
+		newKey, version, err = s.ProcessStore(r.Context(), []byte(storeReq.Id), []byte(storeReq.Payload), opts)
+	}
+	if err != nil {
+		if err == ConflictError {
+			if storeReq.IfMatch == 0 {
+				respondConflict(w, []string{fmt.Sprintf("text with id %s already exists", storeReq.Id)})
+			} else {
+				respondConflict(w, []string{fmt.Sprintf("text with id %s is not at version %d", storeReq.Id, storeReq.IfMatch)})
+			}
+		} else if err == NotFoundError {
+			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", storeReq.Id)})
+		} else if err == TooLargeError {
+			respondPayloadTooLarge(w, []string{"the text is larger than the storage accepts"})
+		} else if errors.Cause(err) == engine.ErrInvalidRecipient {
+			respondBadRequest(w, "bad request", []string{"invalid recipient public key"})
+		} else {
+			logger.Error("failed to process Store request", "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+		}
 		return
 	}
 
-	newKeyB64 := base64.StdEncoding.EncodeToString(newKey[:])
+	// a key derived from a passphrase isn't returned, the passphrase is
+	// what the caller keeps. Neither is the key of a text encrypted to
+	// recipients, their identities are
+	result := api.IdKeyPair{
+		Id:      storeReq.Id,
+		Version: version,
+	}
+	switch {
+	case newKey != nil && split:
+		// the key itself is forgotten, only the shares leave the service
+		shares, err := shamir.Split(newKey, storeReq.SplitShares, storeReq.SplitThreshold)
+		if err != nil {
+			logger.Error("failed to split key", "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+			return
+		}
+		for _, share := range shares {
+			result.KeyShares = append(result.KeyShares, base64.StdEncoding.EncodeToString(share))
+		}
+	case newKey != nil:
+		result.Key = base64.StdEncoding.EncodeToString(newKey)
+	}
 	respObj := &api.Response{
 		StatusCode:    0,
 		StatusMessage: "Success",
-		Result: api.IdKeyPair{
-			Id:  storeReq.Id,
-			Key: newKeyB64,
-		},
-		Errors: []string{},
+		Result:        result,
+		Errors:        []string{},
 	}
 
 	writeResponse(w, respObj)
 }
 
 func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	writeCommonHeaders(w)
 
 	if r.Method != http.MethodGet {
@@ -107,27 +336,163 @@ func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request)
 
 	retrieveReq, err := parseRetrieveRequest(r)
 	if err != nil {
-		log.Printf("failed to parse request data : %s", err.Error())
+		logger.Warn("failed to parse request data", "error", err)
 		respondBadRequest(w, "bad request", []string{})
 		return
 	}
-	if s.config.Service.Debug {
-		log.Printf("handleRetrieveRequest: request data: id:[%s], key:[%s]", retrieveReq.Id, retrieveReq.Key)
+	logger.Debug("retrieve request", "id", retrieveReq.Id, "with_key", retrieveReq.Key != "", "with_passphrase", retrieveReq.Passphrase != "", "with_identity", retrieveReq.Identity != "", "share", retrieveReq.Share, "key_shares", len(retrieveReq.KeyShares))
+
+	creds, ok := s.checkCredentials(w, r, retrieveReq)
+	if !ok {
+		return
 	}
+	id := []byte(retrieveReq.Id)
 
-	key, err := base64.StdEncoding.DecodeString(retrieveReq.Key)
+	if acceptsRawPayload(r) {
+		s.streamRetrieveResponse(w, r, retrieveReq.Id, func(dst io.Writer, start func(*Text)) error {
+			switch {
+			case creds.Share != "":
+				return s.ProcessRetrieveStreamShare(r.Context(), id, creds.Share, creds.Identity, dst, start)
+			case creds.Passphrase != nil:
+				return s.ProcessRetrieveStreamPassphrase(r.Context(), id, creds.Passphrase, dst, start)
+			case creds.Identity != nil:
+				return s.ProcessRetrieveStreamIdentity(r.Context(), id, creds.Identity, dst, start)
+			case creds.Key == nil:
+				return s.ProcessRetrieveStreamUnwrapped(r.Context(), id, dst, start)
+			default:
+				return s.ProcessRetrieveStream(r.Context(), id, creds.Key, dst, start)
+			}
+		})
+		return
+	}
+
+	var text *Text
+	switch {
+	case creds.Share != "":
+		text, err = s.ProcessRetrieveShare(r.Context(), id, creds.Share, creds.Identity)
+	case creds.Passphrase != nil:
+		text, err = s.ProcessRetrievePassphrase(r.Context(), id, creds.Passphrase)
+	case creds.Identity != nil:
+		text, err = s.ProcessRetrieveIdentity(r.Context(), id, creds.Identity)
+	case creds.Key == nil:
+		text, err = s.ProcessRetrieveUnwrapped(r.Context(), id)
+	default:
+		text, err = s.ProcessRetrieve(r.Context(), id, creds.Key)
+	}
 	if err != nil {
-		log.Printf("malformed key, failed to decode from base64 : %s", err.Error())
-		respondInternalServerError(w, "internal server", []string{})
+		respondRetrieveError(w, r, retrieveReq.Id, err)
+		return
+	}
+
+	// JSON strings can't carry arbitrary bytes, they would be mangled
+	if !utf8.Valid(text.Payload) {
+		respondNotAcceptable(w, []string{"the text is binary, retrieve it with Accept: " + api.ContentTypeOctetStream})
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result: api.IdMessage{
+			Id:          retrieveReq.Id,
+			Payload:     string(text.Payload),
+			Version:     text.Version,
+			ContentType: text.ContentType,
+		},
+		Errors: []string{},
+	}
+
+	writeResponse(w, respObj)
+}
+
+// streamRetrieveResponse decrypts a text straight into the response with
+// one of the ProcessRetrieveStream methods. Errors found before the first
+// segment is authenticated get the usual JSON error response. Later ones can
+// only abort the response, so the client sees a truncated body instead of a
+// complete one
+func (s *Service) streamRetrieveResponse(w http.ResponseWriter, r *http.Request, id string, retrieve func(dst io.Writer, start func(*Text)) error) {
+	started := false
+	start := func(text *Text) {
+		started = true
+		writeRawHeaders(w, id, text)
+	}
+
+	err := retrieve(w, start)
+	if err == nil {
+		return
+	}
+	if !started {
+		respondRetrieveError(w, r, id, err)
 		return
 	}
 
-	payload, err := s.ProcessRetrieve([]byte(retrieveReq.Id), key)
+	logging.FromContext(r.Context()).Warn("aborting streamed retrieve response", "id", id, "error", err)
+	panic(http.ErrAbortHandler)
+}
+
+// respondRetrieveError responds to a retrieve request that failed
+func respondRetrieveError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if err == NotFoundError {
+		respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", id)})
+	} else if err == InvalidKeyError {
+		respondInvalidKey(w)
+	} else if err == ConflictError {
+		respondConflict(w, []string{fmt.Sprintf("text with id %s was replaced while it was read, retrieve it again", id)})
+	} else if err == UnwrapUnavailableError {
+		respondBadRequest(w, "server side unwrap is not available for this text", []string{})
+	} else {
+		logging.FromContext(r.Context()).Error("failed to process retrieve request", "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+	}
+}
+
+func (s *Service) handleDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	writeCommonHeaders(w)
+
+	if r.Method != http.MethodDelete {
+		respondBadRequest(w, "unknown request", []string{})
+		return
+	}
+
+	deleteReq, err := parseDeleteRequest(r)
+	if err != nil {
+		logger.Warn("failed to parse request data", "error", err)
+		respondBadRequest(w, "bad request", []string{})
+		return
+	}
+	logger.Debug("delete request", "id", deleteReq.Id, "with_key", deleteReq.Key != "", "with_passphrase", deleteReq.Passphrase != "", "with_identity", deleteReq.Identity != "", "key_shares", len(deleteReq.KeyShares))
+
+	creds, ok := s.checkCredentials(w, r, deleteReq)
+	if !ok {
+		return
+	}
+	if creds.Share != "" {
+		respondBadRequest(w, "bad request", []string{"a share can't be used to delete a text"})
+		return
+	}
+
+	switch {
+	case creds.Passphrase != nil:
+		err = s.ProcessDeletePassphrase(r.Context(), []byte(deleteReq.Id), creds.Passphrase)
+	case creds.Identity != nil:
+		err = s.ProcessDeleteIdentity(r.Context(), []byte(deleteReq.Id), creds.Identity)
+	case creds.Key == nil:
+		err = s.ProcessDeleteUnwrapped(r.Context(), []byte(deleteReq.Id))
+	default:
+		err = s.ProcessDelete(r.Context(), []byte(deleteReq.Id), creds.Key)
+	}
 	if err != nil {
 		if err == NotFoundError {
-			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", retrieveReq.Id)})
+			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", deleteReq.Id)})
+		} else if err == InvalidKeyError {
+			respondInvalidKey(w)
+		} else if err == UnwrapUnavailableError {
+			respondBadRequest(w, "server side unwrap is not available for this text", []string{})
+		} else if err == ConflictError {
+			respondConflict(w, []string{fmt.Sprintf("text with id %s has been replaced since it was opened", deleteReq.Id)})
 		} else {
-			log.Printf("failed to process retrieve request: %s", err.Error())
+			logger.Error("failed to process delete request", "error", err)
 			respondInternalServerError(w, "internal server error", []string{})
 		}
 		return
@@ -136,9 +501,8 @@ func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request)
 	respObj := &api.Response{
 		StatusCode:    0,
 		StatusMessage: "Success",
-		Result: api.IdMessage{
-			Id:      retrieveReq.Id,
-			Payload: string(payload),
+		Result: api.Id{
+			Id: deleteReq.Id,
 		},
 		Errors: []string{},
 	}
@@ -146,169 +510,529 @@ func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request)
 	writeResponse(w, respObj)
 }
 
-func (s *Service) ProcessStore(id, payload []byte) (aesKey []byte, err error) {
+// Credentials prove access to a text, at most one of Key, Passphrase and
+// Identity is set. Share names the share Identity opens, instead of the
+// recipients the text was stored for. None is set for a request authorised
+// to have the key unwrapped
+type Credentials struct {
+	Key        []byte
+	Passphrase []byte
+	Identity   *[32]byte
+	Share      string
+}
 
-	newKey, err := s.engine.GenerateNewKey()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to generate a new key during processing a store request")
+// checkCredentials decodes the key or identity of a retrieve, delete or share
+// request, key shares are combined into the key. A request with none of a
+// key, key shares, a passphrase and an identity has to be authorised to have
+// the key unwrapped. It responds and returns false if the request can't go on
+func (s *Service) checkCredentials(w http.ResponseWriter, r *http.Request, req *api.IdKeyPair) (*Credentials, bool) {
+	given := 0
+	for _, credential := range []bool{req.Key != "", len(req.KeyShares) > 0, req.Passphrase != "", req.Identity != ""} {
+		if credential {
+			given++
+		}
+	}
+
+	switch {
+	case given > 1:
+		respondBadRequest(w, "bad request", []string{"send only one of a key, key shares, a passphrase and an identity"})
+		return nil, false
+	case req.Share != "" && req.Identity == "":
+		respondBadRequest(w, "bad request", []string{"a share is opened with the identity of its recipient"})
+		return nil, false
+	case req.Passphrase != "":
+		return &Credentials{Passphrase: []byte(req.Passphrase)}, true
+	case req.Identity != "":
+		identity, err := base64.StdEncoding.DecodeString(req.Identity)
+		if err != nil || len(identity) != 32 {
+			logging.FromContext(r.Context()).Warn("malformed identity, expected 32 base64 encoded bytes")
+			respondInvalidKey(w)
+			return nil, false
+		}
+		creds := &Credentials{Identity: &[32]byte{}, Share: req.Share}
+		copy(creds.Identity[:], identity)
+		return creds, true
+	case len(req.KeyShares) > 0:
+		key, err := combineKeyShares(req.KeyShares)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("malformed key shares", "error", err)
+			respondInvalidKey(w)
+			return nil, false
+		}
+		return &Credentials{Key: key}, true
+	case req.Key == "":
+		if !s.authorisedToUnwrap(r) {
+			respondUnauthorized(w, []string{"a key, key shares, a passphrase, an identity or an authorised unwrap token is required"})
+			return nil, false
+		}
+		return &Credentials{}, true
 	}
 
-	cipherText, err := s.engine.Encrypt(payload, newKey)
+	key, err := base64.StdEncoding.DecodeString(req.Key)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to encrypt")
+		logging.FromContext(r.Context()).Warn("malformed key, failed to decode from base64", "error", err)
+		respondInvalidKey(w)
+		return nil, false
+	}
+
+	return &Credentials{Key: key}, true
+}
+
+// combineKeyShares recovers a key from base64 Shamir shares. Too few shares
+// recover a wrong key, which fails to decrypt like any other
+func combineKeyShares(encoded []string) ([]byte, error) {
+	shares := [][]byte{}
+	for _, share := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(share)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode from base64")
+		}
+		shares = append(shares, decoded)
+	}
+
+	return shamir.Combine(shares)
+}
+
+// decodeRecipients decodes the base64 X25519 public keys of the recipients
+// of a text to store
+func decodeRecipients(encoded []string) ([]*[32]byte, error) {
+	if len(encoded) > engine.MaxRecipients {
+		return nil, errors.Errorf("a text can have at most %d recipients", engine.MaxRecipients)
 	}
 
-	if err := s.sendToStorage(string(id), cipherText); err != nil {
-		return nil, errors.Wrap(err, "failed to store encoded text")
+	recipients := []*[32]byte{}
+	for _, r := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(r)
+		if err != nil || len(decoded) != 32 {
+			return nil, errors.New("malformed recipient, expected 32 base64 encoded bytes")
+		}
+		recipient := [32]byte{}
+		copy(recipient[:], decoded)
+		recipients = append(recipients, &recipient)
 	}
 
-	return newKey[:], nil
+	return recipients, nil
 }
 
-func (s *Service) sendToStorage(id string, ciphertext []byte) error {
+// authorisedToUnwrap checks the request carries the configured unwrap token
+// as a bearer token. Server side unwrap is disabled without a token
+func (s *Service) authorisedToUnwrap(r *http.Request) bool {
+	token := s.config.KEK.UnwrapToken
+	if token == "" {
+		return false
+	}
+
+	expected := []byte("Bearer " + token)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
 
-	textB64 := base64.StdEncoding.EncodeToString(ciphertext)
-	jsonreq := &storageApi.IdMessage{
-		Id:      id,
-		Payload: textB64,
+// newId generates a random 128 bit id for a text stored without one. It is
+// URL safe, so it can be passed around in links
+func newId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "failed to read random bytes")
 	}
-	buf, err := json.Marshal(jsonreq)
+
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// StoreOptions are the optional settings of a stored text
+type StoreOptions struct {
+	// TTL is how long the text is kept for, zero keeps it until it is deleted
+	TTL time.Duration
+
+	// MaxReads is how often the text can be retrieved before it is deleted,
+	// zero allows any number of retrievals
+	MaxReads int
+
+	// IfMatch replaces the text stored with the same id if it is at that
+	// version. Zero only stores the text if the id isn't taken yet
+	IfMatch int
+
+	// ContentType is the media type of the payload, returned with it
+	ContentType string
+
+	// Passphrase derives the key of the text with Argon2id instead of
+	// generating a random one. The key isn't returned then, the text is
+	// retrieved with the passphrase
+	Passphrase []byte
+
+	// Recipients are X25519 public keys the random key of the text is sealed
+	// to. The key isn't returned and isn't wrapped with the KEK, the text
+	// is only retrieved with the identity of one of the recipients
+	Recipients []*[32]byte
+
+	// NoWrap keeps the key from being wrapped with the KEK, so the text can't
+	// be retrieved server side. A key split into shares is stored like that,
+	// no single custodian must be able to decrypt the text
+	NoWrap bool
+}
+
+// Text is a retrieved and decrypted text
+type Text struct {
+	Payload     []byte
+	Version     int
+	ContentType string
+}
+
+// ProcessStore encrypts and stores the payload with a new key, and returns
+// the key and the version the text is stored at. A key derived from
+// opts.Passphrase or sealed to opts.Recipients isn't returned. It returns
+// ConflictError if the id is taken, or the text to replace is no longer at
+// opts.IfMatch
+func (s *Service) ProcessStore(ctx context.Context, id, payload []byte, opts StoreOptions) (aesKey []byte, version int, err error) {
+
+	newKey, header, record, err := s.newRecord(id, opts)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal storage request")
+		return nil, 0, err
 	}
-	body := bytes.NewBuffer(buf)
 
-	req, err := http.NewRequest(
-		http.MethodPost,
-		fmt.Sprintf("http://%s:%s%s", s.config.Storage.Host, s.config.Storage.Port, s.config.Storage.StoreUri),
-		body,
-	)
+	ad := associatedData(id, record.version)
+	if header != nil {
+		record.payload = header.Header()
+		ad = header.AdditionalData(ad)
+	}
+
+	var cipherText []byte
+	if len(opts.Recipients) > 0 {
+		cipherText, err = s.recipients.EncryptTo(payload, ad, opts.Recipients)
+	} else {
+		cipherText, err = s.engine.Encrypt(payload, ad, newKey)
+	}
 	if err != nil {
-		return errors.Wrap(err, "failed to create storage request")
+		return nil, 0, errors.Wrap(err, "failed to encrypt")
+	}
+	record.payload = append(record.payload, cipherText...)
+
+	if err := s.sendToStorage(ctx, string(id), record, opts.IfMatch); err != nil {
+		if err == ConflictError || err == NotFoundError || err == TooLargeError {
+			return nil, 0, err
+		}
+		return nil, 0, errors.Wrap(err, "failed to store encoded text")
 	}
-	req.Header.Add("Content-Type", "application/json")
 
-	timeout := time.Duration(s.config.Service.CtxTimeout) * time.Second
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	r, err := s.client.Do(req.WithContext(ctx))
+	if newKey == nil || header != nil {
+		return nil, record.version, nil
+	}
+	return newKey[:], record.version, nil
+}
+
+// ProcessStoreStream is ProcessStore for a payload read from src. The payload
+// is encrypted and sent to the storage-service as it is read, so it is never
+// held in memory as a whole
+func (s *Service) ProcessStoreStream(ctx context.Context, id []byte, src io.Reader, opts StoreOptions) (aesKey []byte, version int, err error) {
+	newKey, header, record, err := s.newRecord(id, opts)
 	if err != nil {
-		return errors.Wrap(err, "failed do perform store request")
+		return nil, 0, err
 	}
-	defer func() {
-		log.Println(r.Body.Close())
+
+	pr, pw := io.Pipe()
+	encrypted := make(chan error, 1)
+	go func() {
+		ad := associatedData(id, record.version)
+		if header != nil {
+			ad = header.AdditionalData(ad)
+			if _, err := pw.Write(header.Header()); err != nil {
+				pw.CloseWithError(err)
+				encrypted <- err
+				return
+			}
+		}
+		var err error
+		if len(opts.Recipients) > 0 {
+			err = s.recipients.EncryptStreamTo(pw, src, ad, opts.Recipients)
+		} else {
+			err = s.engine.EncryptStream(pw, src, ad, newKey)
+		}
+		pw.CloseWithError(err)
+		encrypted <- err
 	}()
 
-	response, err := ioutil.ReadAll(r.Body)
+	err = s.sendStreamToStorage(ctx, string(id), record, pr, opts.IfMatch)
+	// unblocks the encryption if the storage-service stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if encryptErr := <-encrypted; encryptErr != nil && encryptErr != io.ErrClosedPipe {
+		return nil, 0, errors.Wrap(encryptErr, "failed to encrypt")
+	}
+	if err != nil {
+		if err == ConflictError || err == NotFoundError || err == TooLargeError {
+			return nil, 0, err
+		}
+		return nil, 0, errors.Wrap(err, "failed to store encoded text")
+	}
+
+	if newKey == nil || header != nil {
+		return nil, record.version, nil
+	}
+	return newKey[:], record.version, nil
+}
+
+// newRecord generates or derives the data key of a text to be stored and
+// creates the record it is stored as, still without its ciphertext. header
+// is only set for a key derived from a passphrase, it has to precede the
+// ciphertext. A text for recipients gets no key, the recipient engine
+// generates one and seals it into the ciphertext
+func (s *Service) newRecord(id []byte, opts StoreOptions) (newKey *[32]byte, header engine.KeyHeader, record *storedRecord, err error) {
+	switch {
+	case len(opts.Recipients) > 0:
+		// the recipient engine writes its header with the key itself
+	case len(opts.Passphrase) > 0:
+		kdf, err := engine.NewKDFParams(s.kdfCost)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to create key derivation parameters")
+		}
+		newKey, header = kdf.DeriveKey(opts.Passphrase), kdf
+	default:
+		newKey, err = s.engine.GenerateNewKey()
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to generate a new key during processing a store request")
+		}
+	}
+
+	record = &storedRecord{
+		// the storage-service stores new texts at version 1 and bumps the
+		// version on every replace
+		version:  opts.IfMatch + 1,
+		metadata: map[string]string{},
+		ttl:      opts.TTL,
+		maxReads: opts.MaxReads,
+	}
+	// the server keeps no way to a key sealed to recipients
+	if s.keyring != nil && len(opts.Recipients) == 0 && !opts.NoWrap {
+		wrappedKey, err := s.keyring.Wrap(newKey, wrappedKeyAssociatedData(id, record.version))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		record.metadata[wrappedKeyMetadata] = base64.StdEncoding.EncodeToString(wrappedKey)
+	}
+	if opts.ContentType != "" {
+		record.metadata[contentTypeMetadata] = opts.ContentType
+	}
+
+	return newKey, header, record, nil
+}
+
+// ProcessRetrieve decrypts a record with the caller's key
+func (s *Service) ProcessRetrieve(ctx context.Context, id, aesKey []byte) (*Text, error) {
+	record, key, plaintext, err := s.openWithKey(ctx, id, aesKey)
 	if err != nil {
-		return errors.Wrap(err, "failed to read response body")
+		return nil, err
 	}
 
-	parsed := &storageApi.Response{}
-	err = json.Unmarshal(response, parsed)
+	usedUp, err := s.consume(ctx, id, record)
 	if err != nil {
-		return errors.Wrap(err, "failed to parse response body")
+		return nil, err
 	}
 
-	if parsed.StatusCode != 0 {
-		return errors.Wrap(err, fmt.Sprintf("unexpected return from the storage service: %d - %s, %s", parsed.StatusCode, parsed.StatusMessage, strings.Join(parsed.Errors, ":")))
+	if !usedUp {
+		s.rewrapIfNeeded(ctx, id, record, key)
 	}
 
-	return nil
+	return record.text(plaintext), nil
 }
 
-func (s *Service) getFromStorage(id string) ([]byte, error) {
-	if s.config.Service.Debug {
-		log.Printf("getFromStorage id: [%s]\n", id)
+// ProcessRetrievePassphrase decrypts a record with the key derived from the
+// passphrase it was stored with
+func (s *Service) ProcessRetrievePassphrase(ctx context.Context, id, passphrase []byte) (*Text, error) {
+	record, key, plaintext, err := s.openWithPassphrase(ctx, id, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	usedUp, err := s.consume(ctx, id, record)
+	if err != nil {
+		return nil, err
 	}
 
-	jsonreq := &storageApi.Id{
-		Id: id,
+	if !usedUp {
+		s.rewrapIfNeeded(ctx, id, record, key)
 	}
-	buf, err := json.Marshal(jsonreq)
+
+	return record.text(plaintext), nil
+}
+
+// ProcessRetrieveIdentity decrypts a record encrypted to recipients with the
+// identity of one of them
+func (s *Service) ProcessRetrieveIdentity(ctx context.Context, id []byte, identity *[32]byte) (*Text, error) {
+	record, plaintext, err := s.openWithIdentity(ctx, id, identity)
 	if err != nil {
-		log.Printf("failed to marshal retrieve request: %s", err.Error())
-		return nil, errors.Wrap(err, "failed to marshal retrieve request")
+		return nil, err
 	}
-	body := bytes.NewBuffer(buf)
 
-	req, err := http.NewRequest(
-		http.MethodGet,
-		fmt.Sprintf("http://%s:%s%s", s.config.Storage.Host, s.config.Storage.Port, s.config.Storage.RetrieveUri),
-		body,
-	)
+	// the key of a text encrypted to recipients is never wrapped, there is
+	// nothing to rewrap
+	if _, err := s.consume(ctx, id, record); err != nil {
+		return nil, err
+	}
+
+	return record.text(plaintext), nil
+}
+
+// ProcessRetrieveUnwrapped decrypts a record without the caller's key, by
+// unwrapping the data key stored next to it with the server side KEK
+func (s *Service) ProcessRetrieveUnwrapped(ctx context.Context, id []byte) (*Text, error) {
+	record, key, plaintext, err := s.openUnwrapped(ctx, id)
 	if err != nil {
-		log.Printf("failed to create retrieve request: %s", err.Error())
-		return nil, errors.Wrap(err, "failed to create retrieve request")
+		return nil, err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	timeout := time.Duration(s.config.Service.CtxTimeout) * time.Second
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	r, err := s.client.Do(req.WithContext(ctx))
+	usedUp, err := s.consume(ctx, id, record)
 	if err != nil {
-		log.Printf("failed do perform retrieve request: %s", err.Error())
-		return nil, errors.Wrap(err, "failed do perform retrieve request")
+		return nil, err
 	}
-	defer func() {
-		log.Println(r.Body.Close())
-	}()
 
-	response, err := ioutil.ReadAll(r.Body)
+	if !usedUp {
+		s.rewrapIfNeeded(ctx, id, record, key)
+	}
+
+	return record.text(plaintext), nil
+}
+
+// ProcessRetrieveStream decrypts a record with the caller's key into dst as
+// it is read from the storage-service. start is called with the details of
+// the text once its first segment has been authenticated, nothing is written
+// to dst before. A ciphertext corrupted after its first segment fails part
+// way, once start has been called. A record with a limited number of reads
+// is authenticated in full first, so a failure never uses up a read; start
+// is called once the read has been counted
+func (s *Service) ProcessRetrieveStream(ctx context.Context, id, aesKey []byte, dst io.Writer, start func(*Text)) error {
+	if len(aesKey) != 32 {
+		return InvalidKeyError
+	}
+
+	record, payload, err := s.getStream(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer closeStorageResponse(ctx, payload)
+
+	key := [32]byte{}
+	copy(key[:], aesKey)
+
+	return s.decryptStream(ctx, id, record, payload, s.decryptWithKey(&key), &key, dst, start)
+}
+
+// ProcessRetrieveStreamPassphrase is ProcessRetrieveStream with the key
+// derived from the passphrase the text was stored with
+func (s *Service) ProcessRetrieveStreamPassphrase(ctx context.Context, id, passphrase []byte, dst io.Writer, start func(*Text)) error {
+	record, payload, err := s.getStream(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer closeStorageResponse(ctx, payload)
+
+	kdf, err := s.readKDFParams(payload)
+	if err != nil {
+		return err
+	}
+
+	// the engine authenticates the header along with the ciphertext
+	src := io.MultiReader(bytes.NewReader(kdf.Header()), payload)
+
+	key := kdf.DeriveKey(passphrase)
+
+	return s.decryptStream(ctx, id, record, src, s.decryptWithKey(key), key, dst, start)
+}
+
+// ProcessRetrieveStreamIdentity is ProcessRetrieveStream with the key sealed
+// to the recipient of identity
+func (s *Service) ProcessRetrieveStreamIdentity(ctx context.Context, id []byte, identity *[32]byte, dst io.Writer, start func(*Text)) error {
+	record, payload, err := s.getStream(ctx, id)
 	if err != nil {
-		log.Printf("failed to read response body: %s", err.Error())
-		return nil, errors.Wrap(err, "failed to read response body")
+		return err
+	}
+	defer closeStorageResponse(ctx, payload)
+
+	decrypt := func(dst io.Writer, src io.Reader, additionalData []byte) error {
+		return s.recipients.DecryptStreamWith(dst, src, additionalData, identity)
+	}
+
+	// the key of a text encrypted to recipients is never wrapped, there is
+	// nothing to rewrap
+	return s.decryptStream(ctx, id, record, payload, decrypt, nil, dst, start)
+}
+
+// ProcessRetrieveStreamUnwrapped is ProcessRetrieveStream with the data key
+// unwrapped with the server side KEK
+func (s *Service) ProcessRetrieveStreamUnwrapped(ctx context.Context, id []byte, dst io.Writer, start func(*Text)) error {
+	if s.keyring == nil {
+		return UnwrapUnavailableError
 	}
 
-	parsed := &storageApi.Response{}
-	err = json.Unmarshal(response, parsed)
+	record, payload, err := s.getStream(ctx, id)
 	if err != nil {
-		log.Printf("failed to parse response body: %s", err.Error())
-		return nil, errors.Wrap(err, "failed to parse response body")
+		return err
+	}
+	defer closeStorageResponse(ctx, payload)
+
+	wrappedKey, ok := record.metadata[wrappedKeyMetadata]
+	if !ok {
+		return UnwrapUnavailableError
 	}
 
-	if parsed.StatusCode == http.StatusNotFound {
-		log.Printf("no text found for id %s", id)
-		return nil, NotFoundError
+	key, err := s.unwrapKey(id, record.version, wrappedKey)
+	if err != nil {
+		return err
 	}
 
-	if parsed.StatusCode != 0 {
-		log.Printf("unexpected status code returned from the storage service: %d - %s, %s", parsed.StatusCode, parsed.StatusMessage, strings.Join(parsed.Errors, ":"))
-		return nil, errors.Errorf("unexpected return from the storage service: %d - %s, %s", parsed.StatusCode, parsed.StatusMessage, strings.Join(parsed.Errors, ":"))
+	return s.decryptStream(ctx, id, record, payload, s.decryptWithKey(key), key, dst, start)
+}
+
+// ProcessDelete removes a record, once aesKey has proven to decrypt it
+func (s *Service) ProcessDelete(ctx context.Context, id, aesKey []byte) error {
+	record, _, _, err := s.openWithKey(ctx, id, aesKey)
+	if err != nil {
+		return err
 	}
 
-	idAndText := &storageApi.IdMessage{}
-	err = json.Unmarshal(parsed.Result, idAndText)
+	return s.shred(ctx, id, record)
+}
+
+// ProcessDeletePassphrase removes a record, once the passphrase has proven
+// to decrypt it
+func (s *Service) ProcessDeletePassphrase(ctx context.Context, id, passphrase []byte) error {
+	record, _, _, err := s.openWithPassphrase(ctx, id, passphrase)
 	if err != nil {
-		log.Printf("unexpected return from the storage %v", parsed.Result)
-		return nil, errors.Wrap(err, "unexpected return from the storage")
+		return err
 	}
 
-	if s.config.Service.Debug {
-		log.Printf("got id: [%s]\n    payload text: [%s]\n", idAndText.Id, idAndText.Payload)
+	return s.shred(ctx, id, record)
+}
+
+// ProcessDeleteIdentity removes a record, once the identity has proven to
+// decrypt it
+func (s *Service) ProcessDeleteIdentity(ctx context.Context, id []byte, identity *[32]byte) error {
+	record, _, err := s.openWithIdentity(ctx, id, identity)
+	if err != nil {
+		return err
 	}
 
-	payloadBytes, err := base64.StdEncoding.DecodeString(idAndText.Payload)
+	return s.shred(ctx, id, record)
+}
+
+// ProcessDeleteUnwrapped removes a record without the caller's key
+func (s *Service) ProcessDeleteUnwrapped(ctx context.Context, id []byte) error {
+	record, _, _, err := s.openUnwrapped(ctx, id)
 	if err != nil {
-		log.Printf("malformed text, failed to decode from base64: %s", err.Error())
-		return nil, errors.Wrap(err, "malformed text, failed to decode from base64")
+		return err
 	}
 
-	return payloadBytes, nil
+	return s.shred(ctx, id, record)
 }
 
-func (s *Service) ProcessRetrieve(id, aesKey []byte) (payload []byte, err error) {
+func (s *Service) openWithKey(ctx context.Context, id, aesKey []byte) (*storedRecord, *[32]byte, []byte, error) {
 
 	if len(aesKey) != 32 {
-		return nil, errors.New("invalid key")
+		return nil, nil, nil, InvalidKeyError
 	}
 
-	log.Printf("ProcessRetrieve: aesKey:[%s]", base64.StdEncoding.EncodeToString(aesKey[:]))
-	cipherText, err := s.getFromStorage(string(id))
+	record, err := s.getFromStorage(ctx, string(id))
 	if err != nil {
 		if err == NotFoundError {
-			return nil, err
+			return nil, nil, nil, err
 		} else {
-			return nil, errors.Wrap(err, "failed to retrieve text from storage")
+			return nil, nil, nil, errors.Wrap(err, "failed to retrieve text from storage")
 		}
 	}
 
@@ -317,15 +1041,446 @@ func (s *Service) ProcessRetrieve(id, aesKey []byte) (payload []byte, err error)
 		key[i] = b
 	}
 
-	log.Printf("ProcessRetrieve: key(array):[%s]", base64.StdEncoding.EncodeToString(key[:]))
-	plaintext, err := s.engine.Decrypt(cipherText, &key)
+	plaintext, err := s.decrypt(ctx, id, record, &key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return record, &key, plaintext, nil
+}
+
+func (s *Service) openWithPassphrase(ctx context.Context, id, passphrase []byte) (*storedRecord, *[32]byte, []byte, error) {
+
+	record, err := s.getFromStorage(ctx, string(id))
+	if err != nil {
+		if err == NotFoundError {
+			return nil, nil, nil, err
+		} else {
+			return nil, nil, nil, errors.Wrap(err, "failed to retrieve text from storage")
+		}
+	}
+
+	kdf, err := s.readKDFParams(bytes.NewReader(record.payload))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key := kdf.DeriveKey(passphrase)
+
+	plaintext, err := s.decrypt(ctx, id, record, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return record, key, plaintext, nil
+}
+
+func (s *Service) openWithIdentity(ctx context.Context, id []byte, identity *[32]byte) (*storedRecord, []byte, error) {
+
+	record, err := s.getFromStorage(ctx, string(id))
+	if err != nil {
+		if err == NotFoundError {
+			return nil, nil, err
+		} else {
+			return nil, nil, errors.Wrap(err, "failed to retrieve text from storage")
+		}
+	}
+
+	plaintext, err := s.recipients.DecryptWith(record.payload, associatedData(id, record.version), identity)
+	if err != nil {
+		return nil, nil, decryptError(err)
+	}
+
+	logging.FromContext(ctx).Debug("decrypted payload", "id", string(id), "plaintext_bytes", len(plaintext))
+
+	return record, plaintext, nil
+}
+
+func (s *Service) openUnwrapped(ctx context.Context, id []byte) (*storedRecord, *[32]byte, []byte, error) {
+
+	if s.keyring == nil {
+		return nil, nil, nil, UnwrapUnavailableError
+	}
+
+	record, err := s.getFromStorage(ctx, string(id))
+	if err != nil {
+		if err == NotFoundError {
+			return nil, nil, nil, err
+		} else {
+			return nil, nil, nil, errors.Wrap(err, "failed to retrieve text from storage")
+		}
+	}
+
+	wrappedKey, ok := record.metadata[wrappedKeyMetadata]
+	if !ok {
+		return nil, nil, nil, UnwrapUnavailableError
+	}
+
+	key, err := s.unwrapKey(id, record.version, wrappedKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	plaintext, err := s.decrypt(ctx, id, record, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return record, key, plaintext, nil
+}
+
+// consume counts a read of a record with a limited number of reads. It is
+// only called once the record has been decrypted, so a wrong key doesn't use
+// up a read. The plaintext must not be returned if it fails: another reader
+// may have taken the last read in the meantime, or replaced the record with
+// a version that wasn't read, which fails with ConflictError. usedUp
+// reports whether this was the last read and the record is gone
+func (s *Service) consume(ctx context.Context, id []byte, record *storedRecord) (usedUp bool, err error) {
+	if record.maxReads == 0 {
+		return false, nil
+	}
+
+	readsLeft, err := s.consumeFromStorage(ctx, string(id), record.version)
+	if err == NotFoundError || err == ConflictError {
+		return false, err
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to consume a read")
+	}
+
+	return readsLeft == 0, nil
+}
+
+// shred deletes a record from the storage-service. The wrapped data key of
+// envelope mode and the data keys sealed for shares are destroyed first, so
+// the payload can't be recovered server side even if deleting the
+// ciphertext fails half way. Copies of the wrapped key in backups stay
+// unwrappable until the KEK it was wrapped with is retired. Only the version
+// of the record that was opened is shredded, ConflictError is returned if it
+// has been replaced since
+func (s *Service) shred(ctx context.Context, id []byte, record *storedRecord) error {
+	destroyed := map[string]string{}
+	if _, ok := record.metadata[wrappedKeyMetadata]; ok {
+		destroyed[wrappedKeyMetadata] = ""
+	}
+	for _, name := range shareNames(record.metadata) {
+		destroyed[shareMetadata(name)] = ""
+	}
+	if len(destroyed) > 0 {
+		err := s.updateStorageMetadata(ctx, string(id), destroyed, record.version)
+		if err == ConflictError {
+			return err
+		}
+		if err != nil && err != NotFoundError {
+			return errors.Wrap(err, "failed to destroy wrapped data key")
+		}
+	}
+
+	// a record that is gone already has nothing left to shred
+	err := s.deleteFromStorage(ctx, string(id), record.version)
+	if err == ConflictError {
+		return err
+	}
+	if err != nil && err != NotFoundError {
+		return errors.Wrap(err, "failed to delete text from storage")
+	}
+
+	return nil
+}
+
+func (s *Service) getStream(ctx context.Context, id []byte) (*storedRecord, io.ReadCloser, error) {
+	record, payload, err := s.getStreamFromStorage(ctx, string(id))
+	if err == NotFoundError {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to retrieve text from storage")
+	}
+
+	return record, payload, nil
+}
+
+// streamDecrypter decrypts the ciphertext read from src into dst
+type streamDecrypter func(dst io.Writer, src io.Reader, additionalData []byte) error
+
+// decryptWithKey returns a streamDecrypter decrypting with key
+func (s *Service) decryptWithKey(key *[32]byte) streamDecrypter {
+	return func(dst io.Writer, src io.Reader, additionalData []byte) error {
+		return s.engine.DecryptStream(dst, src, additionalData, key)
+	}
+}
+
+// decryptStream decrypts the ciphertext read from payload into dst with
+// decrypt, see ProcessRetrieveStream. key is the data key to rewrap after
+// the read, nil if it isn't known. Errors returned by dst are passed on as
+// they are. The read of a record with a limited number of reads is only
+// counted once all of its ciphertext has been authenticated: the ciphertext
+// is spooled to a temporary file while it is verified, and decrypted from
+// there into dst
+func (s *Service) decryptStream(ctx context.Context, id []byte, record *storedRecord, payload io.Reader, decrypt streamDecrypter, key *[32]byte, dst io.Writer, start func(*Text)) error {
+	additionalData := associatedData(id, record.version)
+
+	usedUp := false
+	if record.maxReads > 0 {
+		spool, err := os.CreateTemp("", "retrieve-")
+		if err != nil {
+			return errors.Wrap(err, "failed to create spool file")
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+
+		if err := decrypt(io.Discard, io.TeeReader(payload, spool), additionalData); err != nil {
+			return decryptError(err)
+		}
+
+		if usedUp, err = s.consume(ctx, id, record); err != nil {
+			return err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to rewind spool file")
+		}
+		payload = spool
+	}
+
+	w := &streamingWriter{
+		w: dst,
+		start: func() error {
+			start(record.text(nil))
+			return nil
+		},
+	}
+
+	err := decrypt(w, payload, additionalData)
+	if err == nil {
+		err = w.begin()
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to decrypt")
+		if w.started && errors.Cause(err) != engine.ErrWrongKey {
+			return err
+		}
+		return decryptError(err)
+	}
+
+	if !usedUp && key != nil {
+		s.rewrapIfNeeded(ctx, id, record, key)
 	}
 
-	if s.config.Service.Debug {
-		log.Printf("decrypted message: \n%s\n", string(plaintext))
+	return nil
+}
+
+func (s *Service) decrypt(ctx context.Context, id []byte, record *storedRecord, key *[32]byte) ([]byte, error) {
+	plaintext, err := s.engine.Decrypt(record.payload, associatedData(id, record.version), key)
+	if err != nil {
+		return nil, decryptError(err)
 	}
 
+	logging.FromContext(ctx).Debug("decrypted payload", "id", string(id), "plaintext_bytes", len(plaintext))
+
 	return plaintext, nil
 }
+
+// keyHeaderError maps a failure to read the key derivation header of a
+// text. A passphrase can't open a text stored another way, just like a wrong
+// passphrase can't
+func keyHeaderError(err error) error {
+	if err == engine.ErrNoKDFParams {
+		return InvalidKeyError
+	}
+
+	return errors.Wrap(err, "malformed key header")
+}
+
+// readKDFParams reads the key derivation header of a text, refusing a cost
+// above the maximum before anything is derived from it. Texts are stored
+// with the configured cost, a higher one has been forged in storage or was
+// configured before and has to be allowed explicitly
+func (s *Service) readKDFParams(r io.Reader) (*engine.KDFParams, error) {
+	kdf, err := engine.ReadKDFParams(r)
+	if err != nil {
+		return nil, keyHeaderError(err)
+	}
+	if err := kdf.CheckMax(s.kdfMax); err != nil {
+		return nil, errors.Wrap(err, "refusing to derive key")
+	}
+
+	return kdf, nil
+}
+
+// decryptError maps a failure to decrypt a text. A wrong key, or an identity
+// trying to open a text that wasn't encrypted to recipients, is an invalid
+// key
+func decryptError(err error) error {
+	if errors.Cause(err) == engine.ErrWrongKey || err == engine.ErrNoRecipientHeader {
+		return InvalidKeyError
+	}
+
+	return errors.Wrap(err, "failed to decrypt")
+}
+
+func (s *Service) unwrapKey(id []byte, version int, wrappedKeyB64 string) (*[32]byte, error) {
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrappedKeyB64)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed wrapped data key, failed to decode from base64")
+	}
+
+	key, _, err := s.keyring.Unwrap(wrappedKey, wrappedKeyAssociatedData(id, version))
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// rewrapIfNeeded wraps the record's data key with the current KEK if it was
+// wrapped with a previous one, so a KEK rotation never needs the payloads to
+// be encrypted again. Failures are only logged, the previous wrapped key
+// stays usable
+func (s *Service) rewrapIfNeeded(ctx context.Context, id []byte, record *storedRecord, key *[32]byte) {
+	if s.keyring == nil {
+		return
+	}
+	wrappedKeyB64, ok := record.metadata[wrappedKeyMetadata]
+	if !ok {
+		return
+	}
+
+	logger := logging.FromContext(ctx)
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrappedKeyB64)
+	if err != nil {
+		logger.Warn("malformed wrapped data key, failed to decode from base64", "error", err)
+		return
+	}
+
+	if s.keyring.IsCurrent(wrappedKey) {
+		return
+	}
+
+	rewrapped, err := s.keyring.Wrap(key, wrappedKeyAssociatedData(id, record.version))
+	if err != nil {
+		logger.Error("failed to rewrap data key", "error", err)
+		return
+	}
+
+	// a replaced record has a new data key, the old one must not be stored
+	// with it
+	err = s.updateStorageMetadata(ctx, string(id), map[string]string{
+		wrappedKeyMetadata: base64.StdEncoding.EncodeToString(rewrapped),
+	}, record.version)
+	if err == ConflictError {
+		logger.Info("text was replaced, not storing rewrapped data key", "id", string(id))
+		return
+	}
+	if err != nil {
+		logger.Error("failed to store rewrapped data key", "error", err)
+	}
+}
+
+// reportKEKs counts the data keys still wrapped with a previous KEK every
+// ReportInterval seconds, until ctx is cancelled
+func (s *Service) reportKEKs(ctx context.Context) {
+	if s.keyring == nil || s.config.KEK.ReportInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(s.config.KEK.ReportInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.reportWrappedKeys(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportWrappedKeys logs how many data keys are wrapped with each previous
+// KEK. Data keys are only rewrapped when their record is read, the server
+// can't unwrap them without the id they are bound to; a previous KEK can be
+// removed from PREVIOUS_KEK_FILES once no data keys are left wrapped with it
+func (s *Service) reportWrappedKeys(ctx context.Context) {
+	counts := map[string]int{}
+	unknown := 0
+
+	after := ""
+	for {
+		values, next, err := s.scanStorageMetadata(ctx, wrappedKeyMetadata, after)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error("failed to count wrapped data keys", "error", err)
+			}
+			return
+		}
+
+		for _, value := range values {
+			wrappedKey, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				unknown++
+				continue
+			}
+			id, known, err := s.keyring.KEKID(wrappedKey)
+			if err != nil || !known {
+				unknown++
+				continue
+			}
+			if id != s.keyring.CurrentID() {
+				counts[id]++
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	for id, count := range counts {
+		s.logger.Info("data keys left wrapped with a previous KEK", "kek_id", id, "count", count)
+	}
+	if unknown > 0 {
+		s.logger.Warn("data keys wrapped with an unknown KEK can't be unwrapped anymore", "count", unknown)
+	}
+	if len(counts) == 0 && unknown == 0 {
+		s.logger.Info("all data keys are wrapped with the current KEK", "kek_id", s.keyring.CurrentID())
+	}
+}
+
+// argon2idCost converts a configured cost of deriving keys from passphrases
+func argon2idCost(time, memory, threads uint) (engine.Argon2idCost, error) {
+	cost := engine.Argon2idCost{
+		Time:    uint32(time),
+		Memory:  uint32(memory),
+		Threads: uint8(threads),
+	}
+	if uint(cost.Time) != time || uint(cost.Memory) != memory || uint(cost.Threads) != threads {
+		return cost, errors.New("argon2id cost out of range")
+	}
+
+	return cost, cost.Validate()
+}
+
+// associatedData binds a ciphertext to the record it is stored as. A
+// ciphertext copied to another id in the storage-service, or restored over a
+// later version of its record, will then fail to authenticate even with the
+// right key. Fields are length prefixed so more of them can be appended
+// without ambiguity. Records stored before versioning have version 0 and are
+// bound to their id only
+func associatedData(id []byte, version int) []byte {
+	ad := make([]byte, 0, 4+len(id)+8)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(id)))
+	ad = append(ad, id...)
+	if version > 0 {
+		ad = binary.BigEndian.AppendUint64(ad, uint64(version))
+	}
+	return ad
+}
+
+// wrappedKeyAssociatedData binds a wrapped data key to its record, and keeps
+// it apart from the payload's additional data
+func wrappedKeyAssociatedData(id []byte, version int) []byte {
+	return append([]byte("wrapped-key"), associatedData(id, version)...)
+}
@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/encryption-service/api"
+	"github.com/akh-dev/encrypt/encryption-service/engine"
+	"github.com/akh-dev/encrypt/logging"
+)
+
+// shareMetadataPrefix prefixes the storage metadata entries holding the data
+// key of a record sealed to the recipient of a share, followed by the name
+// of the share
+const shareMetadataPrefix = "share."
+
+var shareNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+func (s *Service) handleShareRequest(w http.ResponseWriter, r *http.Request) {
+	shareReq, creds, ok := s.checkShareRequest(w, r)
+	if !ok {
+		return
+	}
+
+	recipients, err := decodeRecipients([]string{shareReq.Recipient})
+	if err != nil {
+		respondBadRequest(w, "bad request", []string{err.Error()})
+		return
+	}
+
+	shares, err := s.ProcessShare(r.Context(), []byte(shareReq.Id), creds, shareReq.Name, recipients[0])
+	if err != nil {
+		respondShareError(w, r, shareReq.Id, err)
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result: api.Shares{
+			Id:     shareReq.Id,
+			Shares: shares,
+		},
+		Errors: []string{},
+	}
+
+	writeResponse(w, respObj)
+}
+
+func (s *Service) handleRevokeRequest(w http.ResponseWriter, r *http.Request) {
+	revokeReq, creds, ok := s.checkShareRequest(w, r)
+	if !ok {
+		return
+	}
+
+	shares, err := s.ProcessRevoke(r.Context(), []byte(revokeReq.Id), creds, revokeReq.Name)
+	if err != nil {
+		respondShareError(w, r, revokeReq.Id, err)
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result: api.Shares{
+			Id:     revokeReq.Id,
+			Shares: shares,
+		},
+		Errors: []string{},
+	}
+
+	writeResponse(w, respObj)
+}
+
+// checkShareRequest parses a share or revoke request and checks its share
+// name and credentials. It responds and returns false if the request can't go
+// on
+func (s *Service) checkShareRequest(w http.ResponseWriter, r *http.Request) (*api.ShareRequest, *Credentials, bool) {
+	logger := logging.FromContext(r.Context())
+	writeCommonHeaders(w)
+
+	if r.Method != http.MethodPost {
+		respondBadRequest(w, "unknown request", []string{})
+		return nil, nil, false
+	}
+
+	shareReq, err := parseShareRequest(r)
+	if err != nil {
+		logger.Warn("failed to parse request data", "error", err)
+		respondBadRequest(w, "bad request", []string{})
+		return nil, nil, false
+	}
+	logger.Debug("share request", "path", r.URL.Path, "id", shareReq.Id, "name", shareReq.Name, "with_key", shareReq.Key != "", "with_passphrase", shareReq.Passphrase != "", "with_identity", shareReq.Identity != "")
+
+	if !shareNamePattern.MatchString(shareReq.Name) {
+		respondBadRequest(w, "bad request", []string{"share names are 1 to 64 letters, digits, '.', '_', '@' or '-'"})
+		return nil, nil, false
+	}
+	if shareReq.Share != "" {
+		respondBadRequest(w, "bad request", []string{"a share can't be used to manage shares"})
+		return nil, nil, false
+	}
+
+	creds, ok := s.checkCredentials(w, r, &shareReq.IdKeyPair)
+	return shareReq, creds, ok
+}
+
+// respondShareError responds to a share or revoke request that failed
+func respondShareError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if err == ConflictError {
+		respondConflict(w, []string{fmt.Sprintf("text with id %s was replaced, open it again", id)})
+	} else if errors.Cause(err) == engine.ErrInvalidRecipient {
+		respondBadRequest(w, "bad request", []string{"invalid recipient public key"})
+	} else {
+		respondRetrieveError(w, r, id, err)
+	}
+}
+
+// ProcessShare shares a record with the recipient under name, replacing a
+// share of the same name. The data key is opened with creds and sealed to
+// the recipient, the payload isn't encrypted again. It returns the names of
+// all shares of the record, or ConflictError if the record was replaced in
+// the meantime
+func (s *Service) ProcessShare(ctx context.Context, id []byte, creds *Credentials, name string, recipient *[32]byte) ([]string, error) {
+	record, key, err := s.openWithCredentials(ctx, id, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	stanza, err := engine.SealKey(key, recipient, shareAssociatedData(id, record.version, name))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to seal data key to recipient")
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(stanza)
+	err = s.updateStorageMetadata(ctx, string(id), map[string]string{
+		shareMetadata(name): encoded,
+	}, record.version)
+	if err != nil {
+		return nil, err
+	}
+	record.metadata[shareMetadata(name)] = encoded
+
+	return shareNames(record.metadata), nil
+}
+
+// ProcessRevoke removes the share called name from a record, once creds have
+// proven to decrypt it. Revoking a share that doesn't exist succeeds. It
+// returns the names of the remaining shares of the record
+func (s *Service) ProcessRevoke(ctx context.Context, id []byte, creds *Credentials, name string) ([]string, error) {
+	record, _, err := s.openWithCredentials(ctx, id, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := record.metadata[shareMetadata(name)]; ok {
+		err = s.updateStorageMetadata(ctx, string(id), map[string]string{
+			shareMetadata(name): "",
+		}, record.version)
+		if err != nil {
+			return nil, err
+		}
+		delete(record.metadata, shareMetadata(name))
+	}
+
+	return shareNames(record.metadata), nil
+}
+
+// ProcessRetrieveShare decrypts a record with the identity of the recipient
+// of the share called name
+func (s *Service) ProcessRetrieveShare(ctx context.Context, id []byte, name string, identity *[32]byte) (*Text, error) {
+	record, key, plaintext, err := s.openShare(ctx, id, name, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	usedUp, err := s.consume(ctx, id, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if !usedUp {
+		s.rewrapIfNeeded(ctx, id, record, key)
+	}
+
+	return record.text(plaintext), nil
+}
+
+// ProcessRetrieveStreamShare is ProcessRetrieveStream with the key of the
+// share called name, opened with the identity of its recipient
+func (s *Service) ProcessRetrieveStreamShare(ctx context.Context, id []byte, name string, identity *[32]byte, dst io.Writer, start func(*Text)) error {
+	record, payload, err := s.getStream(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer closeStorageResponse(ctx, payload)
+
+	key, err := shareKey(id, record, name, identity)
+	if err != nil {
+		return err
+	}
+
+	return s.decryptStream(ctx, id, record, payload, s.decryptWithKey(key), key, dst, start)
+}
+
+// openWithCredentials decrypts a record with whichever of creds is set, to
+// get at its data key
+func (s *Service) openWithCredentials(ctx context.Context, id []byte, creds *Credentials) (*storedRecord, *[32]byte, error) {
+	var record *storedRecord
+	var key *[32]byte
+	var err error
+	switch {
+	case creds.Share != "":
+		record, key, _, err = s.openShare(ctx, id, creds.Share, creds.Identity)
+	case creds.Passphrase != nil:
+		record, key, _, err = s.openWithPassphrase(ctx, id, creds.Passphrase)
+	case creds.Identity != nil:
+		record, _, err = s.openWithIdentity(ctx, id, creds.Identity)
+		if err == nil {
+			key, err = s.recipients.OpenKeyWith(record.payload, creds.Identity)
+		}
+	case creds.Key == nil:
+		record, key, _, err = s.openUnwrapped(ctx, id)
+	default:
+		record, key, _, err = s.openWithKey(ctx, id, creds.Key)
+	}
+
+	return record, key, err
+}
+
+func (s *Service) openShare(ctx context.Context, id []byte, name string, identity *[32]byte) (*storedRecord, *[32]byte, []byte, error) {
+
+	record, err := s.getFromStorage(ctx, string(id))
+	if err != nil {
+		if err == NotFoundError {
+			return nil, nil, nil, err
+		} else {
+			return nil, nil, nil, errors.Wrap(err, "failed to retrieve text from storage")
+		}
+	}
+
+	key, err := shareKey(id, record, name, identity)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	plaintext, err := s.decrypt(ctx, id, record, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return record, key, plaintext, nil
+}
+
+// shareKey opens the data key of the share called name. A share that
+// doesn't exist fails like a wrong identity
+func shareKey(id []byte, record *storedRecord, name string, identity *[32]byte) (*[32]byte, error) {
+	encoded, ok := record.metadata[shareMetadata(name)]
+	if !ok {
+		return nil, InvalidKeyError
+	}
+
+	stanza, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed share, failed to decode from base64")
+	}
+
+	key, err := engine.OpenKey(stanza, identity, shareAssociatedData(id, record.version, name))
+	if err == engine.ErrWrongKey {
+		return nil, InvalidKeyError
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed share")
+	}
+
+	return key, nil
+}
+
+func shareMetadata(name string) string {
+	return shareMetadataPrefix + name
+}
+
+// shareNames returns the sorted names of the shares in a record's metadata
+func shareNames(metadata map[string]string) []string {
+	names := []string{}
+	for k := range metadata {
+		if strings.HasPrefix(k, shareMetadataPrefix) {
+			names = append(names, strings.TrimPrefix(k, shareMetadataPrefix))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// shareAssociatedData binds the data key sealed for a share to its record
+// and its name, so it can't be copied to another record or share
+func shareAssociatedData(id []byte, version int, name string) []byte {
+	ad := append([]byte("share"), associatedData(id, version)...)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(name)))
+	return append(ad, name...)
+}
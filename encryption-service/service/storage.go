@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	storageApi "github.com/akh-dev/encrypt/storage-service/api"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/logging"
+)
+
+// storedRecord is a ciphertext as kept by the storage-service. A zero ttl
+// keeps it until it is deleted, a zero maxReads allows any number of reads.
+// version is 0 for records stored before versioning
+type storedRecord struct {
+	version  int
+	payload  []byte
+	metadata map[string]string
+	ttl      time.Duration
+	maxReads int
+}
+
+// text returns the decrypted payload of the record with its details
+func (r *storedRecord) text(plaintext []byte) *Text {
+	return &Text{
+		Payload:     plaintext,
+		Version:     r.version,
+		ContentType: r.metadata[contentTypeMetadata],
+	}
+}
+
+// sendToStorage creates the record, or replaces the one at version ifMatch.
+// It returns ConflictError if that would overwrite another record, and
+// TooLargeError if the storage-service doesn't take a payload that large
+func (s *Service) sendToStorage(ctx context.Context, id string, record *storedRecord, ifMatch int) error {
+	timeout := time.Duration(s.config.Service.CtxTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return s.sendStreamToStorage(ctx, id, record, bytes.NewReader(record.payload), ifMatch)
+}
+
+// sendStreamToStorage is sendToStorage with the ciphertext read from
+// payload rather than record. The ciphertext is sent as it is read, so the
+// request isn't bounded by CtxTimeout but only by ctx
+func (s *Service) sendStreamToStorage(ctx context.Context, id string, record *storedRecord, payload io.Reader, ifMatch int) error {
+	header := http.Header{}
+	header.Set("Content-Type", storageApi.ContentTypeOctetStream)
+	header.Set(storageApi.IdHeader, id)
+	if record.ttl > 0 {
+		header.Set(storageApi.TTLSecondsHeader, strconv.FormatInt(int64(record.ttl/time.Second), 10))
+	}
+	if record.maxReads > 0 {
+		header.Set(storageApi.MaxReadsHeader, strconv.Itoa(record.maxReads))
+	}
+	if ifMatch > 0 {
+		header.Set(storageApi.IfMatchHeader, strconv.Itoa(ifMatch))
+	}
+	if len(record.metadata) > 0 {
+		metadata, err := json.Marshal(record.metadata)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal metadata")
+		}
+		header.Set(storageApi.MetadataHeader, string(metadata))
+	}
+
+	r, err := s.sendStorageRequest(ctx, http.MethodPost, s.config.Storage.StoreUri, header, payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to perform store request")
+	}
+	parsed, err := readStorageResponse(ctx, r)
+	if err == NotFoundError || err == ConflictError || err == TooLargeError {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to perform store request")
+	}
+
+	stored := &storageApi.IdVersion{}
+	if err := json.Unmarshal(parsed.Result, stored); err != nil {
+		return errors.Wrap(err, "unexpected return from the storage")
+	}
+	// the ciphertext is bound to the version it was encrypted for
+	if stored.Version != record.version {
+		return errors.Errorf("storage stored version %d, expected %d", stored.Version, record.version)
+	}
+
+	return nil
+}
+
+func (s *Service) getFromStorage(ctx context.Context, id string) (*storedRecord, error) {
+	timeout := time.Duration(s.config.Service.CtxTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	record, payload, err := s.getStreamFromStorage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer closeStorageResponse(ctx, payload)
+
+	record.payload, err = ioutil.ReadAll(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read text from storage")
+	}
+	logging.FromContext(ctx).Debug("retrieved from storage", "id", id, "ciphertext_bytes", len(record.payload))
+
+	return record, nil
+}
+
+// getStreamFromStorage returns the record without its ciphertext, which is
+// read from the returned body as it arrives. The body has to be closed.
+// Like sendStreamToStorage, it is only bounded by ctx
+func (s *Service) getStreamFromStorage(ctx context.Context, id string) (*storedRecord, io.ReadCloser, error) {
+	logger := logging.FromContext(ctx)
+	logger.Debug("retrieving from storage", "id", id)
+
+	header := http.Header{}
+	header.Set("Accept", storageApi.ContentTypeOctetStream)
+	header.Set(storageApi.IdHeader, id)
+
+	r, err := s.sendStorageRequest(ctx, http.MethodGet, s.config.Storage.RetrieveUri, header, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to perform retrieve request")
+	}
+
+	// errors are still JSON responses
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.StatusCode != http.StatusOK || mediaType != storageApi.ContentTypeOctetStream {
+		_, err := readStorageResponse(ctx, r)
+		if err == NotFoundError {
+			logger.Info("no text found", "id", id)
+			return nil, nil, err
+		}
+		if err == nil {
+			err = errors.New("expected a raw payload")
+		}
+		return nil, nil, errors.Wrap(err, "failed to perform retrieve request")
+	}
+
+	record := &storedRecord{}
+	if record.version, err = optionalInt(storageApi.VersionHeader, r.Header.Get(storageApi.VersionHeader)); err != nil {
+		closeStorageResponse(ctx, r.Body)
+		return nil, nil, errors.Wrap(err, "unexpected return from the storage")
+	}
+	if record.maxReads, err = optionalInt(storageApi.MaxReadsHeader, r.Header.Get(storageApi.MaxReadsHeader)); err != nil {
+		closeStorageResponse(ctx, r.Body)
+		return nil, nil, errors.Wrap(err, "unexpected return from the storage")
+	}
+	if metadata := r.Header.Get(storageApi.MetadataHeader); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &record.metadata); err != nil {
+			closeStorageResponse(ctx, r.Body)
+			return nil, nil, errors.Wrap(err, "unexpected return from the storage")
+		}
+	}
+
+	return record, r.Body, nil
+}
+
+// updateStorageMetadata sets metadata entries of a stored record, entries
+// with an empty value are removed. A non zero ifMatch only updates the record
+// if it is still at that version, otherwise ConflictError is returned
+func (s *Service) updateStorageMetadata(ctx context.Context, id string, metadata map[string]string, ifMatch int) error {
+	jsonreq := &storageApi.MetadataUpdate{
+		Id:       id,
+		Metadata: metadata,
+		IfMatch:  ifMatch,
+	}
+
+	_, err := s.storageRequest(ctx, http.MethodPost, s.config.Storage.MetadataUri, jsonreq)
+	if err == NotFoundError || err == ConflictError {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to perform metadata request")
+	}
+
+	return nil
+}
+
+// deleteFromStorage removes a stored record. A non zero ifMatch only removes
+// the record if it is still at that version, otherwise ConflictError is
+// returned, and NotFoundError if it is gone
+func (s *Service) deleteFromStorage(ctx context.Context, id string, ifMatch int) error {
+	jsonreq := &storageApi.DeleteRequest{
+		Id:      id,
+		IfMatch: ifMatch,
+	}
+
+	_, err := s.storageRequest(ctx, http.MethodDelete, s.config.Storage.DeleteUri, jsonreq)
+	if err == NotFoundError || err == ConflictError {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to perform delete request")
+	}
+
+	return nil
+}
+
+// consumeFromStorage counts a successful read of the version ifMatch of a
+// record with a limited number of reads and returns how many are left. It
+// returns NotFoundError if the last read has been taken already, and
+// ConflictError if the record has been replaced since it was read
+func (s *Service) consumeFromStorage(ctx context.Context, id string, ifMatch int) (int, error) {
+	jsonreq := &storageApi.ConsumeRequest{
+		Id:      id,
+		IfMatch: ifMatch,
+	}
+
+	parsed, err := s.storageRequest(ctx, http.MethodPost, s.config.Storage.ConsumeUri, jsonreq)
+	if err == NotFoundError || err == ConflictError {
+		return 0, err
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to perform consume request")
+	}
+
+	readsLeft := &storageApi.ReadsLeft{}
+	if err := json.Unmarshal(parsed.Result, readsLeft); err != nil {
+		return 0, errors.Wrap(err, "unexpected return from the storage")
+	}
+
+	return readsLeft.ReadsLeft, nil
+}
+
+// scanStorageMetadata returns the values of the metadata entry name of a page
+// of stored records after the page ending with after, and where the next page
+// starts. next is empty on the last page
+func (s *Service) scanStorageMetadata(ctx context.Context, name, after string) (values []string, next string, err error) {
+	jsonreq := &storageApi.ScanRequest{
+		Metadata: name,
+		After:    after,
+	}
+
+	parsed, err := s.storageRequest(ctx, http.MethodPost, s.config.Storage.ScanUri, jsonreq)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to perform scan request")
+	}
+
+	scanned := &storageApi.ScanResult{}
+	if err := json.Unmarshal(parsed.Result, scanned); err != nil {
+		return nil, "", errors.Wrap(err, "unexpected return from the storage")
+	}
+
+	return scanned.Values, scanned.Next, nil
+}
+
+// storageRequest sends a JSON request to the storage-service and returns its
+// parsed response. A not found response is returned as NotFoundError, a
+// conflict as ConflictError, a payload too large as TooLargeError and any
+// other unsuccessful response as an error
+func (s *Service) storageRequest(ctx context.Context, method, uri string, jsonreq interface{}) (*storageApi.Response, error) {
+	buf, err := json.Marshal(jsonreq)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal storage request")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	timeout := time.Duration(s.config.Service.CtxTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	r, err := s.sendStorageRequest(ctx, method, uri, header, bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	return readStorageResponse(ctx, r)
+}
+
+// sendStorageRequest sends a request to the storage-service and returns the
+// response, whose body has to be closed. The request id of ctx is passed on,
+// so log lines of both services can be matched up
+func (s *Service) sendStorageRequest(ctx context.Context, method, uri string, header http.Header, body io.Reader) (*http.Response, error) {
+	scheme := "http"
+	if s.config.Storage.TLS {
+		scheme = "https"
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		method,
+		fmt.Sprintf("%s://%s:%s%s", scheme, s.config.Storage.Host, s.config.Storage.Port, uri),
+		body,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create storage request")
+	}
+	req.Header = header
+	if requestId := logging.RequestId(ctx); requestId != "" {
+		req.Header.Set(logging.RequestIdHeader, requestId)
+	}
+
+	r, err := s.client.Load().Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send storage request")
+	}
+
+	return r, nil
+}
+
+// readStorageResponse reads and closes a JSON response of the storage-service
+func readStorageResponse(ctx context.Context, r *http.Response) (*storageApi.Response, error) {
+	defer closeStorageResponse(ctx, r.Body)
+
+	response, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	parsed := &storageApi.Response{}
+	err = json.Unmarshal(response, parsed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse response body")
+	}
+
+	if parsed.StatusCode == http.StatusNotFound {
+		return nil, NotFoundError
+	}
+
+	if parsed.StatusCode == http.StatusConflict {
+		return nil, ConflictError
+	}
+
+	if parsed.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, TooLargeError
+	}
+
+	if parsed.StatusCode != 0 {
+		return nil, errors.Errorf("unexpected return from the storage service: %d - %s, %s", parsed.StatusCode, parsed.StatusMessage, strings.Join(parsed.Errors, ":"))
+	}
+
+	return parsed, nil
+}
+
+func closeStorageResponse(ctx context.Context, body io.Closer) {
+	if err := body.Close(); err != nil {
+		logging.FromContext(ctx).Warn("failed to close storage response body", "error", err)
+	}
+}
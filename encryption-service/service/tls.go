@@ -0,0 +1,126 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// keyPair is a certificate and private key loaded from disk, which can be
+// swapped for a new version without restarting the service
+type keyPair struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newKeyPair(certFile, keyFile string) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *keyPair) reload() error {
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load key pair %s, %s", k.certFile, k.keyFile)
+	}
+	k.cert.Store(&cert)
+	return nil
+}
+
+func (k *keyPair) get() *tls.Certificate {
+	return k.cert.Load()
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA file %s", caFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the listener's TLS config, or nil if TLS is not
+// configured
+func (s *Service) serverTLSConfig() *tls.Config {
+	if s.serverCert == nil {
+		return nil
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.serverCert.get(), nil
+		},
+	}
+}
+
+// newStorageClient creates the http.Client used to talk to the
+// storage-service. With STORAGE_TLS enabled the storage-service certificate
+// is verified against the configured CA, and the client certificate, if
+// any, is presented for mutual TLS
+func (s *Service) newStorageClient() (*http.Client, error) {
+	cfg := s.config.Storage
+	if !cfg.TLS {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load storage client key pair %s, %s", cfg.CertFile, cfg.KeyFile)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// ReloadCertificates reads all certificates, keys and CAs from disk again.
+// Connections made from then on use the new ones, established connections
+// are not affected. On error the previous certificates stay in use
+func (s *Service) ReloadCertificates() error {
+	if s.serverCert != nil {
+		if err := s.serverCert.reload(); err != nil {
+			return err
+		}
+	}
+
+	client, err := s.newStorageClient()
+	if err != nil {
+		return err
+	}
+
+	if old := s.client.Swap(client); old != nil && old != client {
+		old.CloseIdleConnections()
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+// Package shamir splits secrets, such as data keys, into shares with Shamir's
+// secret sharing over GF(2^8). Any threshold of the shares recover the
+// secret, fewer reveal nothing about it.
+//
+// A share is its x coordinate, never 0, followed by the values of the
+// polynomials at x, one byte of the share for each byte of the secret. The
+// field is that of AES, reduced by x^8 + x^4 + x^3 + x + 1.
+package shamir
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MaxShares is the number of shares a secret can be split into, one for
+// every non zero x coordinate
+const MaxShares = 255
+
+var (
+	ErrTooFewShares    = errors.New("at least two shares are required")
+	ErrMalformedShares = errors.New("shares are malformed or don't belong together")
+)
+
+// Split splits secret into n shares, any threshold of which recover it
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	return split(secret, n, threshold, rand.Reader)
+}
+
+// split is Split with the coefficients of the polynomials read from random
+func split(secret []byte, n, threshold int, random io.Reader) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > MaxShares {
+		return nil, errors.Errorf("threshold must be between 2 and the number of shares, at most %d", MaxShares)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret must not be empty")
+	}
+
+	// the coefficients of x^1 to x^(threshold-1) of the polynomial of every
+	// byte of the secret, its constant term is the byte itself
+	coefficients := make([]byte, len(secret)*(threshold-1))
+	if _, err := io.ReadFull(random, coefficients); err != nil {
+		return nil, errors.Wrap(err, "failed to read random coefficients")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, 1+len(secret))
+		share[0] = x
+		for j, b := range secret {
+			share[1+j] = evaluate(b, coefficients[j*(threshold-1):(j+1)*(threshold-1)], x)
+		}
+		shares[i] = share
+	}
+
+	return shares, nil
+}
+
+// Combine recovers the secret from shares created by Split. Fewer shares than
+// the threshold, or shares of different secrets, recover a wrong secret
+// without an error
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+
+	size := len(shares[0])
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) != size || size < 2 || share[0] == 0 || seen[share[0]] {
+			return nil, ErrMalformedShares
+		}
+		seen[share[0]] = true
+	}
+
+	// Lagrange interpolation at x = 0, subtraction is addition in GF(2^8)
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = mul(basis, div(other[0], other[0]^share[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= mul(share[1+k], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// evaluate returns the value at x of the polynomial with constant term c0
+// and the higher coefficients, using Horner's method
+func evaluate(c0 byte, coefficients []byte, x byte) byte {
+	y := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+
+	return mul(y, x) ^ c0
+}
+
+// mul multiplies in GF(2^8) without branching on or indexing by its
+// arguments, so shares don't leak through timing
+func mul(a, b byte) byte {
+	p := byte(0)
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+
+	return p
+}
+
+// div divides in GF(2^8), b must not be 0. The inverse of b is b^254
+func div(a, b byte) byte {
+	inverse := byte(1)
+	for i := 0; i < 7; i++ {
+		b = mul(b, b)
+		inverse = mul(inverse, b)
+	}
+
+	return mul(a, inverse)
+}
@@ -0,0 +1,125 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMul(t *testing.T) {
+	// the multiplication examples of FIPS-197, section 4.2
+	testCases := []struct {
+		a, b, product byte
+	}{
+		{a: 0x57, b: 0x83, product: 0xc1},
+		{a: 0x57, b: 0x13, product: 0xfe},
+		{a: 0x57, b: 0x01, product: 0x57},
+		{a: 0x57, b: 0x00, product: 0x00},
+	}
+
+	for i, data := range testCases {
+		if product := mul(data.a, data.b); product != data.product {
+			t.Errorf("test case %d failed : expected %#x, got %#x", i, data.product, product)
+		}
+		if data.b != 0 && div(data.product, data.b) != data.a {
+			t.Errorf("test case %d failed : division doesn't invert multiplication", i)
+		}
+	}
+
+	for b := 1; b < 256; b++ {
+		if mul(byte(b), div(1, byte(b))) != 1 {
+			t.Fatalf("%#x times its inverse isn't 1", b)
+		}
+	}
+}
+
+func TestSplitKnownAnswer(t *testing.T) {
+	secret := []byte{0x42, 0x13, 0x37}
+	coefficients := bytes.NewReader([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+	expected := []string{"01411434", "02480525", "034b0226", "04665f43", "05655840"}
+
+	shares, err := split(secret, 5, 3, coefficients)
+	if err != nil {
+		t.Fatalf("failed to split : %s", err.Error())
+	}
+	for i, share := range shares {
+		if hex.EncodeToString(share) != expected[i] {
+			t.Errorf("share %d doesn't match. expected %s, got %x", i, expected[i], share)
+		}
+	}
+
+	for _, picked := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		subset := [][]byte{}
+		for _, i := range picked {
+			share, _ := hex.DecodeString(expected[i])
+			subset = append(subset, share)
+		}
+		combined, err := Combine(subset)
+		if err != nil {
+			t.Fatalf("failed to combine shares %v : %s", picked, err.Error())
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Errorf("shares %v recovered %x, expected %x", picked, combined, secret)
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	for _, params := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {MaxShares, 10}} {
+		shares, err := Split(secret, params.n, params.threshold)
+		if err != nil {
+			t.Fatalf("failed to split into %d of %d : %s", params.threshold, params.n, err.Error())
+		}
+		if len(shares) != params.n {
+			t.Fatalf("expected %d shares, got %d", params.n, len(shares))
+		}
+
+		combined, err := Combine(shares[len(shares)-params.threshold:])
+		if err != nil {
+			t.Fatalf("failed to combine %d of %d : %s", params.threshold, params.n, err.Error())
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Errorf("%d of %d shares didn't recover the secret", params.threshold, params.n)
+		}
+
+		if params.threshold > 2 {
+			combined, _ := Combine(shares[:params.threshold-1])
+			if bytes.Equal(combined, secret) {
+				t.Errorf("%d of %d shares recovered the secret below the threshold", params.threshold-1, params.n)
+			}
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	secret := []byte("secret")
+	for _, params := range []struct{ n, threshold int }{{3, 1}, {2, 3}, {MaxShares + 1, 2}} {
+		if _, err := Split(secret, params.n, params.threshold); err == nil {
+			t.Errorf("expected an error for %d of %d but got success", params.threshold, params.n)
+		}
+	}
+	if _, err := Split(nil, 3, 2); err == nil {
+		t.Error("expected an error for an empty secret but got success")
+	}
+
+	shares, _ := Split(secret, 3, 2)
+	testCases := []struct {
+		shares [][]byte
+		err    error
+	}{
+		{shares: shares[:1], err: ErrTooFewShares},
+		{shares: [][]byte{shares[0], shares[0]}, err: ErrMalformedShares},
+		{shares: [][]byte{shares[0], shares[1][:3]}, err: ErrMalformedShares},
+		{shares: [][]byte{shares[0], append([]byte{0}, shares[1][1:]...)}, err: ErrMalformedShares},
+	}
+
+	for i, data := range testCases {
+		if _, err := Combine(data.shares); err != data.err {
+			t.Errorf("test case %d failed : expected %v, got %v", i, data.err, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// sensitiveKeys are attribute keys whose values are never written to the
+// log. Their values are replaced with a length and a short keyed hash, enough
+// to correlate log lines of this process but useless to an attacker
+var sensitiveKeys = map[string]bool{
+	"key":         true,
+	"aes_key":     true,
+	"payload":     true,
+	"plaintext":   true,
+	"ciphertext":  true,
+	"wrapped_key": true,
+	"token":       true,
+	"passphrase":  true,
+	"identity":    true,
+}
+
+// New creates a JSON logger that redacts sensitive attributes. Debug enables
+// debug level output
+func New(w io.Writer, debug bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	return slog.New(NewRedactingHandler(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// RedactingHandler replaces the values of sensitive attributes before they
+// reach the wrapped handler
+type RedactingHandler struct {
+	next slog.Handler
+}
+
+func NewRedactingHandler(next slog.Handler) *RedactingHandler {
+	return &RedactingHandler{next: next}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redact(a))
+		return true
+	})
+
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, redact(a))
+	}
+
+	return &RedactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name)}
+}
+
+func redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, 0, len(attrs))
+		for _, ga := range attrs {
+			redacted = append(redacted, redact(ga))
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+
+	if !sensitiveKeys[strings.ToLower(a.Key)] {
+		return a
+	}
+
+	var data []byte
+	switch v := a.Value.Any().(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		data = []byte(a.Value.String())
+	}
+
+	return slog.String(a.Key, Summary(data))
+}
+
+// summaryKey keys the hashes of Summary. It is random per process, so a
+// logged hash can't be checked against guessed values of the data
+var summaryKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate log summary key: %s", err))
+	}
+	return key
+}()
+
+// Summary describes data by its length and a short HMAC of it
+func Summary(data []byte) string {
+	mac := hmac.New(sha256.New, summaryKey)
+	mac.Write(data)
+	return fmt.Sprintf("[redacted len=%d hmac=%s]", len(data), hex.EncodeToString(mac.Sum(nil)[:4]))
+}
+
+type contextKey struct{}
+
+// FromContext returns the request scoped logger stored by Middleware, or the
+// default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// RequestId returns the id Middleware assigned to the request, if any
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+type requestIdKey struct{}
+
+// Middleware assigns every request an id, taken from the X-Request-Id header
+// or generated, makes a logger carrying it available through FromContext
+// and logs the outcome of the request
+func Middleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIdHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		requestLogger := logger.With("request_id", id)
+		ctx := context.WithValue(r.Context(), contextKey{}, requestLogger)
+		ctx = context.WithValue(ctx, requestIdKey{}, id)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		requestLogger.Info("request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
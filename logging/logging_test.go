@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(buf, true)
+
+	secretKey := []byte("JAvDBuhM8yB4iKymW3mHOO8JpQ7nDN/dg+mgebuSIRs=")
+	logger.With("plaintext", "with attrs secret").
+		WithGroup("request").
+		Debug("test", "id", "my-1st-text", "key", secretKey, "payload", "some very long text")
+
+	out := buf.String()
+	for _, secret := range []string{string(secretKey), "some very long text", "with attrs secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("secret %q was logged : %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "my-1st-text") {
+		t.Errorf("non sensitive attribute was not logged : %s", out)
+	}
+	if !strings.Contains(out, Summary(secretKey)) {
+		t.Errorf("expected summary of the key to be logged : %s", out)
+	}
+	unkeyed := sha256.Sum256(secretKey)
+	if strings.Contains(out, hex.EncodeToString(unkeyed[:4])) {
+		t.Errorf("unkeyed hash of the key was logged : %s", out)
+	}
+}
+
+func TestDebugLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	New(buf, false).Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("debug message logged without debug enabled : %s", buf.String())
+	}
+}
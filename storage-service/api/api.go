@@ -4,6 +4,21 @@ import (
 	"encoding/json"
 )
 
+// Headers carrying the fields of requests and responses with a raw
+// application/octet-stream payload, instead of a JSON body. Metadata is
+// sent as a JSON object
+const (
+	IdHeader         = "X-Id"
+	VersionHeader    = "X-Version"
+	TTLSecondsHeader = "X-Ttl-Seconds"
+	MaxReadsHeader   = "X-Max-Reads"
+	IfMatchHeader    = "X-If-Match"
+	MetadataHeader   = "X-Metadata"
+)
+
+// ContentTypeOctetStream marks a raw payload
+const ContentTypeOctetStream = "application/octet-stream"
+
 type Response struct {
 	StatusCode    int             `json:"status_code"`
 	StatusMessage string          `json:"status_message"`
@@ -11,11 +26,70 @@ type Response struct {
 	Errors        []string        `json:"errors,omitempty"`
 }
 
+// IdMessage is a stored text. On store, IfMatch replaces the text with that
+// version instead of creating a new one. Version is set on retrieve
 type IdMessage struct {
-	Id      string `json:"id"`
-	Payload string `json:"payload"`
+	Id         string            `json:"id"`
+	Payload    string            `json:"payload"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	TTLSeconds int64             `json:"ttl_seconds,omitempty"`
+	MaxReads   int               `json:"max_reads,omitempty"`
+	IfMatch    int               `json:"if_match,omitempty"`
+	Version    int               `json:"version,omitempty"`
 }
 
 type Id struct {
 	Id string `json:"id"`
 }
+
+// IdVersion is the result of a store, with the version of the stored text
+type IdVersion struct {
+	Id      string `json:"id"`
+	Version int    `json:"version"`
+}
+
+// MetadataUpdate sets the given metadata entries of a stored record. An entry
+// with an empty value is removed. A non zero IfMatch only updates the record
+// if it is still at that version
+type MetadataUpdate struct {
+	Id       string            `json:"id"`
+	Metadata map[string]string `json:"metadata"`
+	IfMatch  int               `json:"if_match,omitempty"`
+}
+
+// DeleteRequest removes a stored record. A non zero IfMatch only removes the
+// record if it is still at that version
+type DeleteRequest struct {
+	Id      string `json:"id"`
+	IfMatch int    `json:"if_match,omitempty"`
+}
+
+// ScanRequest asks for the values of the metadata entry Metadata of the
+// stored records, a page of at most Limit records at a time. After is the
+// Next of the previous page
+type ScanRequest struct {
+	Metadata string `json:"metadata"`
+	After    string `json:"after,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+// ScanResult holds the values found on a page of records, records without
+// the entry are skipped. Next is empty on the last page
+type ScanResult struct {
+	Values []string `json:"values"`
+	Next   string   `json:"next,omitempty"`
+}
+
+// ConsumeRequest counts a read of a stored record. A non zero IfMatch only
+// counts it if the record is still at that version, the one that was read
+type ConsumeRequest struct {
+	Id      string `json:"id"`
+	IfMatch int    `json:"if_match,omitempty"`
+}
+
+// ReadsLeft is the result of consuming a read of a record. ReadsLeft is -1
+// for records that can be read any number of times
+type ReadsLeft struct {
+	Id        string `json:"id"`
+	ReadsLeft int    `json:"reads_left"`
+}
@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/storage-service/config"
+)
+
+// New creates the backend selected in the config
+func New(cfg *config.BackendConf) (Interface, error) {
+	switch cfg.Type {
+	case "memory":
+		if cfg.WALDir != "" {
+			return NewWALBackend(cfg.WALDir, WALOptions{
+				Sync:             SyncPolicy(cfg.WALSync),
+				SyncInterval:     time.Duration(cfg.WALSyncInterval) * time.Millisecond,
+				SnapshotInterval: time.Duration(cfg.WALSnapshotInterval) * time.Second,
+			})
+		}
+		return NewMemoryBackend()
+	case "bolt":
+		return NewBoltBackend(cfg.BoltPath)
+	case "sqlite":
+		return NewSQLiteBackend(cfg.SQLitePath)
+	case "files":
+		return NewFilesBackend(cfg.FilesRoot)
+	case "s3":
+		return NewS3Backend(S3Options{
+			Endpoint:     cfg.S3Endpoint,
+			Bucket:       cfg.S3Bucket,
+			Region:       cfg.S3Region,
+			AccessKey:    cfg.S3AccessKey,
+			SecretKey:    cfg.S3SecretKey,
+			SessionToken: cfg.S3SessionToken,
+			PathStyle:    cfg.S3PathStyle,
+			Prefix:       cfg.S3Prefix,
+			TempDir:      cfg.S3TempDir,
+		})
+	default:
+		return nil, errors.Errorf("unknown storage backend %q", cfg.Type)
+	}
+}
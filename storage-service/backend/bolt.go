@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var recordsBucket = []byte("records")
+
+// BoltBackend keeps records in a single bbolt database file, so they survive
+// restarts of the storage-service. Records are stored JSON encoded
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bolt database %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to create records bucket")
+	}
+
+	return &BoltBackend{db: db}, nil
+}
+
+func (b *BoltBackend) Put(key string, record *Record) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal record")
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).Put([]byte(key), value)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to put record")
+	}
+
+	return nil
+}
+
+func (b *BoltBackend) Create(key string, record *Record) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal record")
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		_, err := getRecord(tx, key)
+		if err == nil {
+			return ErrExists
+		}
+		if err != ErrNotFound {
+			return err
+		}
+
+		return tx.Bucket(recordsBucket).Put([]byte(key), value)
+	})
+	if err == ErrExists {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	return nil
+}
+
+func (b *BoltBackend) Get(key string) (*Record, error) {
+	var record *Record
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx, key)
+		return err
+	})
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get record")
+	}
+
+	return record, nil
+}
+
+func (b *BoltBackend) Update(key string, fn func(record *Record) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(record)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal record")
+		}
+
+		return tx.Bucket(recordsBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *BoltBackend) Rename(from, to string) error {
+	// a read-only transaction is cheaper than a commit, and most lookups of
+	// previous keys find nothing
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, err := getRecord(tx, from)
+		return err
+	})
+	if err == ErrNotFound {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get record")
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getRecord(tx, from); err != nil {
+			return err
+		}
+
+		_, err := getRecord(tx, to)
+		if err == nil {
+			return ErrExists
+		}
+		if err != ErrNotFound {
+			return err
+		}
+
+		bucket := tx.Bucket(recordsBucket)
+		if err := bucket.Put([]byte(to), bucket.Get([]byte(from))); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(from))
+	})
+	if err == ErrNotFound || err == ErrExists {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to rename record")
+	}
+
+	return nil
+}
+
+func (b *BoltBackend) Delete(key string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete record")
+	}
+
+	return nil
+}
+
+func (b *BoltBackend) DeleteIf(key string, fn func(record *Record) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		return tx.Bucket(recordsBucket).Delete([]byte(key))
+	})
+}
+
+func (b *BoltBackend) DeleteExpired(now time.Time) (int, error) {
+	deleted := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket)
+
+		expired := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			record := &Record{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal record %s", k)
+			}
+			if record.gone(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// keys must not be deleted while iterating
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete expired records")
+	}
+
+	return deleted, nil
+}
+
+func (b *BoltBackend) List() ([]string, error) {
+	keys := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list records")
+	}
+
+	return keys, nil
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+func getRecord(tx *bolt.Tx, key string) (*Record, error) {
+	value := tx.Bucket(recordsBucket).Get([]byte(key))
+	if value == nil {
+		return nil, ErrNotFound
+	}
+
+	record := &Record{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal record")
+	}
+	if record.gone(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return record, nil
+}
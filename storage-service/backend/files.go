@@ -0,0 +1,884 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A record file holds the record's fields in a JSON header, followed by its
+// payload:
+//
+//	magic       4 bytes  "AKHB"
+//	version     1 byte   file format version, currently 1
+//	header      4 bytes  length of the JSON header
+//	payload     8 bytes  length of the payload
+//	checksum    4 bytes  CRC-32C of the JSON header and the payload
+//	header      JSON     every field of the record but the payload
+//	payload
+//
+// Files are named by their key and sharded by the SHA-256 of the key, e.g.
+// <root>/3f/a2/<key>, so no directory grows too large
+const recordFileVersion = 1
+
+const recordFilePrefixSize = 4 + 1 + 4 + 8 + 4
+
+var recordFileMagic = []byte("AKHB")
+
+// tmpDir holds files being written under the root, renamed into place once
+// complete. Shards are hex, so it can't clash with one
+const tmpDir = ".tmp"
+
+var ErrCorruptRecord = errors.New("corrupt record file")
+
+// FilesBackend keeps every record in a file of its own under a root
+// directory, so large payloads can live on cheap disks and be backed up
+// with rsync. Files are written to a temporary file, flushed and renamed
+// into place, so a crash never leaves a partial record behind. Only one
+// storage-service may use a root at a time
+type FilesBackend struct {
+	root string
+
+	// locks serialise the changes to the keys of a stripe, readers rely on
+	// renames being atomic instead
+	locks [256]sync.Mutex
+}
+
+func NewFilesBackend(root string) (*FilesBackend, error) {
+	if err := os.MkdirAll(filepath.Join(root, tmpDir), 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create storage root %s", root)
+	}
+
+	// left over by writes interrupted by a crash
+	entries, err := os.ReadDir(filepath.Join(root, tmpDir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read storage root %s", root)
+	}
+	for _, entry := range entries {
+		os.Remove(filepath.Join(root, tmpDir, entry.Name()))
+	}
+
+	return &FilesBackend{root: root}, nil
+}
+
+func (b *FilesBackend) Put(key string, record *Record) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	if err := b.write(key, record); err != nil {
+		return errors.Wrap(err, "failed to put record")
+	}
+
+	return nil
+}
+
+func (b *FilesBackend) Create(key string, record *Record) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	_, err := b.header(key, time.Now())
+	if err == nil {
+		return ErrExists
+	}
+	if err != ErrNotFound {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	if err := b.write(key, record); err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	return nil
+}
+
+func (b *FilesBackend) Get(key string) (*Record, error) {
+	if err := checkFileKey(key); err != nil {
+		return nil, err
+	}
+
+	record, err := b.read(key, time.Now())
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get record")
+	}
+
+	return record, nil
+}
+
+func (b *FilesBackend) Update(key string, fn func(record *Record) error) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	record, err := b.read(key, time.Now())
+	if err == ErrNotFound {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to update record")
+	}
+
+	if err := fn(record); err != nil {
+		return err
+	}
+
+	if err := b.write(key, record); err != nil {
+		return errors.Wrap(err, "failed to update record")
+	}
+
+	return nil
+}
+
+func (b *FilesBackend) Rename(from, to string) error {
+	if err := checkFileKey(from); err != nil {
+		return err
+	}
+	if err := checkFileKey(to); err != nil {
+		return err
+	}
+
+	unlock := b.lock(from, to)
+	defer unlock()
+
+	now := time.Now()
+	if _, err := b.header(from, now); err == ErrNotFound {
+		return err
+	} else if err != nil {
+		return errors.Wrap(err, "failed to rename record")
+	}
+
+	_, err := b.header(to, now)
+	if err == nil {
+		return ErrExists
+	}
+	if err != ErrNotFound {
+		return errors.Wrap(err, "failed to rename record")
+	}
+
+	dir, err := b.shardDir(to)
+	if err != nil {
+		return errors.Wrap(err, "failed to rename record")
+	}
+	if err := os.Rename(b.path(from), b.path(to)); err != nil {
+		return errors.Wrap(err, "failed to rename record")
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(b.path(from)))
+}
+
+func (b *FilesBackend) Delete(key string) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	return b.remove(key)
+}
+
+func (b *FilesBackend) DeleteIf(key string, fn func(record *Record) error) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	header, err := b.header(key, time.Now())
+	if err == ErrNotFound {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to delete record")
+	}
+
+	if err := fn(header.record()); err != nil {
+		return err
+	}
+
+	return b.remove(key)
+}
+
+// CreateStream writes the payload to a temporary file before it takes the
+// lock of key, so a slow upload doesn't hold up other changes
+func (b *FilesBackend) CreateStream(key string, record *Record, payload io.Reader) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	tmp, err := b.spool(record, payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	_, err = b.header(key, time.Now())
+	if err == nil {
+		os.Remove(tmp)
+		return ErrExists
+	}
+	if err != ErrNotFound {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	if err := b.commit(tmp, key); err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	return nil
+}
+
+// ReplaceStream writes the payload to a temporary file before it takes the
+// lock of key, like CreateStream
+func (b *FilesBackend) ReplaceStream(key string, record *Record, payload io.Reader, check func(existing *Record) error) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	tmp, err := b.spool(record, payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace record")
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	header, err := b.header(key, time.Now())
+	if err == ErrNotFound {
+		os.Remove(tmp)
+		return err
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to replace record")
+	}
+	if err := check(header.record()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := b.commit(tmp, key); err != nil {
+		return errors.Wrap(err, "failed to replace record")
+	}
+
+	return nil
+}
+
+// GetStream reads the payload from the file that was in place when it was
+// called, even if the record is replaced in the meantime
+func (b *FilesBackend) GetStream(key string) (*Record, int64, io.ReadCloser, error) {
+	if err := checkFileKey(key); err != nil {
+		return nil, 0, nil, err
+	}
+
+	file, size, err := openRecordFile(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, 0, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "failed to get record")
+	}
+
+	header, raw, err := readRecordHeader(file, size)
+	if err != nil {
+		file.Close()
+		return nil, 0, nil, errors.Wrapf(err, "failed to read record %s", key)
+	}
+	if header.gone(time.Now()) {
+		file.Close()
+		return nil, 0, nil, ErrNotFound
+	}
+
+	return header.record(), int64(binary.BigEndian.Uint64(raw[9:])), newPayloadReader(file, file, raw), nil
+}
+
+// UpdateHeader copies the payload to the new file while it verifies its
+// checksum, a corrupt record isn't given a fresh checksum
+func (b *FilesBackend) UpdateHeader(key string, fn func(record *Record) error) error {
+	if err := checkFileKey(key); err != nil {
+		return err
+	}
+
+	unlock := b.lock(key)
+	defer unlock()
+
+	file, size, err := openRecordFile(b.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to update record")
+	}
+	defer file.Close()
+
+	header, raw, err := readRecordHeader(file, size)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read record %s", key)
+	}
+	if header.gone(time.Now()) {
+		return ErrNotFound
+	}
+
+	record := header.record()
+	if err := fn(record); err != nil {
+		return err
+	}
+
+	tmp, err := b.spool(record, newPayloadReader(file, file, raw))
+	if err != nil {
+		return errors.Wrap(err, "failed to update record")
+	}
+	if err := b.commit(tmp, key); err != nil {
+		return errors.Wrap(err, "failed to update record")
+	}
+
+	return nil
+}
+
+func (b *FilesBackend) DeleteExpired(now time.Time) (int, error) {
+	keys, err := b.List()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		gone, err := b.expired(key, now)
+		if errors.Cause(err) == ErrCorruptRecord {
+			// one bad file mustn't stop the expiry of all the others
+			slog.Default().Warn("skipped corrupt record file", "key", key, "error", err)
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if gone {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (b *FilesBackend) List() ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(b.root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		keys = append(keys, entry.Name())
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list records")
+	}
+
+	return keys, nil
+}
+
+func (b *FilesBackend) Close() error {
+	return nil
+}
+
+// expired deletes the record stored under key if it has expired at now or is
+// used up, and reports whether it did
+func (b *FilesBackend) expired(key string, now time.Time) (bool, error) {
+	unlock := b.lock(key)
+	defer unlock()
+
+	file, size, err := openRecordFile(b.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open record")
+	}
+	defer file.Close()
+
+	// the payload isn't needed to tell, and isn't read
+	header, _, err := readRecordHeader(file, size)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read record %s", key)
+	}
+	if !header.gone(now) {
+		return false, nil
+	}
+
+	if err := b.remove(key); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// read returns the record stored under key, or ErrNotFound if there is none
+// or it is gone at now
+func (b *FilesBackend) read(key string, now time.Time) (*Record, error) {
+	file, size, err := openRecordFile(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	record, err := readRecordFile(file, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read record %s", key)
+	}
+	if record.gone(now) {
+		return nil, ErrNotFound
+	}
+
+	return record, nil
+}
+
+// header returns the header of the record stored under key without reading
+// its payload, or ErrNotFound if there is none or it is gone at now
+func (b *FilesBackend) header(key string, now time.Time) (*recordHeader, error) {
+	file, size, err := openRecordFile(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, _, err := readRecordHeader(file, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read record %s", key)
+	}
+	if header.gone(now) {
+		return nil, ErrNotFound
+	}
+
+	return header, nil
+}
+
+// write replaces the file of key atomically: the record is written to a
+// temporary file, flushed and renamed into place
+func (b *FilesBackend) write(key string, record *Record) error {
+	tmp, err := os.CreateTemp(filepath.Join(b.root, tmpDir), "record-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+
+	err = writeRecordFile(tmp, record)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write temporary file")
+	}
+
+	return b.commit(tmp.Name(), key)
+}
+
+// spool writes a record file with the payload read from payload to a flushed
+// temporary file, and returns its path to be committed
+func (b *FilesBackend) spool(record *Record, payload io.Reader) (string, error) {
+	tmp, _, err := spoolRecord(filepath.Join(b.root, tmpDir), record, payload)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write temporary file")
+	}
+
+	err = tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "failed to write temporary file")
+	}
+
+	return tmp.Name(), nil
+}
+
+// commit renames the flushed temporary file tmp into place as the file of
+// key. tmp is removed if that fails
+func (b *FilesBackend) commit(tmp, key string) error {
+	dir, err := b.shardDir(key)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, b.path(key)); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to rename temporary file")
+	}
+
+	return syncDir(dir)
+}
+
+func (b *FilesBackend) remove(key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to delete record")
+	}
+
+	return syncDir(filepath.Dir(b.path(key)))
+}
+
+// shardDir creates the shard directory of key if needed, flushing the
+// directories it was created in
+func (b *FilesBackend) shardDir(key string) (string, error) {
+	dir := filepath.Dir(b.path(key))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "failed to create shard directory %s", dir)
+	}
+	for _, d := range []string{filepath.Dir(dir), b.root} {
+		if err := syncDir(d); err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+func (b *FilesBackend) path(key string) string {
+	shard := shardOf(key)
+	return filepath.Join(b.root, shard[:2], shard[2:4], key)
+}
+
+// lock locks the stripes of the given keys, in order so two renames can't
+// deadlock, and returns a function unlocking them
+func (b *FilesBackend) lock(keys ...string) func() {
+	stripes := []int{}
+	for _, key := range keys {
+		stripe := int(sha256.Sum256([]byte(key))[0])
+		if len(stripes) == 0 || stripes[len(stripes)-1] != stripe {
+			stripes = append(stripes, stripe)
+		}
+	}
+	if len(stripes) == 2 && stripes[0] > stripes[1] {
+		stripes[0], stripes[1] = stripes[1], stripes[0]
+	}
+
+	for _, stripe := range stripes {
+		b.locks[stripe].Lock()
+	}
+
+	return func() {
+		for _, stripe := range stripes {
+			b.locks[stripe].Unlock()
+		}
+	}
+}
+
+func shardOf(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:2])
+}
+
+// checkFileKey makes sure a key is a plain file name, so it can't escape its
+// shard directory or be mistaken for a temporary file
+func checkFileKey(key string) error {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, "/\\\x00") {
+		return errors.Errorf("key %q can't be used as a file name", key)
+	}
+
+	return nil
+}
+
+// recordHeader holds every field of a record but its payload
+type recordHeader struct {
+	Version   int               `json:"version,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at,omitzero"`
+	MaxReads  int               `json:"max_reads,omitempty"`
+	Reads     int               `json:"reads,omitempty"`
+	IdRef     []byte            `json:"id_ref,omitempty"`
+}
+
+func (h *recordHeader) gone(now time.Time) bool {
+	return h.record().gone(now)
+}
+
+// record returns the record the header belongs to, without its payload
+func (h *recordHeader) record() *Record {
+	return &Record{
+		Version:   h.Version,
+		Metadata:  h.Metadata,
+		ExpiresAt: h.ExpiresAt,
+		MaxReads:  h.MaxReads,
+		Reads:     h.Reads,
+		IdRef:     h.IdRef,
+	}
+}
+
+func marshalRecordHeader(record *Record) ([]byte, error) {
+	header, err := json.Marshal(recordHeader{
+		Version:   record.Version,
+		Metadata:  record.Metadata,
+		ExpiresAt: record.ExpiresAt,
+		MaxReads:  record.MaxReads,
+		Reads:     record.Reads,
+		IdRef:     record.IdRef,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal record header")
+	}
+
+	return header, nil
+}
+
+func recordFilePrefix(headerLength int, payloadLength int64, checksum uint32) []byte {
+	prefix := make([]byte, 0, recordFilePrefixSize)
+	prefix = append(prefix, recordFileMagic...)
+	prefix = append(prefix, recordFileVersion)
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(headerLength))
+	prefix = binary.BigEndian.AppendUint64(prefix, uint64(payloadLength))
+	return binary.BigEndian.AppendUint32(prefix, checksum)
+}
+
+func writeRecordFile(w io.Writer, record *Record) error {
+	header, err := marshalRecordHeader(record)
+	if err != nil {
+		return err
+	}
+
+	checksum := crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, record.Payload)
+	prefix := recordFilePrefix(len(header), int64(len(record.Payload)), checksum)
+
+	for _, part := range [][]byte{prefix, header, record.Payload} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRecordStream writes a record file to f with the payload read from
+// payload, and returns its size. The lengths and the checksum are only known
+// once the payload has been copied, so the prefix is filled in last
+func writeRecordStream(f *os.File, record *Record, payload io.Reader) (int64, error) {
+	header, err := marshalRecordHeader(record)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Write(make([]byte, recordFilePrefixSize)); err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(header); err != nil {
+		return 0, err
+	}
+
+	checksum := crc32.New(castagnoli)
+	checksum.Write(header)
+	payloadLength, err := io.Copy(io.MultiWriter(f, checksum), payload)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := f.WriteAt(recordFilePrefix(len(header), payloadLength, checksum.Sum32()), 0); err != nil {
+		return 0, err
+	}
+
+	return recordFilePrefixSize + int64(len(header)) + payloadLength, nil
+}
+
+// spoolRecord writes a record file with the payload read from payload to a
+// new temporary file in dir. The caller closes and removes the file
+func spoolRecord(dir string, record *Record, payload io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp(dir, "record-")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to create temporary file")
+	}
+
+	size, err := writeRecordStream(file, record, payload)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+
+	return file, size, nil
+}
+
+// openRecordFile opens a record file and returns its size
+func openRecordFile(path string) (*os.File, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// readRecordHeader reads the header of a record file of the given size,
+// leaving r at the start of the payload. It also returns the bytes read,
+// which hold the lengths and the checksum
+func readRecordHeader(r io.Reader, size int64) (*recordHeader, []byte, error) {
+	prefix := make([]byte, recordFilePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, ErrCorruptRecord
+	}
+	if !bytes.Equal(prefix[:4], recordFileMagic) || prefix[4] != recordFileVersion {
+		return nil, nil, ErrCorruptRecord
+	}
+
+	headerLength := int64(binary.BigEndian.Uint32(prefix[5:]))
+	payloadLength := binary.BigEndian.Uint64(prefix[9:])
+	if payloadLength > uint64(size) || recordFilePrefixSize+headerLength+int64(payloadLength) != size {
+		return nil, nil, ErrCorruptRecord
+	}
+
+	headerJSON := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, headerJSON); err != nil {
+		return nil, nil, ErrCorruptRecord
+	}
+
+	header := &recordHeader{}
+	if err := json.Unmarshal(headerJSON, header); err != nil {
+		return nil, nil, ErrCorruptRecord
+	}
+
+	return header, append(prefix, headerJSON...), nil
+}
+
+// payloadReader reads the payload of a record file, once its header has been
+// read by readRecordHeader. It fails with ErrCorruptRecord at the end of the
+// payload if it doesn't match the checksum
+type payloadReader struct {
+	r         io.Reader
+	closer    io.Closer
+	checksum  hash.Hash32
+	expected  uint32
+	remaining int64
+	err       error
+}
+
+// newPayloadReader reads the payload from r, which is closed by Close. raw
+// is the header as returned by readRecordHeader
+func newPayloadReader(r io.Reader, closer io.Closer, raw []byte) *payloadReader {
+	checksum := crc32.New(castagnoli)
+	checksum.Write(raw[recordFilePrefixSize:])
+
+	return &payloadReader{
+		r:         r,
+		closer:    closer,
+		checksum:  checksum,
+		expected:  binary.BigEndian.Uint32(raw[17:]),
+		remaining: int64(binary.BigEndian.Uint64(raw[9:])),
+	}
+}
+
+func (p *payloadReader) Read(buf []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	if p.remaining == 0 {
+		p.err = io.EOF
+		if p.checksum.Sum32() != p.expected {
+			p.err = ErrCorruptRecord
+		}
+		return 0, p.err
+	}
+
+	if int64(len(buf)) > p.remaining {
+		buf = buf[:p.remaining]
+	}
+	n, err := p.r.Read(buf)
+	p.checksum.Write(buf[:n])
+	p.remaining -= int64(n)
+	if err == io.EOF && p.remaining > 0 {
+		p.err = ErrCorruptRecord
+		return n, p.err
+	}
+	if err != nil && err != io.EOF {
+		p.err = err
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (p *payloadReader) Close() error {
+	return p.closer.Close()
+}
+
+// readRecordFile reads a record file of the given size and verifies its
+// checksum
+func readRecordFile(r io.Reader, size int64) (*Record, error) {
+	header, raw, err := readRecordHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint64(raw[9:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, ErrCorruptRecord
+	}
+
+	checksum := crc32.Update(crc32.Checksum(raw[recordFilePrefixSize:], castagnoli), castagnoli, payload)
+	if checksum != binary.BigEndian.Uint32(raw[17:]) {
+		return nil, ErrCorruptRecord
+	}
+
+	record := header.record()
+	record.Payload = payload
+
+	return record, nil
+}
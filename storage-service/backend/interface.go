@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound = errors.New("record not found")
+	ErrExists   = errors.New("record already exists")
+)
+
+// Record is a single stored ciphertext together with the metadata the
+// encryption-service keeps next to it, e.g. a wrapped data key. A record
+// with a zero ExpiresAt never expires, one with a zero MaxReads can be read
+// any number of times. Version and IdRef, the sealed id of the record, are
+// maintained by the service, the backends store them like any other field
+type Record struct {
+	Version   int               `json:"version,omitempty"`
+	Payload   []byte            `json:"payload"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at,omitzero"`
+	MaxReads  int               `json:"max_reads,omitempty"`
+	Reads     int               `json:"reads,omitempty"`
+	IdRef     []byte            `json:"id_ref,omitempty"`
+}
+
+// Interface is implemented by every place the storage-service can keep its
+// records in. Keys are the hashed ids produced by the service
+type Interface interface {
+	// Put stores the record under the given key, replacing any previous one
+	Put(key string, record *Record) error
+
+	// Create stores the record under the given key unless a record is stored
+	// there already, in which case it returns ErrExists. Expired and used up
+	// records don't count as stored
+	Create(key string, record *Record) error
+
+	// Get returns the record stored under the given key or ErrNotFound.
+	// Expired and used up records are reported as ErrNotFound even before
+	// they are purged
+	Get(key string) (*Record, error)
+
+	// Update atomically applies fn to the record stored under the given key
+	// and stores the result. It returns ErrNotFound if there is no such
+	// record or it is expired or used up, and stores nothing if fn returns
+	// an error
+	Update(key string, fn func(record *Record) error) error
+
+	// Rename atomically moves the record stored under from to the key to. It
+	// returns ErrNotFound if there is no record under from or it is expired
+	// or used up, and ErrExists if a record is stored under to already
+	Rename(from, to string) error
+
+	// Delete removes the record stored under the given key. Deleting a key
+	// that doesn't exist is not an error
+	Delete(key string) error
+
+	// DeleteIf atomically removes the record stored under the given key if
+	// fn returns nil for it. It returns ErrNotFound if there is no such
+	// record or it is expired or used up, and removes nothing if fn returns
+	// an error. fn may be given the record without its payload
+	DeleteIf(key string, fn func(record *Record) error) error
+
+	// DeleteExpired removes all records that have expired at now or are used
+	// up, and returns how many were removed
+	DeleteExpired(now time.Time) (int, error)
+
+	// List returns all keys currently held by the backend
+	List() ([]string, error)
+
+	// Close releases any resources held by the backend
+	Close() error
+}
+
+// Streamer is implemented by backends that can store and read payloads
+// without holding them in memory. The Payload of the records passed to and
+// returned by its methods is left empty, the payload travels separately
+type Streamer interface {
+	// CreateStream is Create with the payload read from payload
+	CreateStream(key string, record *Record, payload io.Reader) error
+
+	// ReplaceStream atomically replaces the record stored under the given
+	// key with record and the payload read from payload, if check returns
+	// nil for the stored record. It returns ErrNotFound if there is no such
+	// record or it is expired or used up. check may be called more than once
+	ReplaceStream(key string, record *Record, payload io.Reader, check func(existing *Record) error) error
+
+	// GetStream is Get with the payload returned as a reader, which has to
+	// be closed, along with its size. The reader fails with ErrCorruptRecord
+	// at the end of a payload that doesn't match its checksum
+	GetStream(key string) (*Record, int64, io.ReadCloser, error)
+
+	// UpdateHeader is Update for changes that leave the payload alone. The
+	// payload is copied as it is, fn can't change it
+	UpdateHeader(key string, fn func(record *Record) error) error
+}
+
+// clone returns a deep copy of the record, so callers never share the
+// backing arrays or maps with a backend
+func (r *Record) clone() *Record {
+	c := *r
+	c.Payload = append([]byte(nil), r.Payload...)
+	c.IdRef = append([]byte(nil), r.IdRef...)
+	if r.Metadata != nil {
+		c.Metadata = make(map[string]string, len(r.Metadata))
+		for k, v := range r.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return &c
+}
+
+// Expired reports whether the record has expired at now
+func (r *Record) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// UsedUp reports whether the record has been read as often as it may be
+func (r *Record) UsedUp() bool {
+	return r.MaxReads > 0 && r.Reads >= r.MaxReads
+}
+
+// gone reports whether the record must be treated as if it didn't exist
+func (r *Record) gone(now time.Time) bool {
+	return r.Expired(now) || r.UsedUp()
+}
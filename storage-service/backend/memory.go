@@ -0,0 +1,155 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps records in a map. Everything is lost when the process
+// exits, so it is only suitable for development and tests
+type MemoryBackend struct {
+	lock    sync.RWMutex
+	storage map[string]*Record
+}
+
+func NewMemoryBackend() (*MemoryBackend, error) {
+	return &MemoryBackend{
+		storage: map[string]*Record{},
+	}, nil
+}
+
+func (b *MemoryBackend) Put(key string, record *Record) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.storage[key] = record.clone()
+
+	return nil
+}
+
+func (b *MemoryBackend) Create(key string, record *Record) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if existing, ok := b.storage[key]; ok && !existing.gone(time.Now()) {
+		return ErrExists
+	}
+	b.storage[key] = record.clone()
+
+	return nil
+}
+
+func (b *MemoryBackend) Get(key string) (*Record, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	record, ok := b.storage[key]
+	if !ok || record.gone(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return record.clone(), nil
+}
+
+// stored reports whether a record that isn't expired or used up is stored
+// under the given key
+func (b *MemoryBackend) stored(key string) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	record, ok := b.storage[key]
+	return ok && !record.gone(time.Now())
+}
+
+func (b *MemoryBackend) Update(key string, fn func(record *Record) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record, ok := b.storage[key]
+	if !ok || record.gone(time.Now()) {
+		return ErrNotFound
+	}
+
+	updated := record.clone()
+	if err := fn(updated); err != nil {
+		return err
+	}
+	b.storage[key] = updated
+
+	return nil
+}
+
+func (b *MemoryBackend) Rename(from, to string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	record, ok := b.storage[from]
+	if !ok || record.gone(now) {
+		return ErrNotFound
+	}
+	if existing, ok := b.storage[to]; ok && !existing.gone(now) {
+		return ErrExists
+	}
+
+	b.storage[to] = record
+	delete(b.storage, from)
+
+	return nil
+}
+
+func (b *MemoryBackend) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.storage, key)
+
+	return nil
+}
+
+func (b *MemoryBackend) DeleteIf(key string, fn func(record *Record) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	record, ok := b.storage[key]
+	if !ok || record.gone(time.Now()) {
+		return ErrNotFound
+	}
+	if err := fn(record.clone()); err != nil {
+		return err
+	}
+	delete(b.storage, key)
+
+	return nil
+}
+
+func (b *MemoryBackend) DeleteExpired(now time.Time) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	deleted := 0
+	for key, record := range b.storage {
+		if record.gone(now) {
+			delete(b.storage, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (b *MemoryBackend) List() ([]string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	keys := make([]string, 0, len(b.storage))
+	for key := range b.storage {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,718 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// s3Attempts bounds how often a conditional write is retried when the object
+// keeps changing underneath it
+const s3Attempts = 5
+
+// Object metadata holding the fields that decide whether a record is gone,
+// so DeleteExpired only needs to HEAD objects
+const (
+	s3ExpiresAtHeader = "X-Amz-Meta-Expires-At"
+	s3MaxReadsHeader  = "X-Amz-Meta-Max-Reads"
+	s3ReadsHeader     = "X-Amz-Meta-Reads"
+)
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+type S3Options struct {
+	// Endpoint is the URL of the S3 service, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://minio:9000
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// as most on-prem servers expect
+	PathStyle bool
+
+	// Prefix is put in front of every object key
+	Prefix string
+
+	// TempDir holds the record files of streamed payloads while they are
+	// uploaded, the system's temporary directory if empty
+	TempDir string
+}
+
+// S3Backend keeps every record in an object of an S3 compatible bucket, in
+// the format of the files backend. Creates and updates are conditional
+// writes, so the server must support If-None-Match and If-Match on PUT.
+// Renames copy the object and delete the original, they are only atomic
+// where the server supports If-Match on DELETE as well. Streamed payloads are
+// spooled to a temporary file before they are uploaded, the request has to
+// state its length and checksum up front
+type S3Backend struct {
+	endpoint *url.URL
+	options  S3Options
+	creds    s3Credentials
+	client   *http.Client
+}
+
+// NewS3Backend checks that the bucket can be accessed with the credentials
+func NewS3Backend(options S3Options) (*S3Backend, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.Errorf("invalid S3 endpoint %q", options.Endpoint)
+	}
+	if options.Bucket == "" {
+		return nil, errors.New("an S3 bucket is required")
+	}
+	if options.Region == "" {
+		return nil, errors.New("an S3 region is required")
+	}
+
+	b := &S3Backend{
+		endpoint: endpoint,
+		options:  options,
+		creds: s3Credentials{
+			accessKey:    options.AccessKey,
+			secretKey:    options.SecretKey,
+			sessionToken: options.SessionToken,
+		},
+		client: &http.Client{},
+	}
+
+	resp, err := b.do(http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to access S3 bucket %s", options.Bucket)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to access S3 bucket %s: %s", options.Bucket, resp.Status)
+	}
+
+	return b, nil
+}
+
+func (b *S3Backend) Put(key string, record *Record) error {
+	if err := b.putObject(key, record, nil); err != nil {
+		return errors.Wrap(err, "failed to put record")
+	}
+
+	return nil
+}
+
+func (b *S3Backend) Create(key string, record *Record) error {
+	body := &bytes.Buffer{}
+	if err := writeRecordFile(body, record); err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	err := b.create(key, record, bytes.NewReader(body.Bytes()), int64(body.Len()))
+	if err == ErrExists {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	return nil
+}
+
+func (b *S3Backend) Get(key string) (*Record, error) {
+	record, _, err := b.getObject(key)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get record")
+	}
+	if record.gone(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return record, nil
+}
+
+// Update only stores the record if it hasn't changed since it was read, and
+// tries again otherwise. fn may be called more than once
+func (b *S3Backend) Update(key string, fn func(record *Record) error) error {
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		record, etag, err := b.getObject(key)
+		if err == ErrNotFound {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to update record")
+		}
+		if record.gone(time.Now()) {
+			return ErrNotFound
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		err = b.putObject(key, record, http.Header{"If-Match": {etag}})
+		if err == errPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to update record")
+		}
+		return nil
+	}
+
+	return errors.Errorf("failed to update record: changed concurrently %d times", s3Attempts)
+}
+
+// Rename streams the record through a temporary file
+func (b *S3Backend) Rename(from, to string) error {
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		record, etag, _, payload, err := b.getStream(from)
+		if err == ErrNotFound {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to rename record")
+		}
+		if record.gone(time.Now()) {
+			payload.Close()
+			return ErrNotFound
+		}
+
+		file, size, err := spoolRecord(b.options.TempDir, record, payload)
+		payload.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to rename record")
+		}
+		err = b.create(to, record, file, size)
+		dropSpool(file)
+		if err == ErrExists {
+			return err
+		} else if err != nil {
+			return errors.Wrap(err, "failed to rename record")
+		}
+
+		// the original changed after it was copied, the copy is dropped and
+		// the rename starts over
+		err = b.deleteObject(from, etag)
+		if err == errPreconditionFailed {
+			if err := b.deleteObject(to, ""); err != nil {
+				return errors.Wrap(err, "failed to rename record")
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to rename record")
+		}
+		return nil
+	}
+
+	return errors.Errorf("failed to rename record: changed concurrently %d times", s3Attempts)
+}
+
+func (b *S3Backend) Delete(key string) error {
+	if err := b.deleteObject(key, ""); err != nil {
+		return errors.Wrap(err, "failed to delete record")
+	}
+
+	return nil
+}
+
+// DeleteIf only deletes the record if it hasn't changed since it was read,
+// and tries again otherwise. fn may be called more than once
+func (b *S3Backend) DeleteIf(key string, fn func(record *Record) error) error {
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		record, etag, _, payload, err := b.getStream(key)
+		if err == ErrNotFound {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to delete record")
+		}
+		payload.Close()
+		if record.gone(time.Now()) {
+			return ErrNotFound
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		err = b.deleteObject(key, etag)
+		if err == errPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to delete record")
+		}
+		return nil
+	}
+
+	return errors.Errorf("failed to delete record: changed concurrently %d times", s3Attempts)
+}
+
+func (b *S3Backend) CreateStream(key string, record *Record, payload io.Reader) error {
+	file, size, err := spoolRecord(b.options.TempDir, record, payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+	defer dropSpool(file)
+
+	err = b.create(key, record, file, size)
+	if err == ErrExists {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	return nil
+}
+
+// ReplaceStream only stores the record if the one it replaces hasn't changed
+// since check was given it, and tries again otherwise
+func (b *S3Backend) ReplaceStream(key string, record *Record, payload io.Reader, check func(existing *Record) error) error {
+	file, size, err := spoolRecord(b.options.TempDir, record, payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace record")
+	}
+	defer dropSpool(file)
+
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		existing, etag, _, existingPayload, err := b.getStream(key)
+		if err == ErrNotFound {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to replace record")
+		}
+		existingPayload.Close()
+		if existing.gone(time.Now()) {
+			return ErrNotFound
+		}
+
+		if err := check(existing); err != nil {
+			return err
+		}
+
+		err = b.putFile(key, record, file, size, http.Header{"If-Match": {etag}})
+		if err == errPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to replace record")
+		}
+		return nil
+	}
+
+	return errors.Errorf("failed to replace record: changed concurrently %d times", s3Attempts)
+}
+
+// GetStream reads the payload from the response to the GET of the object
+func (b *S3Backend) GetStream(key string) (*Record, int64, io.ReadCloser, error) {
+	record, _, size, payload, err := b.getStream(key)
+	if err == ErrNotFound {
+		return nil, 0, nil, err
+	}
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "failed to get record")
+	}
+	if record.gone(time.Now()) {
+		payload.Close()
+		return nil, 0, nil, ErrNotFound
+	}
+
+	return record, size, payload, nil
+}
+
+// UpdateHeader streams the record through a temporary file, and only stores
+// it if it hasn't changed since it was read. fn may be called more than once
+func (b *S3Backend) UpdateHeader(key string, fn func(record *Record) error) error {
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		record, etag, _, payload, err := b.getStream(key)
+		if err == ErrNotFound {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to update record")
+		}
+		if record.gone(time.Now()) {
+			payload.Close()
+			return ErrNotFound
+		}
+
+		if err := fn(record); err != nil {
+			payload.Close()
+			return err
+		}
+
+		file, size, err := spoolRecord(b.options.TempDir, record, payload)
+		payload.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to update record")
+		}
+		err = b.putFile(key, record, file, size, http.Header{"If-Match": {etag}})
+		dropSpool(file)
+		if err == errPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to update record")
+		}
+		return nil
+	}
+
+	return errors.Errorf("failed to update record: changed concurrently %d times", s3Attempts)
+}
+
+// DeleteExpired only reads the metadata of every object. A record is only
+// deleted if it hasn't been replaced since, where the server supports
+// If-Match on DELETE
+func (b *S3Backend) DeleteExpired(now time.Time) (int, error) {
+	keys, err := b.List()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		resp, err := b.do(http.MethodHead, key, nil, nil, nil)
+		if err != nil {
+			return deleted, errors.Wrap(err, "failed to delete expired records")
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return deleted, errors.Errorf("failed to delete expired records: %s", resp.Status)
+		}
+
+		record, ok := recordFromS3Headers(resp.Header)
+		if !ok || !record.gone(now) {
+			continue
+		}
+
+		err = b.deleteObject(key, resp.Header.Get("ETag"))
+		if err == errPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return deleted, errors.Wrap(err, "failed to delete expired records")
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (b *S3Backend) List() ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if b.options.Prefix != "" {
+			query.Set("prefix", b.options.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := b.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list records")
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list records")
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Wrap(s3Error(resp, body), "failed to list records")
+		}
+
+		result := struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, errors.Wrap(err, "failed to parse object list")
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, b.options.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *S3Backend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+// create stores the record file of record, of the given size, unless a
+// record that isn't gone is stored under key. A gone record is only replaced
+// if it hasn't changed since it was read
+func (b *S3Backend) create(key string, record *Record, file io.ReaderAt, size int64) error {
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		err := b.putFile(key, record, file, size, http.Header{"If-None-Match": {"*"}})
+		if err != errPreconditionFailed {
+			return err
+		}
+
+		existing, etag, _, payload, err := b.getStream(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		payload.Close()
+		if !existing.gone(time.Now()) {
+			return ErrExists
+		}
+
+		err = b.putFile(key, record, file, size, http.Header{"If-Match": {etag}})
+		if err != errPreconditionFailed {
+			return err
+		}
+	}
+
+	return errors.Errorf("changed concurrently %d times", s3Attempts)
+}
+
+// getObject returns the record stored under key even if it is gone, and the
+// ETag of its object
+func (b *S3Backend) getObject(key string) (*Record, string, error) {
+	record, etag, _, payload, err := b.getStream(key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer payload.Close()
+
+	if record.Payload, err = io.ReadAll(payload); err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read record %s", key)
+	}
+
+	return record, etag, nil
+}
+
+// getStream returns the record stored under key without its payload even if
+// it is gone, the ETag of its object, and the size of the payload and a
+// reader of it, which has to be closed
+func (b *S3Backend) getStream(key string) (*Record, string, int64, io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", 0, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, "", 0, nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, "", 0, nil, s3Error(resp, body)
+	}
+
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, "", 0, nil, errors.Errorf("no Content-Length in the response for record %s", key)
+	}
+	header, raw, err := readRecordHeader(resp.Body, resp.ContentLength)
+	if err != nil {
+		resp.Body.Close()
+		return nil, "", 0, nil, errors.Wrapf(err, "failed to read record %s", key)
+	}
+
+	size := int64(binary.BigEndian.Uint64(raw[9:]))
+	return header.record(), resp.Header.Get("ETag"), size, newPayloadReader(resp.Body, resp.Body, raw), nil
+}
+
+// putObject stores the record under key. It returns errPreconditionFailed if
+// the conditional headers in condition don't hold
+func (b *S3Backend) putObject(key string, record *Record, condition http.Header) error {
+	body := &bytes.Buffer{}
+	if err := writeRecordFile(body, record); err != nil {
+		return err
+	}
+
+	return b.putFile(key, record, bytes.NewReader(body.Bytes()), int64(body.Len()), condition)
+}
+
+// putFile is putObject with the record file of record, of the given size,
+// read from file. It is read twice, for its checksum and to upload it
+func (b *S3Backend) putFile(key string, record *Record, file io.ReaderAt, size int64, condition http.Header) error {
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, io.NewSectionReader(file, 0, size)); err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	for name, values := range condition {
+		header[name] = values
+	}
+	if !record.ExpiresAt.IsZero() {
+		header.Set(s3ExpiresAtHeader, record.ExpiresAt.UTC().Format(time.RFC3339Nano))
+	}
+	header.Set(s3MaxReadsHeader, strconv.Itoa(record.MaxReads))
+	header.Set(s3ReadsHeader, strconv.Itoa(record.Reads))
+
+	resp, err := b.send(http.MethodPut, key, nil, header, io.NewSectionReader(file, 0, size), size, hex.EncodeToString(checksum.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkS3Write(resp)
+}
+
+// deleteObject deletes the object of key, only if its ETag still matches when
+// etag is set. Deleting a missing object succeeds
+func (b *S3Backend) deleteObject(key, etag string) error {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+
+	resp, err := b.do(http.MethodDelete, key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return checkS3Write(resp)
+}
+
+// do sends a signed request for the object of key, or for the bucket if key
+// is empty
+func (b *S3Backend) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	return b.send(method, key, query, header, bytes.NewReader(body), int64(len(body)), payloadHash)
+}
+
+// send is do with a body of the given size read from body. payloadHash is
+// the hex SHA-256 of the body
+func (b *S3Backend) send(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *b.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/"
+	if b.options.PathStyle {
+		path += b.options.Bucket + "/"
+	} else {
+		u.Host = b.options.Bucket + "." + u.Host
+	}
+	if key != "" {
+		path += b.options.Prefix + key
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create S3 request")
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	signV4(req, b.creds, b.options.Region, payloadHash, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send S3 request")
+	}
+
+	return resp, nil
+}
+
+// dropSpool closes and removes a file written by spoolRecord
+func dropSpool(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// checkS3Write maps the response to a write to errPreconditionFailed if one
+// of its conditions didn't hold, or to an error if it failed otherwise
+func checkS3Write(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// 409 is returned when a conditional write races another one
+		return errPreconditionFailed
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return s3Error(resp, body)
+	}
+}
+
+// s3Error describes a failed request with the code and message of the error
+// document the server returned, if any
+func s3Error(resp *http.Response, body []byte) error {
+	document := struct {
+		Code    string
+		Message string
+	}{}
+	if err := xml.Unmarshal(body, &document); err != nil || document.Code == "" {
+		return errors.Errorf("S3 request failed: %s", resp.Status)
+	}
+
+	return errors.Errorf("S3 request failed: %s: %s %s", resp.Status, document.Code, document.Message)
+}
+
+// recordFromS3Headers reads the fields that decide whether a record is gone
+// from the metadata of its object. ok is false for objects without them
+func recordFromS3Headers(header http.Header) (record *Record, ok bool) {
+	record = &Record{}
+
+	maxReads, err := strconv.Atoi(header.Get(s3MaxReadsHeader))
+	if err != nil {
+		return nil, false
+	}
+	reads, err := strconv.Atoi(header.Get(s3ReadsHeader))
+	if err != nil {
+		return nil, false
+	}
+	record.MaxReads, record.Reads = maxReads, reads
+
+	if expiresAt := header.Get(s3ExpiresAtHeader); expiresAt != "" {
+		record.ExpiresAt, err = time.Parse(time.RFC3339Nano, expiresAt)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	return record, true
+}
@@ -0,0 +1,352 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations create and change the schema, in order. Each is applied
+// once and recorded in schema_migrations; released migrations must never be
+// changed, new ones are appended
+var sqliteMigrations = []string{
+	`CREATE TABLE records (
+		key        TEXT PRIMARY KEY,
+		payload    BLOB NOT NULL,
+		metadata   TEXT,
+		version    INTEGER NOT NULL DEFAULT 0,
+		max_reads  INTEGER NOT NULL DEFAULT 0,
+		reads      INTEGER NOT NULL DEFAULT 0,
+		expires_at INTEGER,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX records_expires_at ON records (expires_at) WHERE expires_at IS NOT NULL;`,
+	`ALTER TABLE records ADD COLUMN id_ref BLOB;`,
+}
+
+const recordColumns = "payload, metadata, version, max_reads, reads, expires_at, id_ref"
+
+// SQLiteBackend keeps records in a SQLite database file, so they can be
+// inspected with standard tools. Keys are the hashed ids, metadata is stored
+// as a JSON object and times as unix nanoseconds; expires_at is NULL for
+// records that never expire
+type SQLiteBackend struct {
+	db *sql.DB
+}
+
+func NewSQLiteBackend(path string) (*SQLiteBackend, error) {
+	// transactions take the write lock right away, so two updates of the
+	// same record can't deadlock upgrading their read locks
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open sqlite database %s", path)
+	}
+
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "failed to migrate sqlite database %s", path)
+	}
+
+	return &SQLiteBackend{db: db}, nil
+}
+
+// migrate applies the migrations the database hasn't seen yet, each in its
+// own transaction. A database migrated by a newer storage-service is refused
+func migrate(db *sql.DB, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "failed to create schema_migrations table")
+	}
+
+	for i, migration := range migrations {
+		version := i + 1
+
+		err := inTx(db, func(tx *sql.Tx) error {
+			var current int
+			if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+				return err
+			}
+			if current > len(migrations) {
+				return errors.Errorf("schema version %d is newer than the latest known version %d", current, len(migrations))
+			}
+			if current >= version {
+				return nil
+			}
+
+			if _, err := tx.Exec(migration); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", version, time.Now().UnixNano())
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "migration %d failed", version)
+		}
+	}
+
+	return nil
+}
+
+func (b *SQLiteBackend) Put(key string, record *Record) error {
+	err := inTx(b.db, func(tx *sql.Tx) error {
+		return upsertRecord(tx, key, record)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to put record")
+	}
+
+	return nil
+}
+
+func (b *SQLiteBackend) Create(key string, record *Record) error {
+	err := inTx(b.db, func(tx *sql.Tx) error {
+		_, err := getRecordTx(tx, key)
+		if err == nil {
+			return ErrExists
+		}
+		if err != ErrNotFound {
+			return err
+		}
+
+		// an expired or used up record is replaced by a new one
+		if _, err := tx.Exec("DELETE FROM records WHERE key = ?", key); err != nil {
+			return err
+		}
+		return upsertRecord(tx, key, record)
+	})
+	if err == ErrExists {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create record")
+	}
+
+	return nil
+}
+
+func (b *SQLiteBackend) Get(key string) (*Record, error) {
+	record, err := scanRecord(b.db.QueryRow("SELECT "+recordColumns+" FROM records WHERE key = ?", key))
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get record")
+	}
+	if record.gone(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return record, nil
+}
+
+func (b *SQLiteBackend) Update(key string, fn func(record *Record) error) error {
+	return inTx(b.db, func(tx *sql.Tx) error {
+		record, err := getRecordTx(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		return upsertRecord(tx, key, record)
+	})
+}
+
+func (b *SQLiteBackend) Rename(from, to string) error {
+	err := inTx(b.db, func(tx *sql.Tx) error {
+		if _, err := getRecordTx(tx, from); err != nil {
+			return err
+		}
+
+		_, err := getRecordTx(tx, to)
+		if err == nil {
+			return ErrExists
+		}
+		if err != ErrNotFound {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM records WHERE key = ?", to); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE records SET key = ?, updated_at = ? WHERE key = ?", to, time.Now().UnixNano(), from)
+		return err
+	})
+	if err == ErrNotFound || err == ErrExists {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to rename record")
+	}
+
+	return nil
+}
+
+func (b *SQLiteBackend) Delete(key string) error {
+	if _, err := b.db.Exec("DELETE FROM records WHERE key = ?", key); err != nil {
+		return errors.Wrap(err, "failed to delete record")
+	}
+
+	return nil
+}
+
+func (b *SQLiteBackend) DeleteIf(key string, fn func(record *Record) error) error {
+	return inTx(b.db, func(tx *sql.Tx) error {
+		record, err := getRecordTx(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM records WHERE key = ?", key)
+		return err
+	})
+}
+
+func (b *SQLiteBackend) DeleteExpired(now time.Time) (int, error) {
+	result, err := b.db.Exec(`DELETE FROM records
+		WHERE (expires_at IS NOT NULL AND expires_at <= ?) OR (max_reads > 0 AND reads >= max_reads)`, now.UnixNano())
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete expired records")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to count deleted records")
+	}
+
+	return int(deleted), nil
+}
+
+func (b *SQLiteBackend) List() ([]string, error) {
+	rows, err := b.db.Query("SELECT key FROM records")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list records")
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, errors.Wrap(err, "failed to list records")
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to list records")
+	}
+
+	return keys, nil
+}
+
+func (b *SQLiteBackend) Close() error {
+	return b.db.Close()
+}
+
+// inTx runs fn in a transaction, which is rolled back if fn returns an error
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getRecordTx returns the record stored under key, or ErrNotFound if it is
+// missing, expired or used up
+func getRecordTx(tx *sql.Tx, key string) (*Record, error) {
+	record, err := scanRecord(tx.QueryRow("SELECT "+recordColumns+" FROM records WHERE key = ?", key))
+	if err != nil {
+		return nil, err
+	}
+	if record.gone(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return record, nil
+}
+
+// upsertRecord stores the record under key, keeping the creation time of the
+// record it replaces
+func upsertRecord(tx *sql.Tx, key string, record *Record) error {
+	var metadata sql.NullString
+	if record.Metadata != nil {
+		encoded, err := json.Marshal(record.Metadata)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal metadata")
+		}
+		metadata = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	var expiresAt sql.NullInt64
+	if !record.ExpiresAt.IsZero() {
+		expiresAt = sql.NullInt64{Int64: record.ExpiresAt.UnixNano(), Valid: true}
+	}
+
+	payload := record.Payload
+	if payload == nil {
+		payload = []byte{}
+	}
+
+	now := time.Now().UnixNano()
+	_, err := tx.Exec(`INSERT INTO records (key, `+recordColumns+`, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			payload = excluded.payload,
+			metadata = excluded.metadata,
+			version = excluded.version,
+			max_reads = excluded.max_reads,
+			reads = excluded.reads,
+			expires_at = excluded.expires_at,
+			id_ref = excluded.id_ref,
+			updated_at = excluded.updated_at`,
+		key, payload, metadata, record.Version, record.MaxReads, record.Reads, expiresAt, record.IdRef, now, now)
+
+	return err
+}
+
+func scanRecord(row *sql.Row) (*Record, error) {
+	record := &Record{}
+	var metadata sql.NullString
+	var expiresAt sql.NullInt64
+
+	err := row.Scan(&record.Payload, &metadata, &record.Version, &record.MaxReads, &record.Reads, &expiresAt, &record.IdRef)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &record.Metadata); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal metadata")
+		}
+	}
+	if expiresAt.Valid {
+		record.ExpiresAt = time.Unix(0, expiresAt.Int64)
+	}
+
+	return record, nil
+}
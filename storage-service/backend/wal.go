@@ -0,0 +1,813 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SyncPolicy decides when changes logged by a WALBackend are flushed to disk
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes every change on its own before applying it
+	SyncAlways SyncPolicy = "always"
+
+	// SyncBatched flushes concurrent changes together. A change is applied
+	// right away but only acknowledged once it is on disk
+	SyncBatched SyncPolicy = "batched"
+
+	// SyncInterval flushes every SyncInterval in the background, changes
+	// acknowledged since the last flush are lost in a crash
+	SyncInterval SyncPolicy = "interval"
+)
+
+type WALOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// SnapshotInterval is how often the log is compacted into a snapshot,
+	// zero only compacts it on Close
+	SnapshotInterval time.Duration
+}
+
+// The write-ahead log and snapshots are sequences of frames:
+//
+//	length      4 bytes  length of the body
+//	checksum    4 bytes  CRC-32C of the body
+//	body:
+//	op          1 byte   opPut, opDelete or opRename
+//	key length  4 bytes
+//	key         key length bytes
+//	value       rest     JSON record for opPut, new key for opRename
+//
+// A snapshot only holds opPut frames. Logs and snapshots are numbered by
+// generation: snapshot-N holds the records as they were when wal-N was
+// started, so startup loads the newest snapshot and replays the logs from
+// its generation on
+const frameHeaderSize = 8
+
+const (
+	opPut byte = iota + 1
+	opDelete
+	opRename
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WALBackend keeps records in memory like MemoryBackend, and logs every change
+// to a write-ahead log in its directory so records survive restarts. The log
+// is compacted into a snapshot periodically and on Close
+type WALBackend struct {
+	memory  *MemoryBackend
+	dir     string
+	options WALOptions
+
+	// lock serialises changes, so they are logged in the order they are
+	// applied
+	lock       sync.Mutex
+	log        *logFile
+	generation uint64
+
+	snapshotLock sync.Mutex
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewWALBackend loads the newest snapshot in dir and replays the logs written
+// since. A torn frame at the end of the last log, left by a crash during a
+// write, is truncated away
+func NewWALBackend(dir string, options WALOptions) (*WALBackend, error) {
+	switch options.Sync {
+	case SyncAlways, SyncBatched:
+	case SyncInterval:
+		if options.SyncInterval <= 0 {
+			return nil, errors.New("the interval sync policy requires a positive sync interval")
+		}
+	default:
+		return nil, errors.Errorf("unknown write-ahead log sync policy %q", options.Sync)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create write-ahead log directory %s", dir)
+	}
+
+	snapshots, logs, err := listGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	memory, _ := NewMemoryBackend()
+
+	var snapshot uint64
+	if len(snapshots) > 0 {
+		snapshot = snapshots[len(snapshots)-1]
+		if err := loadSnapshot(snapshotPath(dir, snapshot), memory.storage); err != nil {
+			return nil, err
+		}
+	}
+
+	generation := snapshot
+	replay := []uint64{}
+	for _, g := range logs {
+		if g >= snapshot {
+			replay = append(replay, g)
+		}
+	}
+	for i, g := range replay {
+		if err := replayLog(logPath(dir, g), memory.storage, emptyLogs(dir, replay[i+1:])); err != nil {
+			return nil, err
+		}
+		generation = g
+	}
+
+	log, err := openLog(dir, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &WALBackend{
+		memory:     memory,
+		dir:        dir,
+		options:    options,
+		log:        log,
+		generation: generation,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	// left over when compaction was interrupted
+	removeGenerations(dir, snapshot)
+
+	go b.run()
+
+	return b, nil
+}
+
+func (b *WALBackend) Put(key string, record *Record) error {
+	return b.change(func() ([]byte, error) {
+		return putFrame(key, record)
+	}, func() {
+		b.memory.Put(key, record)
+	})
+}
+
+func (b *WALBackend) Create(key string, record *Record) error {
+	return b.change(func() ([]byte, error) {
+		if b.memory.stored(key) {
+			return nil, ErrExists
+		}
+		return putFrame(key, record)
+	}, func() {
+		b.memory.Put(key, record)
+	})
+}
+
+func (b *WALBackend) Get(key string) (*Record, error) {
+	return b.memory.Get(key)
+}
+
+func (b *WALBackend) Update(key string, fn func(record *Record) error) error {
+	var updated *Record
+	return b.change(func() ([]byte, error) {
+		record, err := b.memory.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(record); err != nil {
+			return nil, err
+		}
+		updated = record
+		return putFrame(key, record)
+	}, func() {
+		b.memory.Put(key, updated)
+	})
+}
+
+func (b *WALBackend) Rename(from, to string) error {
+	return b.change(func() ([]byte, error) {
+		if !b.memory.stored(from) {
+			return nil, ErrNotFound
+		}
+		if b.memory.stored(to) {
+			return nil, ErrExists
+		}
+		return encodeFrame(opRename, from, []byte(to)), nil
+	}, func() {
+		b.memory.Rename(from, to)
+	})
+}
+
+func (b *WALBackend) Delete(key string) error {
+	return b.change(func() ([]byte, error) {
+		return encodeFrame(opDelete, key, nil), nil
+	}, func() {
+		b.memory.Delete(key)
+	})
+}
+
+func (b *WALBackend) DeleteIf(key string, fn func(record *Record) error) error {
+	return b.change(func() ([]byte, error) {
+		record, err := b.memory.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(record); err != nil {
+			return nil, err
+		}
+		return encodeFrame(opDelete, key, nil), nil
+	}, func() {
+		b.memory.Delete(key)
+	})
+}
+
+// DeleteExpired logs the deletes of all purged records in a single write
+func (b *WALBackend) DeleteExpired(now time.Time) (int, error) {
+	expired := []string{}
+	err := b.change(func() ([]byte, error) {
+		frames := []byte(nil)
+
+		b.memory.lock.RLock()
+		for key, record := range b.memory.storage {
+			if record.gone(now) {
+				expired = append(expired, key)
+				frames = append(frames, encodeFrame(opDelete, key, nil)...)
+			}
+		}
+		b.memory.lock.RUnlock()
+
+		return frames, nil
+	}, func() {
+		for _, key := range expired {
+			b.memory.Delete(key)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+func (b *WALBackend) List() ([]string, error) {
+	return b.memory.List()
+}
+
+// Close compacts the log into a snapshot, so the next startup doesn't have to
+// replay it
+func (b *WALBackend) Close() error {
+	close(b.stop)
+	<-b.done
+
+	err := b.Snapshot()
+	if closeErr := b.log.close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// change logs the frames returned by check and applies them, and waits for
+// them to be flushed as the sync policy asks for. Nothing is logged or
+// applied if check returns an error or no frames
+func (b *WALBackend) change(check func() ([]byte, error), apply func()) error {
+	b.lock.Lock()
+
+	frame, err := check()
+	if err != nil || len(frame) == 0 {
+		b.lock.Unlock()
+		return err
+	}
+
+	log := b.log
+	seq, err := log.append(frame)
+	if err == nil && b.options.Sync == SyncAlways {
+		err = log.sync(seq)
+	}
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+
+	apply()
+	b.lock.Unlock()
+
+	if b.options.Sync == SyncBatched {
+		return log.sync(seq)
+	}
+
+	return nil
+}
+
+// Snapshot compacts the log. Changes go to a new log from now on, and the
+// records as they are at the switch are written to a snapshot that replaces
+// the old log
+func (b *WALBackend) Snapshot() error {
+	b.snapshotLock.Lock()
+	defer b.snapshotLock.Unlock()
+
+	b.lock.Lock()
+	if b.log.empty() {
+		b.lock.Unlock()
+		return nil
+	}
+
+	// the old log must be on disk before the next one exists, a torn frame
+	// may only end the last log
+	if err := b.log.flush(); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+
+	generation := b.generation + 1
+	log, err := openLog(b.dir, generation)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	old := b.log
+	b.log, b.generation = log, generation
+
+	// records are replaced rather than changed in place, so the snapshot can
+	// share them with the backend
+	now := time.Now()
+	b.memory.lock.RLock()
+	records := make(map[string]*Record, len(b.memory.storage))
+	for key, record := range b.memory.storage {
+		if !record.gone(now) {
+			records[key] = record
+		}
+	}
+	b.memory.lock.RUnlock()
+	b.lock.Unlock()
+
+	// the snapshot holds everything in the old log, it is only closed to
+	// release the file and wake up changes waiting for a flush
+	if err := old.close(); err != nil {
+		slog.Default().Warn("failed to close write-ahead log", "error", err)
+	}
+
+	if err := writeSnapshot(b.dir, generation, records); err != nil {
+		return err
+	}
+	removeGenerations(b.dir, generation)
+
+	return nil
+}
+
+// run flushes the log and takes snapshots in the background until Close
+func (b *WALBackend) run() {
+	defer close(b.done)
+
+	var syncs, snapshots <-chan time.Time
+	if b.options.Sync == SyncInterval {
+		ticker := time.NewTicker(b.options.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+	if b.options.SnapshotInterval > 0 {
+		ticker := time.NewTicker(b.options.SnapshotInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-syncs:
+			b.lock.Lock()
+			log := b.log
+			b.lock.Unlock()
+			if err := log.flush(); err != nil {
+				slog.Default().Error("failed to flush write-ahead log", "error", err)
+			}
+		case <-snapshots:
+			if err := b.Snapshot(); err != nil {
+				slog.Default().Error("failed to snapshot write-ahead log", "error", err)
+			}
+		}
+	}
+}
+
+// logFile is a write-ahead log frames are appended to. Frames are counted, so
+// concurrent changes can share a flush. Once a write or flush has failed the
+// log refuses all further changes, as it can't tell what made it to disk
+type logFile struct {
+	file *os.File
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	size    int64
+	written uint64
+	synced  uint64
+	syncing bool
+	err     error
+}
+
+// openLog opens the log of a generation for appending, creating it if needed
+func openLog(dir string, generation uint64) (*logFile, error) {
+	path := logPath(dir, generation)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open write-ahead log %s", path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to stat write-ahead log %s", path)
+	}
+
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &logFile{file: file, size: info.Size()}
+	l.cond = sync.NewCond(&l.lock)
+
+	return l, nil
+}
+
+// append writes one or more frames and returns their sequence number to wait
+// for with sync
+func (l *logFile) append(frame []byte) (uint64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	if _, err := l.file.Write(frame); err != nil {
+		l.err = errors.Wrap(err, "failed to write to the write-ahead log")
+		return 0, l.err
+	}
+	l.size += int64(len(frame))
+	l.written++
+
+	return l.written, nil
+}
+
+// sync waits until the frame numbered seq is on disk. Only one flush runs at
+// a time, the frames written while it runs are flushed together by the next
+func (l *logFile) sync(seq uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.synced < seq && l.err == nil {
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+
+		l.syncing = true
+		target := l.written
+		l.lock.Unlock()
+		err := l.file.Sync()
+		l.lock.Lock()
+		l.syncing = false
+
+		if err != nil {
+			l.err = errors.Wrap(err, "failed to flush the write-ahead log")
+		} else {
+			l.synced = target
+		}
+		l.cond.Broadcast()
+	}
+
+	if l.synced >= seq {
+		return nil
+	}
+	return l.err
+}
+
+// flush waits until every frame written so far is on disk
+func (l *logFile) flush() error {
+	l.lock.Lock()
+	written := l.written
+	l.lock.Unlock()
+
+	return l.sync(written)
+}
+
+func (l *logFile) empty() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.size == 0
+}
+
+func (l *logFile) close() error {
+	err := l.flush()
+	if closeErr := l.file.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "failed to close the write-ahead log")
+	}
+
+	return err
+}
+
+func encodeFrame(op byte, key string, value []byte) []byte {
+	length := 1 + 4 + len(key) + len(value)
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+length)
+	frame = append(frame, op)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(key)))
+	frame = append(frame, key...)
+	frame = append(frame, value...)
+
+	binary.BigEndian.PutUint32(frame[0:], uint32(length))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(frame[frameHeaderSize:], castagnoli))
+
+	return frame
+}
+
+func putFrame(key string, record *Record) ([]byte, error) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal record")
+	}
+
+	return encodeFrame(opPut, key, value), nil
+}
+
+// readFrames calls fn with every frame in r, a file of the given size, and
+// returns the length of the intact frames at its start. A frame that is cut
+// short or doesn't match its checksum ends them
+func readFrames(r io.Reader, size int64, fn func(op byte, key string, value []byte) error) (int64, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, frameHeaderSize)
+
+	var offset int64
+	for {
+		if _, err := io.ReadFull(br, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+
+		// a torn length must not make us allocate more than is left
+		length := int64(binary.BigEndian.Uint32(header))
+		if length < 5 || offset+frameHeaderSize+length > size {
+			return offset, nil
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(br, body); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+		if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(header[4:]) {
+			return offset, nil
+		}
+
+		keyLength := int64(binary.BigEndian.Uint32(body[1:]))
+		if 5+keyLength > length {
+			return offset, nil
+		}
+
+		if err := fn(body[0], string(body[5:5+keyLength]), body[5+keyLength:]); err != nil {
+			return offset, err
+		}
+		offset += frameHeaderSize + length
+	}
+}
+
+// applyFrame replays a logged change onto storage
+func applyFrame(storage map[string]*Record, op byte, key string, value []byte) error {
+	switch op {
+	case opPut:
+		record := &Record{}
+		if err := json.Unmarshal(value, record); err != nil {
+			return errors.Wrapf(err, "failed to unmarshal record %s", key)
+		}
+		storage[key] = record
+	case opDelete:
+		delete(storage, key)
+	case opRename:
+		if record, ok := storage[key]; ok {
+			storage[string(value)] = record
+			delete(storage, key)
+		}
+	default:
+		return errors.Errorf("unknown write-ahead log operation %d", op)
+	}
+
+	return nil
+}
+
+// replayLog applies the frames of a log onto storage. A torn frame may only
+// end the last log, or one only followed by empty logs, it is truncated away
+// so new frames follow intact ones
+func replayLog(path string, storage map[string]*Record, last bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open write-ahead log %s", path)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat write-ahead log %s", path)
+	}
+
+	intact, err := readFrames(file, info.Size(), func(op byte, key string, value []byte) error {
+		return applyFrame(storage, op, key, value)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to replay write-ahead log %s", path)
+	}
+	if intact == info.Size() {
+		return nil
+	}
+
+	if !last {
+		return errors.Errorf("write-ahead log %s is corrupt at offset %d", path, intact)
+	}
+	if err := os.Truncate(path, intact); err != nil {
+		return errors.Wrapf(err, "failed to truncate write-ahead log %s", path)
+	}
+	slog.Default().Warn("truncated torn frame at the end of the write-ahead log", "path", path, "offset", intact, "bytes", info.Size()-intact)
+
+	return nil
+}
+
+// loadSnapshot reads a snapshot into storage. Snapshots are only renamed into
+// place once complete, so unlike a log a snapshot must be intact
+// emptyLogs reports whether the logs of all the generations are empty. A
+// crash right after a snapshot opened the next log leaves it empty
+func emptyLogs(dir string, generations []uint64) bool {
+	for _, g := range generations {
+		info, err := os.Stat(logPath(dir, g))
+		if err != nil || info.Size() > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func loadSnapshot(path string, storage map[string]*Record) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open snapshot %s", path)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat snapshot %s", path)
+	}
+
+	intact, err := readFrames(file, info.Size(), func(op byte, key string, value []byte) error {
+		if op != opPut {
+			return errors.Errorf("unexpected operation %d", op)
+		}
+		return applyFrame(storage, op, key, value)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to load snapshot %s", path)
+	}
+	if intact != info.Size() {
+		return errors.Errorf("snapshot %s is corrupt at offset %d", path, intact)
+	}
+
+	return nil
+}
+
+// writeSnapshot writes records to a temporary file and renames it into place
+// once it is on disk
+func writeSnapshot(dir string, generation uint64, records map[string]*Record) error {
+	path := snapshotPath(dir, generation)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create snapshot %s", tmp)
+	}
+
+	err = func() error {
+		w := bufio.NewWriter(file)
+		for key, record := range records {
+			frame, err := putFrame(key, record)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to write snapshot %s", tmp)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to rename snapshot %s", tmp)
+	}
+
+	return syncDir(dir)
+}
+
+// listGenerations returns the sorted generations of the snapshots and logs in
+// dir, and removes snapshots that were never completed
+func listGenerations(dir string) (snapshots, logs []uint64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to read write-ahead log directory %s", dir)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if g, ok := parseGeneration(name, "snapshot-"); ok {
+			snapshots = append(snapshots, g)
+		} else if g, ok := parseGeneration(name, "wal-"); ok {
+			logs = append(logs, g)
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+
+	return snapshots, logs, nil
+}
+
+// removeGenerations removes the snapshots and logs older than generation,
+// which are covered by its snapshot
+func removeGenerations(dir string, generation uint64) {
+	snapshots, logs, err := listGenerations(dir)
+	if err != nil {
+		return
+	}
+
+	for _, g := range snapshots {
+		if g < generation {
+			os.Remove(snapshotPath(dir, g))
+		}
+	}
+	for _, g := range logs {
+		if g < generation {
+			os.Remove(logPath(dir, g))
+		}
+	}
+}
+
+func parseGeneration(name, prefix string) (uint64, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+
+	g, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 16, 64)
+	return g, err == nil
+}
+
+func snapshotPath(dir string, generation uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("snapshot-%016x", generation))
+}
+
+func logPath(dir string, generation uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%016x", generation))
+}
+
+// syncDir flushes dir, so files created or renamed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open directory %s", dir)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync directory %s", dir)
+	}
+
+	return nil
+}
@@ -7,14 +7,66 @@ import (
 
 type Config struct {
 	Service ServiceConf
+	Backend BackendConf
+	TLS     TLSConf
+	Hash    HashConf
 }
 
 // DBConf - DB config
 
 type ServiceConf struct {
-	Port  string `env:"LISTEN_PORT" envDefault:"8081"`
-	Debug bool   `env:"DEBUG" envDefault:"false"`
-	Salt  string `env:"HASH_SALT" envDefault:"kjhsdifuheyoes"`
+	Port            string `env:"LISTEN_PORT" envDefault:"8081"`
+	Debug           bool   `env:"DEBUG" envDefault:"false"`
+	ShutdownTimeout int    `env:"SHUTDOWN_TIMEOUT" envDefault:"30"`
+	SweepInterval   int    `env:"SWEEP_INTERVAL" envDefault:"60"`
+	// MaxBodyBytes limits the request bodies read into memory, 0 disables the
+	// limit. Raw stores to a backend that streams payloads aren't limited
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES" envDefault:"67108864"`
+}
+
+// TLSConf - TLS is enabled when CertFile is set, mutual TLS when
+// ClientCAFile is set as well
+
+type TLSConf struct {
+	CertFile     string `env:"TLS_CERT_FILE"`
+	KeyFile      string `env:"TLS_KEY_FILE"`
+	ClientCAFile string `env:"TLS_CLIENT_CA_FILE"`
+}
+
+// HashConf - secrets ids are hashed with into storage keys. Keyed hashing is
+// enabled when File is set, otherwise ids are hashed with the legacy Salt.
+// Legacy keeps finding records stored under the salted hash after keyed
+// hashing is enabled
+
+type HashConf struct {
+	File          string   `env:"HASH_KEY_FILE"`
+	PreviousFiles []string `env:"PREVIOUS_HASH_KEY_FILES" envSeparator:","`
+	Salt          string   `env:"HASH_SALT" envDefault:"kjhsdifuheyoes"`
+	Legacy        bool     `env:"LEGACY_HASH" envDefault:"true"`
+}
+
+// BackendConf - the memory backend is made durable by setting WALDir. Sync is
+// always, batched or interval, the intervals are in milliseconds and seconds.
+// The S3 backend addresses buckets path-style unless S3PathStyle is false
+
+type BackendConf struct {
+	Type                string `env:"STORAGE_BACKEND" envDefault:"memory"`
+	BoltPath            string `env:"BOLT_PATH" envDefault:"storage.db"`
+	SQLitePath          string `env:"SQLITE_PATH" envDefault:"storage.sqlite"`
+	FilesRoot           string `env:"FILES_ROOT" envDefault:"storage"`
+	WALDir              string `env:"WAL_DIR"`
+	WALSync             string `env:"WAL_SYNC" envDefault:"always"`
+	WALSyncInterval     int    `env:"WAL_SYNC_INTERVAL_MS" envDefault:"100"`
+	WALSnapshotInterval int    `env:"WAL_SNAPSHOT_INTERVAL" envDefault:"300"`
+	S3Endpoint          string `env:"S3_ENDPOINT"`
+	S3Bucket            string `env:"S3_BUCKET"`
+	S3Region            string `env:"S3_REGION" envDefault:"us-east-1"`
+	S3AccessKey         string `env:"S3_ACCESS_KEY"`
+	S3SecretKey         string `env:"S3_SECRET_KEY"`
+	S3SessionToken      string `env:"S3_SESSION_TOKEN"`
+	S3PathStyle         bool   `env:"S3_PATH_STYLE" envDefault:"true"`
+	S3Prefix            string `env:"S3_PREFIX"`
+	S3TempDir           string `env:"S3_TEMP_DIR"`
 }
 
 func Get() (*Config, error) {
@@ -24,5 +76,17 @@ func Get() (*Config, error) {
 		return nil, errors.Wrap(err, "Failed to load Service config")
 	}
 
+	if err := env.Parse(&cfg.Backend); err != nil {
+		return nil, errors.Wrap(err, "Failed to load Backend config")
+	}
+
+	if err := env.Parse(&cfg.TLS); err != nil {
+		return nil, errors.Wrap(err, "Failed to load TLS config")
+	}
+
+	if err := env.Parse(&cfg.Hash); err != nil {
+		return nil, errors.Wrap(err, "Failed to load Hash config")
+	}
+
 	return cfg, nil
 }
@@ -0,0 +1,244 @@
+package idhash
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LegacyGeneration names the salted SHA-512 hashes ids were stored under
+// before keyed hashing
+const LegacyGeneration = "legacy"
+
+// generationInfo is hashed with a secret to name its generation, so the name
+// doesn't reveal anything about the secret
+var generationInfo = []byte("akh-dev/encrypt id hash generation")
+
+// refInfo is hashed with a secret into the key ids are sealed with
+var refInfo = []byte("akh-dev/encrypt id reference")
+
+var ErrInvalidRef = errors.New("invalid id reference")
+
+// Hasher turns the ids of texts into the keys their records are stored under.
+// Ids are hashed with HMAC-SHA-512 keyed with the current secret, previous
+// secrets and the legacy salted hash are only kept to find records stored
+// before a rotation. A hash is prefixed with the generation of its secret:
+//
+//	<generation>.<base64url HMAC-SHA-512(secret, id)>
+//
+// legacy hashes have no prefix.
+//
+// A record also keeps a reference to its id sealed with the secret, so it can
+// be hashed again under a new secret without its id being looked up:
+//
+//	<generation>.<nonce><AES-256-GCM(HMAC-SHA-512(secret, refInfo)[:32], id)>
+type Hasher struct {
+	generations []generation
+}
+
+// generation is one way of hashing ids, the current one comes first. ref is
+// nil for the legacy generation, which has no secret to seal ids with
+type generation struct {
+	name string
+	hash func(id string) string
+	ref  cipher.AEAD
+}
+
+func New(current []byte, previous ...[]byte) *Hasher {
+	h := &Hasher{}
+	for _, secret := range append([][]byte{current}, previous...) {
+		h.generations = append(h.generations, keyed(secret))
+	}
+
+	return h
+}
+
+// NewLegacy creates a hasher using only the legacy salted SHA-512 hash, for
+// deployments without a secret
+func NewLegacy(salt string) *Hasher {
+	return &Hasher{generations: []generation{legacy(salt)}}
+}
+
+// Load reads the current and previous secrets from keyfiles. A keyfile
+// contains either the 32 raw secret bytes or their base64 encoding
+func Load(currentFile string, previousFiles []string) (*Hasher, error) {
+	current, err := readKeyFile(currentFile)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := [][]byte{}
+	for _, file := range previousFiles {
+		secret, err := readKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, secret)
+	}
+
+	return New(current, previous...), nil
+}
+
+// WithLegacy adds the legacy salted hash as the oldest generation, to find
+// records stored before keyed hashing
+func (h *Hasher) WithLegacy(salt string) *Hasher {
+	h.generations = append(h.generations, legacy(salt))
+	return h
+}
+
+// Hash returns the key the record of id is stored under
+func (h *Hasher) Hash(id string) string {
+	return h.generations[0].hash(id)
+}
+
+// Previous returns the keys the record of id may have been stored under
+// before a rotation, newest generation first
+func (h *Hasher) Previous(id string) []string {
+	hashes := make([]string, 0, len(h.generations)-1)
+	for _, g := range h.generations[1:] {
+		hashes = append(hashes, g.hash(id))
+	}
+
+	return hashes
+}
+
+// Current returns the name of the current generation
+func (h *Hasher) Current() string {
+	return h.generations[0].name
+}
+
+// Known reports whether generation is the current or a previous one
+func (h *Hasher) Known(generation string) bool {
+	return h.find(generation) != nil
+}
+
+// Seal returns a reference to id sealed with the current secret, to be
+// stored with its record. It returns nil if the current generation is legacy
+func (h *Hasher) Seal(id string) ([]byte, error) {
+	g := h.generations[0]
+	if g.ref == nil {
+		return nil, nil
+	}
+
+	nonce := make([]byte, g.ref.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to create nonce")
+	}
+
+	ref := append([]byte(g.name+"."), nonce...)
+	return g.ref.Seal(ref, nonce, []byte(id), []byte(g.name)), nil
+}
+
+// Open returns the id a reference returned by Seal refers to. The id must
+// hash to key, so a reference can't be moved to another record. It returns
+// ErrInvalidRef if the reference doesn't belong to key or was sealed with a
+// secret the hasher doesn't know anymore
+func (h *Hasher) Open(key string, ref []byte) (string, error) {
+	i := bytes.IndexByte(ref, '.')
+	if i < 0 {
+		return "", ErrInvalidRef
+	}
+	name, sealed := string(ref[:i]), ref[i+1:]
+
+	sealedBy, hashedBy := h.find(name), h.find(h.Generation(key))
+	if sealedBy == nil || sealedBy.ref == nil || hashedBy == nil {
+		return "", ErrInvalidRef
+	}
+
+	nonceSize := sealedBy.ref.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", ErrInvalidRef
+	}
+	id, err := sealedBy.ref.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil || hashedBy.hash(string(id)) != key {
+		return "", ErrInvalidRef
+	}
+
+	return string(id), nil
+}
+
+// find returns the generation of the given name, nil if the hasher doesn't
+// know it
+func (h *Hasher) find(name string) *generation {
+	for i := range h.generations {
+		if h.generations[i].name == name {
+			return &h.generations[i]
+		}
+	}
+	return nil
+}
+
+// Generation returns the name of the generation a key was hashed with, which
+// may be one the hasher doesn't know anymore
+func (h *Hasher) Generation(key string) string {
+	if i := strings.IndexByte(key, '.'); i >= 0 {
+		return key[:i]
+	}
+
+	return LegacyGeneration
+}
+
+func keyed(secret []byte) generation {
+	mac := hmac.New(sha512.New, secret)
+	mac.Write(generationInfo)
+	name := hex.EncodeToString(mac.Sum(nil)[:4])
+
+	mac = hmac.New(sha512.New, secret)
+	mac.Write(refInfo)
+	// a 32 byte key and the standard nonce size can't fail
+	block, _ := aes.NewCipher(mac.Sum(nil)[:32])
+	ref, _ := cipher.NewGCM(block)
+
+	return generation{
+		name: name,
+		ref:  ref,
+		hash: func(id string) string {
+			mac := hmac.New(sha512.New, secret)
+			mac.Write([]byte(id))
+			return name + "." + base64.URLEncoding.EncodeToString(mac.Sum(nil))
+		},
+	}
+}
+
+func legacy(salt string) generation {
+	return generation{
+		name: LegacyGeneration,
+		hash: func(id string) string {
+			hasher := sha512.New()
+			saltedKey := fmt.Sprintf("%sx%s", id, salt)
+			hasher.Write([]byte(saltedKey))
+			return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+		},
+	}
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read keyfile %s", path)
+	}
+
+	if len(data) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, errors.Errorf("keyfile %s must contain 32 raw bytes or their base64 encoding", path)
+		}
+		data = decoded
+	}
+	if len(data) != 32 {
+		return nil, errors.Errorf("keyfile %s must contain a 32 byte secret, got %d bytes", path, len(data))
+	}
+
+	return data, nil
+}
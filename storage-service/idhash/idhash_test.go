@@ -0,0 +1,133 @@
+package idhash
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	oldSecret = bytes.Repeat([]byte{0x01}, 32)
+	newSecret = bytes.Repeat([]byte{0x02}, 32)
+)
+
+func TestRotation(t *testing.T) {
+	old := New(oldSecret)
+	rotated := New(newSecret, oldSecret).WithLegacy("salt")
+
+	hash := old.Hash("my-1st-text")
+	if hash != New(oldSecret).Hash("my-1st-text") {
+		t.Error("the same secret hashed an id differently")
+	}
+	if hash == old.Hash("my-2nd-text") {
+		t.Error("different ids hashed the same")
+	}
+	if !strings.HasPrefix(hash, old.Current()+".") {
+		t.Errorf("expected the hash to be prefixed with its generation %s, got %s", old.Current(), hash)
+	}
+
+	if rotated.Hash("my-1st-text") == hash {
+		t.Error("the id hashed the same after a rotation")
+	}
+	if rotated.Current() == old.Current() {
+		t.Error("the generation wasn't renamed after a rotation")
+	}
+
+	sum := sha512.Sum512([]byte("my-1st-textxsalt"))
+	legacyHash := base64.URLEncoding.EncodeToString(sum[:])
+
+	previous := rotated.Previous("my-1st-text")
+	if len(previous) != 2 || previous[0] != hash || previous[1] != legacyHash {
+		t.Errorf("expected the previous hashes %s and %s, got %v", hash, legacyHash, previous)
+	}
+	if NewLegacy("salt").Hash("my-1st-text") != legacyHash {
+		t.Error("legacy hash doesn't match the salted SHA-512 of the id")
+	}
+	if len(NewLegacy("salt").Previous("my-1st-text")) != 0 {
+		t.Error("expected no previous hashes without a rotation")
+	}
+
+	if g := rotated.Generation(hash); g != old.Current() {
+		t.Errorf("expected generation %s, got %s", old.Current(), g)
+	}
+	if g := rotated.Generation(rotated.Hash("my-1st-text")); g != rotated.Current() {
+		t.Errorf("expected generation %s, got %s", rotated.Current(), g)
+	}
+	if g := rotated.Generation(legacyHash); g != LegacyGeneration {
+		t.Errorf("expected generation %s, got %s", LegacyGeneration, g)
+	}
+	if !rotated.Known(old.Current()) || !rotated.Known(LegacyGeneration) || old.Known(LegacyGeneration) {
+		t.Error("previous generations weren't reported as known")
+	}
+}
+
+func TestRef(t *testing.T) {
+	old := New(oldSecret)
+	rotated := New(newSecret, oldSecret)
+
+	ref, err := old.Seal("my-1st-text")
+	if err != nil {
+		t.Fatalf("failed to seal id : %s", err.Error())
+	}
+
+	// a rotated hasher still opens references of its previous secrets, for
+	// records under the previous hash
+	for _, h := range []*Hasher{old, rotated} {
+		id, err := h.Open(old.Hash("my-1st-text"), ref)
+		if err != nil || id != "my-1st-text" {
+			t.Errorf("expected id my-1st-text, got %q (%v)", id, err)
+		}
+	}
+
+	if _, err := old.Open(old.Hash("my-2nd-text"), ref); err != ErrInvalidRef {
+		t.Errorf("expected %v for the reference of another record, got %v", ErrInvalidRef, err)
+	}
+	if _, err := New(newSecret).Open(old.Hash("my-1st-text"), ref); err != ErrInvalidRef {
+		t.Errorf("expected %v for a retired secret, got %v", ErrInvalidRef, err)
+	}
+	tampered := append([]byte(nil), ref...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := old.Open(old.Hash("my-1st-text"), tampered); err != ErrInvalidRef {
+		t.Errorf("expected %v for a tampered reference, got %v", ErrInvalidRef, err)
+	}
+
+	if ref, err := NewLegacy("salt").Seal("my-1st-text"); err != nil || ref != nil {
+		t.Errorf("expected no reference under the legacy hash, got %v (%v)", ref, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	rawFile := filepath.Join(dir, "raw.key")
+	if err := ioutil.WriteFile(rawFile, newSecret, 0600); err != nil {
+		t.Fatalf("failed to write keyfile : %s", err.Error())
+	}
+	encodedFile := filepath.Join(dir, "encoded.key")
+	if err := ioutil.WriteFile(encodedFile, []byte(base64.StdEncoding.EncodeToString(oldSecret)+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write keyfile : %s", err.Error())
+	}
+
+	loaded, err := Load(rawFile, []string{encodedFile})
+	if err != nil {
+		t.Fatalf("failed to load keyfiles : %s", err.Error())
+	}
+	if loaded.Hash("id") != New(newSecret).Hash("id") || loaded.Previous("id")[0] != New(oldSecret).Hash("id") {
+		t.Error("loaded secrets don't match the written ones")
+	}
+
+	shortFile := filepath.Join(dir, "short.key")
+	if err := ioutil.WriteFile(shortFile, []byte("too short"), 0600); err != nil {
+		t.Fatalf("failed to write keyfile : %s", err.Error())
+	}
+	if _, err := Load(shortFile, nil); err == nil {
+		t.Error("expected an error for a short keyfile but got success")
+	}
+	if _, err := Load(filepath.Join(dir, "missing.key"), nil); err == nil {
+		t.Error("expected an error for a missing keyfile but got success")
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/akh-dev/encrypt/logging"
+	"github.com/akh-dev/encrypt/storage-service/backend"
 	"github.com/akh-dev/encrypt/storage-service/config"
 	"github.com/akh-dev/encrypt/storage-service/service"
 )
@@ -15,14 +21,40 @@ func main() {
 		log.Fatalf("Failed to load config: %+v", err)
 	}
 
-	storageService, err := service.New(cfg)
+	logger := logging.New(os.Stderr, cfg.Service.Debug)
+	slog.SetDefault(logger)
+
+	storageBackend, err := backend.New(&cfg.Backend)
 	if err != nil {
-		log.Fatalf("Failed to initialise storage service: %+v", err)
+		log.Fatalf("Failed to initialise storage backend: %+v", err)
 	}
 
-	storageService.ListenAndServe()
+	storageService, err := service.New(cfg, storageBackend, logger)
+	if err != nil {
+		log.Fatalf("Failed to initialise storage service: %+v", err)
+	}
 
-	log.Println("Storage-Service started, press <ENTER> to exit")
-	fmt.Scanln()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := storageService.ReloadCertificates(); err != nil {
+				logger.Error("failed to reload certificates", "error", err)
+				continue
+			}
+			logger.Info("certificates reloaded")
+		}
+	}()
+
+	// the service owns the backend from here on and closes it on shutdown
+	logger.Info("Storage-Service starting, send SIGINT or SIGTERM to stop")
+	if err := storageService.Run(ctx); err != nil {
+		logger.Error("Storage-Service failed", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Storage-Service stopped")
 
 }
@@ -1,8 +1,9 @@
 package service
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/akh-dev/encrypt/storage-service/api"
@@ -39,46 +40,113 @@ func respondNotFound(w http.ResponseWriter, errors []string) {
 	writeResponse(w, respObj)
 }
 
+func respondConflict(w http.ResponseWriter, errors []string) {
+	w.WriteHeader(http.StatusConflict)
+	respObj := &api.Response{
+		StatusCode:    http.StatusConflict,
+		StatusMessage: http.StatusText(http.StatusConflict),
+		Errors:        errors,
+	}
+	writeResponse(w, respObj)
+}
+
+func respondPayloadTooLarge(w http.ResponseWriter, errors []string) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	respObj := &api.Response{
+		StatusCode:    http.StatusRequestEntityTooLarge,
+		StatusMessage: http.StatusText(http.StatusRequestEntityTooLarge),
+		Errors:        errors,
+	}
+	writeResponse(w, respObj)
+}
+
 func writeResponse(w http.ResponseWriter, respObj *api.Response) {
 	response, err := json.Marshal(respObj)
 	if err != nil {
-		log.Println(err.Error())
+		slog.Error("failed to marshal response", "error", err)
 		return
 	}
 
-	n, err := w.Write(response)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	if _, err := w.Write(response); err != nil {
+		slog.Warn("failed to write response", "error", err)
 	}
-
-	log.Printf("wrote %d bytes in the response", n)
 }
 
 func writeCommonHeaders(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json")
 }
 
-func parseStoreRequest(r *http.Request) (*api.IdMessage, error) {
+// parseStoreRequest reads a store request with a JSON or raw body, depending
+// on its content type, and returns it together with the decoded payload
+func parseStoreRequest(r *http.Request) (*api.IdMessage, []byte, error) {
+	if sendsRawPayload(r) {
+		return parseRawStoreRequest(r)
+	}
+
 	dec := json.NewDecoder(r.Body)
 	storeReq := &api.IdMessage{}
 	if err := dec.Decode(storeReq); err != nil {
-		err = errors.Wrap(err, "failed to parse Store request")
-		log.Println(err.Error())
-		return nil, err
+		return nil, nil, errors.Wrap(err, "failed to parse Store request")
 	}
 
-	return storeReq, nil
+	payload, err := base64.StdEncoding.DecodeString(storeReq.Payload)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "malformed payload, failed to decode from base64")
+	}
+
+	return storeReq, payload, nil
 }
 
 func parseRetrieveRequest(r *http.Request) (*api.Id, error) {
+	if id := r.Header.Get(api.IdHeader); id != "" {
+		return &api.Id{Id: id}, nil
+	}
+
 	dec := json.NewDecoder(r.Body)
 	retrieveReq := &api.Id{}
 	if err := dec.Decode(retrieveReq); err != nil {
-		err = errors.Wrap(err, "failed to parse Retrieve request")
-		log.Println(err.Error())
-		return nil, err
+		return nil, errors.Wrap(err, "failed to parse Retrieve request")
 	}
 
 	return retrieveReq, nil
 }
+
+func parseMetadataRequest(r *http.Request) (*api.MetadataUpdate, error) {
+	dec := json.NewDecoder(r.Body)
+	metadataReq := &api.MetadataUpdate{}
+	if err := dec.Decode(metadataReq); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Metadata request")
+	}
+
+	return metadataReq, nil
+}
+
+func parseDeleteRequest(r *http.Request) (*api.DeleteRequest, error) {
+	dec := json.NewDecoder(r.Body)
+	deleteReq := &api.DeleteRequest{}
+	if err := dec.Decode(deleteReq); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Delete request")
+	}
+
+	return deleteReq, nil
+}
+
+func parseScanRequest(r *http.Request) (*api.ScanRequest, error) {
+	dec := json.NewDecoder(r.Body)
+	scanReq := &api.ScanRequest{}
+	if err := dec.Decode(scanReq); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Scan request")
+	}
+
+	return scanReq, nil
+}
+
+func parseConsumeRequest(r *http.Request) (*api.ConsumeRequest, error) {
+	dec := json.NewDecoder(r.Body)
+	consumeReq := &api.ConsumeRequest{}
+	if err := dec.Decode(consumeReq); err != nil {
+		return nil, errors.Wrap(err, "failed to parse Consume request")
+	}
+
+	return consumeReq, nil
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/encrypt/logging"
+	"github.com/akh-dev/encrypt/storage-service/api"
+	"github.com/akh-dev/encrypt/storage-service/backend"
+)
+
+// parseRawStoreRequest reads a store request with an application/octet-stream
+// body holding the ciphertext. Its other fields travel in headers
+func parseRawStoreRequest(r *http.Request) (*api.IdMessage, []byte, error) {
+	storeReq, err := parseRawStoreHeaders(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the body is read only once the headers are known to be fine
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read payload")
+	}
+
+	return storeReq, payload, nil
+}
+
+// parseRawStoreHeaders reads the fields of a raw store request, leaving the
+// ciphertext in the body
+func parseRawStoreHeaders(r *http.Request) (*api.IdMessage, error) {
+	storeReq := &api.IdMessage{
+		Id: r.Header.Get(api.IdHeader),
+	}
+
+	ttlSeconds, err := optionalInt(api.TTLSecondsHeader, r.Header.Get(api.TTLSecondsHeader))
+	if err != nil {
+		return nil, err
+	}
+	storeReq.TTLSeconds = int64(ttlSeconds)
+
+	if storeReq.MaxReads, err = optionalInt(api.MaxReadsHeader, r.Header.Get(api.MaxReadsHeader)); err != nil {
+		return nil, err
+	}
+	if storeReq.IfMatch, err = optionalInt(api.IfMatchHeader, r.Header.Get(api.IfMatchHeader)); err != nil {
+		return nil, err
+	}
+
+	if metadata := r.Header.Get(api.MetadataHeader); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &storeReq.Metadata); err != nil {
+			return nil, errors.Wrapf(err, "malformed %s", api.MetadataHeader)
+		}
+	}
+
+	return storeReq, nil
+}
+
+// optionalInt parses a numeric header, a missing header is zero
+func optionalInt(name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "malformed %s", name)
+	}
+
+	return n, nil
+}
+
+// sendsRawPayload reports whether the body of the request is the raw
+// ciphertext rather than JSON
+func sendsRawPayload(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == api.ContentTypeOctetStream
+}
+
+// acceptsRawPayload reports whether the request asks for the ciphertext as
+// the raw response body rather than as a base64 JSON string
+func acceptsRawPayload(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == api.ContentTypeOctetStream {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeRawRecord writes the ciphertext of a record as the response body and
+// its other fields as headers
+func writeRawRecord(w http.ResponseWriter, id string, record *backend.Record) {
+	if !writeRawHeaders(w, id, record, int64(len(record.Payload))) {
+		return
+	}
+
+	if _, err := w.Write(record.Payload); err != nil {
+		slog.Warn("failed to write response", "error", err)
+	}
+}
+
+// writeRawStream is writeRawRecord with the ciphertext, of the given size,
+// read from payload. Once the headers are sent a failure can only abort the
+// response, so the client sees a truncated body instead of a complete one
+func writeRawStream(ctx context.Context, w http.ResponseWriter, id string, record *backend.Record, size int64, payload io.Reader) {
+	if !writeRawHeaders(w, id, record, size) {
+		return
+	}
+
+	if _, err := io.Copy(w, payload); err != nil {
+		logging.FromContext(ctx).Warn("aborting streamed retrieve response", "id", id, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeRawHeaders writes the fields of a record as the headers of a response
+// with a payload of the given size. It responds with an error instead and
+// returns false if they can't be written
+func writeRawHeaders(w http.ResponseWriter, id string, record *backend.Record, size int64) bool {
+	if len(record.Metadata) > 0 {
+		metadata, err := json.Marshal(record.Metadata)
+		if err != nil {
+			slog.Error("failed to marshal metadata", "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+			return false
+		}
+		w.Header().Set(api.MetadataHeader, string(metadata))
+	}
+
+	w.Header().Set("Content-Type", api.ContentTypeOctetStream)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set(api.IdHeader, id)
+	w.Header().Set(api.VersionHeader, strconv.Itoa(record.Version))
+	if record.MaxReads > 0 {
+		w.Header().Set(api.MaxReadsHeader, strconv.Itoa(record.MaxReads))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	return true
+}
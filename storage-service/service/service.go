@@ -1,51 +1,286 @@
 package service
 
 import (
-	"crypto/sha512"
+	"bytes"
+	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"sync"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/akh-dev/encrypt/logging"
 	"github.com/akh-dev/encrypt/storage-service/api"
+	"github.com/akh-dev/encrypt/storage-service/backend"
 	"github.com/akh-dev/encrypt/storage-service/config"
+	"github.com/akh-dev/encrypt/storage-service/idhash"
 )
 
+// maxScanLimit is the largest page of records a scan request returns
+const maxScanLimit = 1000
+
 var (
-	lock          sync.RWMutex
-	NotFoundError = errors.New("text not found")
+	NotFoundError        = errors.New("text not found")
+	ExistsError          = errors.New("text already exists")
+	VersionMismatchError = errors.New("text version doesn't match")
 )
 
 type Service struct {
 	config  *config.Config
-	storage map[string]string
+	backend backend.Interface
+	// streamer is the backend's streaming methods, nil if it has none
+	streamer backend.Streamer
+	hasher   *idhash.Hasher
+	server   *http.Server
+	logger   *slog.Logger
+
+	serverCert *keyPair
+	clientCAs  atomic.Pointer[x509.CertPool]
 }
 
-func New(cfg *config.Config) (*Service, error) {
+func New(cfg *config.Config, b backend.Interface, logger *slog.Logger) (*Service, error) {
 	svc := &Service{
 		config:  cfg,
-		storage: map[string]string{},
+		backend: b,
+		logger:  logger,
+	}
+	svc.streamer, _ = b.(backend.Streamer)
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		var err error
+		svc.serverCert, err = newKeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load TLS certificate")
+		}
+
+		if cfg.TLS.ClientCAFile != "" {
+			pool, err := loadCertPool(cfg.TLS.ClientCAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to load TLS client CA")
+			}
+			svc.clientCAs.Store(pool)
+		}
+	} else if cfg.TLS.ClientCAFile != "" {
+		return nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	if cfg.Hash.File != "" {
+		hasher, err := idhash.Load(cfg.Hash.File, cfg.Hash.PreviousFiles)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load hash keys")
+		}
+		if cfg.Hash.Legacy {
+			hasher.WithLegacy(cfg.Hash.Salt)
+		}
+		svc.hasher = hasher
+	} else if len(cfg.Hash.PreviousFiles) > 0 {
+		return nil, errors.New("PREVIOUS_HASH_KEY_FILES requires HASH_KEY_FILE")
+	} else {
+		svc.hasher = idhash.NewLegacy(cfg.Hash.Salt)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", svc.defaultHandler)
+	mux.HandleFunc("/store", svc.handleStoreRequest)
+	mux.HandleFunc("/retrieve", svc.handleRetrieveRequest)
+	mux.HandleFunc("/metadata", svc.handleMetadataRequest)
+	mux.HandleFunc("/delete", svc.handleDeleteRequest)
+	mux.HandleFunc("/consume", svc.handleConsumeRequest)
+	mux.HandleFunc("/scan", svc.handleScanRequest)
+
+	svc.server = &http.Server{
+		Addr:      fmt.Sprintf(":%s", cfg.Service.Port),
+		Handler:   logging.Middleware(logger, mux),
+		TLSConfig: svc.serverTLSConfig(),
 	}
 
 	return svc, nil
 }
 
-func (s *Service) ListenAndServe() {
-	http.HandleFunc("/", s.defaultHandler)
-	http.HandleFunc("/store", s.handleStoreRequest)
-	http.HandleFunc("/retrieve", s.handleRetrieveRequest)
+// Run serves requests until ctx is cancelled and then shuts the service down
+// gracefully. It returns an error if the service can't start, e.g. because
+// the port is already in use
+func (s *Service) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", s.server.Addr)
+	}
+	s.logger.Info("listening", "addr", listener.Addr().String(), "tls", s.server.TLSConfig != nil, "mtls", s.clientCAs.Load() != nil, "hash_generation", s.hasher.Current())
 
+	// the sweeper has to stop before Shutdown closes the backend
+	sweepCtx, stopSweeper := context.WithCancel(ctx)
+	sweeperDone := make(chan struct{})
 	go func() {
-		//err := http.ListenAndServeTLS(fmt.Sprintf(":%s", s.port), "cert.pem", "key.pem")
-		err := http.ListenAndServe(fmt.Sprintf(":%s", s.config.Service.Port), nil)
-		if err != nil {
-			log.Fatal(err.Error())
+		defer close(sweeperDone)
+		s.sweep(sweepCtx)
+	}()
+	defer func() {
+		stopSweeper()
+		<-sweeperDone
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.server.TLSConfig != nil {
+			// certificates come from TLSConfig.GetConfigForClient
+			errc <- s.server.ServeTLS(listener, "", "")
+		} else {
+			errc <- s.server.Serve(listener)
 		}
 	}()
+
+	select {
+	case err := <-errc:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		stopSweeper()
+		<-sweeperDone
+		if closeErr := s.backend.Close(); closeErr != nil {
+			s.logger.Error("failed to close the storage backend", "error", closeErr)
+		}
+		return errors.Wrap(err, "server failed")
+	case <-ctx.Done():
+	}
+
+	stopSweeper()
+	<-sweeperDone
+
+	timeout := time.Duration(s.config.Service.ShutdownTimeout) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return s.Shutdown(shutdownCtx)
+}
+
+// Handler returns the handler serving the API, without the listener
+func (s *Service) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Shutdown stops accepting new requests and waits for the in-flight ones to
+// finish, or for ctx to expire. The connections of requests still running
+// then are closed, and the backend is closed either way, so it is flushed
+func (s *Service) Shutdown(ctx context.Context) error {
+	shutdownErr := s.server.Shutdown(ctx)
+	if shutdownErr != nil {
+		s.server.Close()
+	}
+
+	if err := s.backend.Close(); err != nil {
+		return errors.Wrap(err, "failed to close the storage backend")
+	}
+	if shutdownErr != nil {
+		return errors.Wrap(shutdownErr, "failed to shut down the server")
+	}
+
+	return nil
+}
+
+// sweep purges expired records every SweepInterval seconds until ctx is
+// cancelled. Expired records already read as not found, sweeping only frees
+// the space they take up. Every sweep also moves records left under previous
+// hash generations to the current hash
+func (s *Service) sweep(ctx context.Context) {
+	if s.config.Service.SweepInterval <= 0 {
+		return
+	}
+
+	s.rehash(ctx)
+
+	ticker := time.NewTicker(time.Duration(s.config.Service.SweepInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := s.backend.DeleteExpired(now)
+			if err != nil {
+				s.logger.Error("failed to purge expired records", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				s.logger.Info("purged expired records", "count", deleted)
+			}
+			s.rehash(ctx)
+		}
+	}
+}
+
+// rehash moves the records stored under the hash of a previous generation
+// to the current hash, with the id sealed into their IdRef. Records stored
+// without one are only moved when their id is looked up, rehash logs how
+// many are left; a previous generation can be retired once none are left
+// under it
+func (s *Service) rehash(ctx context.Context) {
+	keys, err := s.backend.List()
+	if err != nil {
+		s.logger.Error("failed to list records", "error", err)
+		return
+	}
+
+	moved := 0
+	counts := map[string]int{}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+
+		generation := s.hasher.Generation(key)
+		if generation == s.hasher.Current() {
+			continue
+		}
+		if s.hasher.Known(generation) && s.rehashRecord(ctx, key) {
+			moved++
+			continue
+		}
+		counts[generation]++
+	}
+
+	if moved > 0 {
+		s.logger.Info("moved records to the current hash generation", "count", moved)
+	}
+
+	for generation, count := range counts {
+		if s.hasher.Known(generation) {
+			s.logger.Info("records left under a previous hash generation", "generation", generation, "count", count)
+		} else {
+			s.logger.Warn("records stored under a retired hash generation can't be found anymore", "generation", generation, "count", count)
+		}
+	}
+}
+
+// rehashRecord moves the record stored under key to the current hash of its
+// id, and reports whether it was moved. A record without IdRef is left alone
+func (s *Service) rehashRecord(ctx context.Context, key string) bool {
+	record, err := s.header(key)
+	if err != nil || record.IdRef == nil {
+		return false
+	}
+
+	id, err := s.hasher.Open(key, record.IdRef)
+	if err != nil {
+		s.logger.Warn("failed to open the id reference of a record", "hash", key, "error", err)
+		return false
+	}
+
+	moved, err := s.migrate(ctx, id)
+	if err != nil {
+		s.logger.Warn("failed to move record to the current hash generation", "hash", key, "error", err)
+		return false
+	}
+
+	return moved
 }
 
 func (s *Service) defaultHandler(w http.ResponseWriter, r *http.Request) {
@@ -54,6 +289,7 @@ func (s *Service) defaultHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) handleStoreRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	writeCommonHeaders(w)
 
 	if r.Method != http.MethodPost {
@@ -61,25 +297,76 @@ func (s *Service) handleStoreRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	storeReq, err := parseStoreRequest(r)
+	// raw payloads are streamed to backends that can take them so, anything
+	// else is read into memory first
+	var storeReq *api.IdMessage
+	var payload []byte
+	var err error
+	streamed := s.streamer != nil && sendsRawPayload(r)
+	if streamed {
+		storeReq, err = parseRawStoreHeaders(r)
+	} else {
+		if s.config.Service.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, s.config.Service.MaxBodyBytes)
+		}
+		storeReq, payload, err = parseStoreRequest(r)
+	}
 	if err != nil {
-		log.Println(errors.Wrap(err, "failed to parse request data"))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondPayloadTooLarge(w, []string{fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)})
+			return
+		}
+		logger.Warn("failed to parse request data", "error", err)
 		respondBadRequest(w, "bad request", []string{})
 		return
 	}
 
-	err = s.store(storeReq.Id, storeReq.Payload)
+	if storeReq.TTLSeconds < 0 {
+		respondBadRequest(w, "bad request", []string{"ttl_seconds must not be negative"})
+		return
+	}
+	if storeReq.MaxReads < 0 {
+		respondBadRequest(w, "bad request", []string{"max_reads must not be negative"})
+		return
+	}
+	if storeReq.IfMatch < 0 {
+		respondBadRequest(w, "bad request", []string{"if_match must not be negative"})
+		return
+	}
+
+	record := &backend.Record{Payload: payload, Metadata: storeReq.Metadata, MaxReads: storeReq.MaxReads}
+	if storeReq.TTLSeconds > 0 {
+		record.ExpiresAt = time.Now().Add(time.Duration(storeReq.TTLSeconds) * time.Second)
+	}
+
+	var version int
+	if streamed {
+		version, err = s.storeStream(r.Context(), storeReq.Id, record, r.Body, storeReq.IfMatch)
+	} else {
+		version, err = s.store(r.Context(), storeReq.Id, record, storeReq.IfMatch)
+	}
 	if err != nil {
-		log.Println(errors.Wrap(err, "failed to parse request data"))
-		respondInternalServerError(w, "internal server error", []string{})
+		switch err {
+		case ExistsError:
+			respondConflict(w, []string{fmt.Sprintf("text with id %s already exists", storeReq.Id)})
+		case VersionMismatchError:
+			respondConflict(w, []string{fmt.Sprintf("text with id %s is not at version %d", storeReq.Id, storeReq.IfMatch)})
+		case NotFoundError:
+			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", storeReq.Id)})
+		default:
+			logger.Error("failed to store payload", "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+		}
 		return
 	}
 
-	result, err := json.Marshal(api.Id{
-		Id: storeReq.Id,
+	result, err := json.Marshal(api.IdVersion{
+		Id:      storeReq.Id,
+		Version: version,
 	})
 	if err != nil {
-		log.Println("error marshaling response: %s", err.Error())
+		logger.Error("error marshaling response", "error", err)
 		respondInternalServerError(w, "internal server error", []string{})
 		return
 	}
@@ -95,6 +382,7 @@ func (s *Service) handleStoreRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	writeCommonHeaders(w)
 
 	if r.Method != http.MethodGet {
@@ -104,29 +392,103 @@ func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request)
 
 	retrieveReq, err := parseRetrieveRequest(r)
 	if err != nil {
-		log.Printf("failed to parse request data: %s", err.Error())
+		logger.Warn("failed to parse request data", "error", err)
+		respondBadRequest(w, "bad request", []string{})
+		return
+	}
+
+	if s.streamer != nil && acceptsRawPayload(r) {
+		record, size, payload, err := s.retrieveStream(r.Context(), retrieveReq.Id)
+		if err != nil {
+			respondRetrieveError(w, r, retrieveReq.Id, err)
+			return
+		}
+		defer payload.Close()
+
+		writeRawStream(r.Context(), w, retrieveReq.Id, record, size, payload)
+		return
+	}
+
+	record, err := s.retrieve(r.Context(), retrieveReq.Id)
+	if err != nil {
+		respondRetrieveError(w, r, retrieveReq.Id, err)
+		return
+	}
+
+	if acceptsRawPayload(r) {
+		writeRawRecord(w, retrieveReq.Id, record)
+		return
+	}
+
+	result, err := json.Marshal(api.IdMessage{
+		Id:       retrieveReq.Id,
+		Payload:  base64.StdEncoding.EncodeToString(record.Payload),
+		Metadata: record.Metadata,
+		MaxReads: record.MaxReads,
+		Version:  record.Version,
+	})
+	if err != nil {
+		logger.Error("error marshaling response", "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result:        result,
+		Errors:        []string{},
+	}
+
+	writeResponse(w, respObj)
+}
+
+// respondRetrieveError responds to a retrieve request that failed
+func respondRetrieveError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if err == NotFoundError {
+		logging.FromContext(r.Context()).Info("not found", "id", id)
+		respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", id)})
+	} else {
+		logging.FromContext(r.Context()).Error("error while retrieving text", "id", id, "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+	}
+}
+
+func (s *Service) handleMetadataRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	writeCommonHeaders(w)
+
+	if r.Method != http.MethodPost {
+		respondBadRequest(w, "unknown request", []string{})
+		return
+	}
+
+	metadataReq, err := parseMetadataRequest(r)
+	if err != nil {
+		logger.Warn("failed to parse request data", "error", err)
 		respondBadRequest(w, "bad request", []string{})
 		return
 	}
 
-	plaintext, err := s.retrieve(retrieveReq.Id)
+	err = s.updateMetadata(r.Context(), metadataReq.Id, metadataReq.Metadata, metadataReq.IfMatch)
 	if err != nil {
 		if err == NotFoundError {
-			log.Printf("not found by id %s", retrieveReq.Id)
-			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", retrieveReq.Id)})
+			logger.Info("not found", "id", metadataReq.Id)
+			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", metadataReq.Id)})
+		} else if err == VersionMismatchError {
+			respondConflict(w, []string{fmt.Sprintf("text with id %s is not at version %d", metadataReq.Id, metadataReq.IfMatch)})
 		} else {
-			log.Printf("error while retrieving text with id %s : %s", retrieveReq.Id, err.Error())
+			logger.Error("error while updating metadata of text", "id", metadataReq.Id, "error", err)
 			respondInternalServerError(w, "internal server error", []string{})
 		}
 		return
 	}
 
-	result, err := json.Marshal(api.IdMessage{
-		Id:      retrieveReq.Id,
-		Payload: plaintext,
+	result, err := json.Marshal(api.Id{
+		Id: metadataReq.Id,
 	})
 	if err != nil {
-		log.Println("error marshaling response: %s", err.Error())
+		logger.Error("error marshaling response", "error", err)
 		respondInternalServerError(w, "internal server error", []string{})
 		return
 	}
@@ -141,42 +503,550 @@ func (s *Service) handleRetrieveRequest(w http.ResponseWriter, r *http.Request)
 	writeResponse(w, respObj)
 }
 
-func (s *Service) keyHash(key string) string {
-	hasher := sha512.New()
-	saltedKey := fmt.Sprintf("%sx%s", key, s.config.Service.Salt)
-	hasher.Write([]byte(saltedKey))
-	sum := hasher.Sum(nil)
-	return base64.URLEncoding.EncodeToString(sum)
+func (s *Service) handleDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	writeCommonHeaders(w)
+
+	if r.Method != http.MethodDelete {
+		respondBadRequest(w, "unknown request", []string{})
+		return
+	}
+
+	deleteReq, err := parseDeleteRequest(r)
+	if err != nil {
+		logger.Warn("failed to parse request data", "error", err)
+		respondBadRequest(w, "bad request", []string{})
+		return
+	}
+
+	err = s.remove(r.Context(), deleteReq.Id, deleteReq.IfMatch)
+	if err != nil {
+		if err == NotFoundError {
+			logger.Info("not found", "id", deleteReq.Id)
+			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", deleteReq.Id)})
+		} else if err == VersionMismatchError {
+			respondConflict(w, []string{fmt.Sprintf("text with id %s is not at version %d", deleteReq.Id, deleteReq.IfMatch)})
+		} else {
+			logger.Error("error while deleting text", "id", deleteReq.Id, "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+		}
+		return
+	}
+
+	result, err := json.Marshal(api.Id{
+		Id: deleteReq.Id,
+	})
+	if err != nil {
+		logger.Error("error marshaling response", "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result:        result,
+		Errors:        []string{},
+	}
+
+	writeResponse(w, respObj)
 }
 
-func (s *Service) store(id, plaintext string) error {
-	hash := s.keyHash(id)
+// handleConsumeRequest counts a successful read of a record. Retrieving a
+// record doesn't count as a read, so a caller with the wrong key can't use
+// it up; the encryption-service consumes the read once it has decrypted it
+func (s *Service) handleConsumeRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	writeCommonHeaders(w)
 
-	lock.Lock()
-	defer lock.Unlock()
+	if r.Method != http.MethodPost {
+		respondBadRequest(w, "unknown request", []string{})
+		return
+	}
+
+	consumeReq, err := parseConsumeRequest(r)
+	if err != nil {
+		logger.Warn("failed to parse request data", "error", err)
+		respondBadRequest(w, "bad request", []string{})
+		return
+	}
+
+	readsLeft, err := s.consume(r.Context(), consumeReq.Id, consumeReq.IfMatch)
+	if err != nil {
+		if err == NotFoundError {
+			logger.Info("not found", "id", consumeReq.Id)
+			respondNotFound(w, []string{fmt.Sprintf("text with id %s not found", consumeReq.Id)})
+		} else if err == VersionMismatchError {
+			respondConflict(w, []string{fmt.Sprintf("text with id %s is not at version %d", consumeReq.Id, consumeReq.IfMatch)})
+		} else {
+			logger.Error("error while consuming a read of text", "id", consumeReq.Id, "error", err)
+			respondInternalServerError(w, "internal server error", []string{})
+		}
+		return
+	}
+
+	result, err := json.Marshal(api.ReadsLeft{
+		Id:        consumeReq.Id,
+		ReadsLeft: readsLeft,
+	})
+	if err != nil {
+		logger.Error("error marshaling response", "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result:        result,
+		Errors:        []string{},
+	}
+
+	writeResponse(w, respObj)
+}
+
+// handleScanRequest returns the values of a metadata entry of all records, a
+// page at a time. The encryption-service uses it to tell how many data keys
+// are still wrapped with a previous KEK, without knowing the ids
+func (s *Service) handleScanRequest(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	writeCommonHeaders(w)
+
+	if r.Method != http.MethodPost {
+		respondBadRequest(w, "unknown request", []string{})
+		return
+	}
+
+	scanReq, err := parseScanRequest(r)
+	if err != nil {
+		logger.Warn("failed to parse request data", "error", err)
+		respondBadRequest(w, "bad request", []string{})
+		return
+	}
+	if scanReq.Metadata == "" {
+		respondBadRequest(w, "bad request", []string{"metadata is required"})
+		return
+	}
+	if scanReq.Limit <= 0 || scanReq.Limit > maxScanLimit {
+		scanReq.Limit = maxScanLimit
+	}
 
-	if s.config.Service.Debug {
-		log.Printf("storing\nid: %s\ntext: %s\n", hash, plaintext)
+	values, next, err := s.scan(scanReq.Metadata, scanReq.After, scanReq.Limit)
+	if err != nil {
+		logger.Error("error while scanning metadata", "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+		return
+	}
+
+	result, err := json.Marshal(api.ScanResult{
+		Values: values,
+		Next:   next,
+	})
+	if err != nil {
+		logger.Error("error marshaling response", "error", err)
+		respondInternalServerError(w, "internal server error", []string{})
+		return
+	}
+
+	respObj := &api.Response{
+		StatusCode:    0,
+		StatusMessage: "Success",
+		Result:        result,
+		Errors:        []string{},
+	}
+
+	writeResponse(w, respObj)
+}
+
+// withHash calls fn with the current hash of id. If fn doesn't find the
+// record, one still stored under the hash of a previous generation is moved
+// to the current hash and fn is called again
+func (s *Service) withHash(ctx context.Context, id string, fn func(hash string) error) error {
+	hash := s.hasher.Hash(id)
+
+	err := fn(hash)
+	if err != backend.ErrNotFound {
+		return err
+	}
+
+	moved, moveErr := s.migrate(ctx, id)
+	if moveErr != nil {
+		return moveErr
+	}
+	if !moved {
+		return err
+	}
+
+	return fn(hash)
+}
+
+// migrate moves the record of id from the hash of a previous generation to
+// the current hash, and reports whether there was a record to move. The
+// IdRef of a moved record is sealed again with the current secret, so the
+// previous one can be retired
+func (s *Service) migrate(ctx context.Context, id string) (bool, error) {
+	hash := s.hasher.Hash(id)
+	logger := logging.FromContext(ctx)
+
+	for _, previous := range s.hasher.Previous(id) {
+		err := s.backend.Rename(previous, hash)
+		switch err {
+		case nil:
+			logger.Info("moved record to the current hash generation", "hash", hash, "generation", s.hasher.Generation(previous))
+			if err := s.sealIdRef(id, hash); err != nil {
+				// the record is found under the current hash all the same
+				logger.Warn("failed to seal the id reference of a moved record", "hash", hash, "error", err)
+			}
+			return true, nil
+		case backend.ErrNotFound:
+			continue
+		case backend.ErrExists:
+			// the current hash wins, the stale record goes with the next delete
+			logger.Warn("record stored under both the current and a previous hash generation", "hash", hash, "generation", s.hasher.Generation(previous))
+			return false, nil
+		default:
+			return false, errors.Wrap(err, "failed to move record to the current hash generation")
+		}
+	}
+
+	return false, nil
+}
+
+// sealIdRef seals id into the IdRef of the record stored under hash with the
+// current secret
+func (s *Service) sealIdRef(id, hash string) error {
+	ref, err := s.hasher.Seal(id)
+	if err != nil {
+		return err
+	}
+
+	return s.update(hash, func(record *backend.Record) error {
+		record.IdRef = ref
+		return nil
+	})
+}
+
+// store creates a new record at version 1, or replaces the one at version
+// ifMatch and bumps its version. It returns the version stored, ExistsError
+// if a new record would overwrite one and VersionMismatchError if the record
+// to replace has been changed since. Records stored before versioning have
+// version 0, they have to be deleted to be replaced
+func (s *Service) store(ctx context.Context, id string, record *backend.Record, ifMatch int) (int, error) {
+	if s.streamer != nil {
+		return s.storeStream(ctx, id, record, bytes.NewReader(record.Payload), ifMatch)
+	}
+
+	hash := s.hasher.Hash(id)
+	ref, err := s.hasher.Seal(id)
+	if err != nil {
+		return 0, err
+	}
+	record.IdRef = ref
+
+	logging.FromContext(ctx).Debug("storing", "hash", hash, "ciphertext_bytes", len(record.Payload), "if_match", ifMatch)
+
+	if ifMatch == 0 {
+		// a record under a previous hash takes the id as well
+		if _, err := s.migrate(ctx, id); err != nil {
+			return 0, err
+		}
+
+		record.Version = 1
+		err := s.backend.Create(hash, record)
+		if err == backend.ErrExists {
+			return 0, ExistsError
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to write to the storage backend")
+		}
+		return record.Version, nil
+	}
+
+	err = s.withHash(ctx, id, func(hash string) error {
+		return s.backend.Update(hash, func(existing *backend.Record) error {
+			if existing.Version != ifMatch {
+				return VersionMismatchError
+			}
+			*existing = *record
+			existing.Version = ifMatch + 1
+			return nil
+		})
+	})
+	switch err {
+	case nil:
+		return ifMatch + 1, nil
+	case VersionMismatchError:
+		return 0, err
+	case backend.ErrNotFound:
+		return 0, NotFoundError
+	default:
+		return 0, errors.Wrap(err, "failed to write to the storage backend")
+	}
+}
+
+// storeStream is store with the payload read from payload, for backends that
+// stream payloads. The payload can only be read once, so the record to
+// replace is moved to the current hash up front rather than on a miss
+func (s *Service) storeStream(ctx context.Context, id string, record *backend.Record, payload io.Reader, ifMatch int) (int, error) {
+	hash := s.hasher.Hash(id)
+	ref, err := s.hasher.Seal(id)
+	if err != nil {
+		return 0, err
+	}
+	record.IdRef = ref
+
+	logging.FromContext(ctx).Debug("storing stream", "hash", hash, "if_match", ifMatch)
+
+	// a record under a previous hash takes the id as well
+	if _, err := s.migrate(ctx, id); err != nil {
+		return 0, err
+	}
+
+	if ifMatch == 0 {
+		record.Version = 1
+		err := s.streamer.CreateStream(hash, record, payload)
+		if err == backend.ErrExists {
+			return 0, ExistsError
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to write to the storage backend")
+		}
+		return record.Version, nil
+	}
+
+	record.Version = ifMatch + 1
+	err = s.streamer.ReplaceStream(hash, record, payload, func(existing *backend.Record) error {
+		if existing.Version != ifMatch {
+			return VersionMismatchError
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		return record.Version, nil
+	case VersionMismatchError:
+		return 0, err
+	case backend.ErrNotFound:
+		return 0, NotFoundError
+	default:
+		return 0, errors.Wrap(err, "failed to write to the storage backend")
+	}
+}
+
+func (s *Service) retrieve(ctx context.Context, id string) (*backend.Record, error) {
+	var record *backend.Record
+	var hash string
+	err := s.withHash(ctx, id, func(h string) error {
+		var err error
+		record, err = s.backend.Get(h)
+		hash = h
+		return err
+	})
+	if err == backend.ErrNotFound {
+		return nil, NotFoundError
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read from the storage backend")
+	}
+
+	logging.FromContext(ctx).Debug("retrieving", "hash", hash, "ciphertext_bytes", len(record.Payload))
+
+	return record, nil
+}
+
+// retrieveStream is retrieve for backends that stream payloads. The payload
+// is returned as a reader of the given size, which has to be closed
+func (s *Service) retrieveStream(ctx context.Context, id string) (*backend.Record, int64, io.ReadCloser, error) {
+	var record *backend.Record
+	var size int64
+	var payload io.ReadCloser
+	var hash string
+	err := s.withHash(ctx, id, func(h string) error {
+		var err error
+		record, size, payload, err = s.streamer.GetStream(h)
+		hash = h
+		return err
+	})
+	if err == backend.ErrNotFound {
+		return nil, 0, nil, NotFoundError
+	}
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "failed to read from the storage backend")
+	}
+
+	logging.FromContext(ctx).Debug("retrieving stream", "hash", hash, "ciphertext_bytes", size)
+
+	return record, size, payload, nil
+}
+
+// update applies fn, which leaves the payload alone, to the record stored
+// under key. Backends that stream payloads copy it without reading it into
+// memory
+func (s *Service) update(key string, fn func(record *backend.Record) error) error {
+	if s.streamer != nil {
+		return s.streamer.UpdateHeader(key, fn)
+	}
+
+	return s.backend.Update(key, fn)
+}
+
+// header returns the record stored under key, without its payload if the
+// backend streams payloads
+func (s *Service) header(key string) (*backend.Record, error) {
+	if s.streamer == nil {
+		return s.backend.Get(key)
+	}
+
+	record, _, payload, err := s.streamer.GetStream(key)
+	if err != nil {
+		return nil, err
+	}
+	payload.Close()
+
+	return record, nil
+}
+
+func (s *Service) updateMetadata(ctx context.Context, id string, metadata map[string]string, ifMatch int) error {
+	err := s.withHash(ctx, id, func(hash string) error {
+		return s.update(hash, func(record *backend.Record) error {
+			if ifMatch != 0 && record.Version != ifMatch {
+				return VersionMismatchError
+			}
+			for k, v := range metadata {
+				if v == "" {
+					delete(record.Metadata, k)
+					continue
+				}
+				if record.Metadata == nil {
+					record.Metadata = map[string]string{}
+				}
+				record.Metadata[k] = v
+			}
+			return nil
+		})
+	})
+	if err == backend.ErrNotFound {
+		return NotFoundError
+	}
+	if err == VersionMismatchError {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to update the storage backend")
 	}
-	s.storage[hash] = plaintext
 
 	return nil
 }
 
-func (s *Service) retrieve(id string) (string, error) {
-	hash := s.keyHash(id)
+// scan returns the values of the metadata entry name of at most limit
+// records stored under keys after the key after, in key order, and the key
+// to continue after. next is empty once all records have been scanned
+func (s *Service) scan(name, after string, limit int) (values []string, next string, err error) {
+	keys, err := s.backend.List()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to list records")
+	}
+	sort.Strings(keys)
+
+	values = []string{}
+	start := sort.SearchStrings(keys, after)
+	if start < len(keys) && keys[start] == after {
+		start++
+	}
+	for i := start; i < len(keys); i++ {
+		if i-start == limit {
+			return values, keys[i-1], nil
+		}
+
+		record, err := s.header(keys[i])
+		if err == backend.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to read from the storage backend")
+		}
+		if value, ok := record.Metadata[name]; ok {
+			values = append(values, value)
+		}
+	}
+
+	return values, "", nil
+}
+
+// remove deletes the record under the hashes of all generations. Removing a
+// record that doesn't exist succeeds, so a retried delete is harmless. A non
+// zero ifMatch only removes the record if it is still at that version, and
+// returns NotFoundError if there is none and VersionMismatchError if it has
+// been replaced since
+func (s *Service) remove(ctx context.Context, id string, ifMatch int) error {
+	hash := s.hasher.Hash(id)
+
+	logging.FromContext(ctx).Debug("deleting", "hash", hash, "if_match", ifMatch)
 
-	lock.RLock()
-	defer lock.RUnlock()
+	if ifMatch != 0 {
+		err := s.withHash(ctx, id, func(hash string) error {
+			return s.backend.DeleteIf(hash, func(record *backend.Record) error {
+				if record.Version != ifMatch {
+					return VersionMismatchError
+				}
+				return nil
+			})
+		})
+		if err == backend.ErrNotFound {
+			return NotFoundError
+		}
+		if err == VersionMismatchError {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to delete from the storage backend")
+		}
+	}
 
-	plaintext, ok := s.storage[hash]
-	if !ok {
-		return "", NotFoundError
+	// stale copies left under previous generations go as well
+	for _, h := range append([]string{hash}, s.hasher.Previous(id)...) {
+		if err := s.backend.Delete(h); err != nil {
+			return errors.Wrap(err, "failed to delete from the storage backend")
+		}
 	}
 
-	if s.config.Service.Debug {
-		log.Printf("ratriving\nid: %s\ntext: %s\n", id, plaintext)
+	return nil
+}
+
+// consume atomically counts a read of the record at version ifMatch, any
+// version if it is 0, and returns how many reads are left, -1 if the number
+// of reads isn't limited. Concurrent readers can't both get the last read:
+// only one of them succeeds, the others get NotFoundError. A read of a
+// version that has been replaced since fails with VersionMismatchError. A
+// used up record reads as not found right away and is purged by the sweeper
+func (s *Service) consume(ctx context.Context, id string, ifMatch int) (int, error) {
+	var hash string
+	readsLeft := -1
+	err := s.withHash(ctx, id, func(h string) error {
+		hash = h
+		return s.update(h, func(record *backend.Record) error {
+			if ifMatch != 0 && record.Version != ifMatch {
+				return VersionMismatchError
+			}
+			if record.MaxReads == 0 {
+				return nil
+			}
+			record.Reads++
+			readsLeft = record.MaxReads - record.Reads
+			return nil
+		})
+	})
+	if err == backend.ErrNotFound {
+		return 0, NotFoundError
+	}
+	if err == VersionMismatchError {
+		return 0, err
 	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to update the storage backend")
+	}
+
+	logging.FromContext(ctx).Debug("consumed a read", "hash", hash, "reads_left", readsLeft)
 
-	return plaintext, nil
+	return readsLeft, nil
 }
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// keyPair is a certificate and private key loaded from disk, which can be
+// swapped for a new version without restarting the service
+type keyPair struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newKeyPair(certFile, keyFile string) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *keyPair) reload() error {
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load key pair %s, %s", k.certFile, k.keyFile)
+	}
+	k.cert.Store(&cert)
+	return nil
+}
+
+func (k *keyPair) get() *tls.Certificate {
+	return k.cert.Load()
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA file %s", caFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the listener's TLS config, or nil if TLS is not
+// configured. With a client CA every client must present a certificate
+// signed by it, i.e. only the encryption-service can connect
+func (s *Service) serverTLSConfig() *tls.Config {
+	if s.serverCert == nil {
+		return nil
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// the config is built per connection, so reloaded certificates and CAs
+	// apply to new connections straight away
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*s.serverCert.get()}
+		if pool := s.clientCAs.Load(); pool != nil {
+			cfg.ClientCAs = pool
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return cfg, nil
+	}
+
+	return base
+}
+
+// ReloadCertificates reads the certificate, key and client CA from disk
+// again. Connections made from then on use the new ones, established
+// connections are not affected. On error the previous certificates stay in
+// use
+func (s *Service) ReloadCertificates() error {
+	if s.serverCert == nil {
+		return nil
+	}
+
+	var pool *x509.CertPool
+	if s.config.TLS.ClientCAFile != "" {
+		var err error
+		pool, err = loadCertPool(s.config.TLS.ClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.serverCert.reload(); err != nil {
+		return err
+	}
+	if pool != nil {
+		s.clientCAs.Store(pool)
+	}
+
+	return nil
+}